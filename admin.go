@@ -0,0 +1,541 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/ficoos/kokosync/kosync"
+	"github.com/ficoos/kokosync/store"
+)
+
+// requireToken rejects requests that don't carry the bearer token.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			slog.WarnContext(r.Context(), "admin request rejected", "uri", r.RequestURI)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kokosync admin"`)
+			recordLogin(r.Context(), kosync.ErrUnauthorized)
+			writeJSONError(w, r, http.StatusUnauthorized, errors.New("invalid or missing admin token"))
+			return
+		}
+		recordLogin(r.Context(), nil)
+		next.ServeHTTP(w, r)
+	})
+}
+
+type progressPatch struct {
+	Progress   *string  `json:"progress"`
+	Percentage *float64 `json:"percentage"`
+	Device     *string  `json:"device"`
+	DeviceID   *string  `json:"device_id"`
+	Timestamp  *int64   `json:"timestamp"`
+}
+
+func (p *progressPatch) apply(progress *kosync.Progress) {
+	if p.Progress != nil {
+		progress.Progress = *p.Progress
+	}
+	if p.Percentage != nil {
+		progress.Percentage = *p.Percentage
+	}
+	if p.Device != nil {
+		progress.Device = *p.Device
+	}
+	if p.DeviceID != nil {
+		progress.DeviceID = *p.DeviceID
+	}
+	if p.Timestamp != nil {
+		progress.Timestamp = *p.Timestamp
+	}
+}
+
+// maxImportSize bounds uploads to the import endpoint.
+const maxImportSize = 64 << 20
+
+type AdminServer struct {
+	bridge *BridgeImpl
+	dal    store.ProgressStore
+}
+
+// NewAdminServer returns the admin API, every request must carry token as
+// a bearer token. Routes are rooted at /admin/.
+func NewAdminServer(bridge *BridgeImpl, token string) http.Handler {
+	s := &AdminServer{bridge: bridge, dal: bridge.dal}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/users", s.listUsers)
+	mux.HandleFunc("DELETE /admin/users/{user}", s.deleteUser)
+	mux.HandleFunc("GET /admin/users/{user}/progress", s.listProgress)
+	mux.HandleFunc("GET /admin/users/{user}/progress/{document}", s.getProgress)
+	mux.HandleFunc("PATCH /admin/users/{user}/progress/{document}", s.patchProgress)
+	mux.HandleFunc("DELETE /admin/users/{user}/progress/{document}", s.deleteProgress)
+	mux.HandleFunc("GET /admin/users/{user}/progress/{document}/devices", s.listDeviceProgress)
+	mux.HandleFunc("GET /admin/users/{user}/devices", s.listUserDevices)
+	mux.HandleFunc("PATCH /admin/users/{user}/devices/{device}", s.patchDevice)
+	mux.HandleFunc("GET /admin/users/{user}/tokens", s.listUserTokens)
+	mux.HandleFunc("POST /admin/users/{user}/tokens", s.createToken)
+	mux.HandleFunc("DELETE /admin/users/{user}/tokens/{token}", s.revokeToken)
+	mux.HandleFunc("GET /admin/devices", s.listDevices)
+	mux.HandleFunc("GET /admin/tokens", s.listTokens)
+	mux.HandleFunc("GET /admin/aliases", s.listAliases)
+	mux.HandleFunc("PUT /admin/aliases/{alias}", s.setAlias)
+	mux.HandleFunc("DELETE /admin/aliases/{alias}", s.deleteAlias)
+	mux.HandleFunc("GET /admin/documents", s.listDocuments)
+	mux.HandleFunc("GET /admin/document-aliases", s.listDocumentAliases)
+	mux.HandleFunc("PUT /admin/document-aliases/{alias}", s.setDocumentAlias)
+	mux.HandleFunc("DELETE /admin/document-aliases/{alias}", s.deleteDocumentAlias)
+	mux.HandleFunc("GET /admin/export", s.exportProgress)
+	mux.HandleFunc("POST /admin/import", s.importProgress)
+	mux.HandleFunc("GET /admin/webhooks/deliveries", s.listWebhookDeliveries)
+
+	return requireToken(token, mux)
+}
+
+func (s *AdminServer) listUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := s.dal.ListUsers(r.Context())
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("list users: %s", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, users)
+}
+
+func (s *AdminServer) listDocuments(w http.ResponseWriter, r *http.Request) {
+	docs, err := s.dal.ListDocuments(r.Context())
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("list documents: %s", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, docs)
+}
+
+func (s *AdminServer) deleteUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.pathUser(w, r)
+	if !ok {
+		return
+	}
+	deleted, err := s.dal.DeleteUser(r.Context(), user)
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("delete user [user=%s]: %s", user, err))
+		return
+	}
+
+	slog.InfoContext(r.Context(), "purged user", "user", user, "deleted", deleted)
+	writeJSON(w, r, http.StatusOK, map[string]int64{"deleted": deleted})
+}
+
+func (s *AdminServer) listProgress(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.pathUser(w, r)
+	if !ok {
+		return
+	}
+	progress, err := s.dal.ListProgress(r.Context(), user)
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("list progress [user=%s]: %s", user, err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, progress)
+}
+
+// pathDocument returns the validated document hash from the path or writes
+// an error response.
+func pathDocument(w http.ResponseWriter, r *http.Request) (string, bool) {
+	document, err := kosync.NormalizeDocumentHash(r.PathValue("document"))
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, err)
+		return "", false
+	}
+
+	return document, true
+}
+
+// pathCanonicalDocument returns the document from the path resolved through
+// document aliases, the document its progress is stored under, or writes an
+// error response.
+func pathCanonicalDocument(w http.ResponseWriter, r *http.Request, bridge *BridgeImpl) (string, bool) {
+	document, ok := pathDocument(w, r)
+	if !ok {
+		return "", false
+	}
+	canonical, err := bridge.canonicalDocument(r.Context(), document)
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, err)
+		return "", false
+	}
+
+	return canonical, true
+}
+
+// pathUser returns the user from the path the way logins are stored,
+// normalized and with aliases resolved, or writes an error response.
+func (s *AdminServer) pathUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user, err := s.bridge.canonicalUser(r.Context(), r.PathValue("user"))
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, err)
+		return "", false
+	}
+
+	return user, true
+}
+
+func (s *AdminServer) getProgress(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.pathUser(w, r)
+	if !ok {
+		return
+	}
+	document, ok := pathCanonicalDocument(w, r, s.bridge)
+	if !ok {
+		return
+	}
+
+	progress, err := s.dal.GetProgress(r.Context(), user, document)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeJSONError(w, r, http.StatusNotFound, kosync.ErrDocNotFound)
+			return
+		}
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("get progress [user=%s document=%s]: %s", user, document, err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, progress)
+}
+
+func (s *AdminServer) patchProgress(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.pathUser(w, r)
+	if !ok {
+		return
+	}
+	document, ok := pathCanonicalDocument(w, r, s.bridge)
+	if !ok {
+		return
+	}
+
+	var patch progressPatch
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, kosync.DefaultMaxBodySize))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&patch)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, fmt.Errorf("decode patch: %s", err))
+		return
+	}
+
+	progress, err := s.dal.GetProgress(r.Context(), user, document)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeJSONError(w, r, http.StatusNotFound, kosync.ErrDocNotFound)
+			return
+		}
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("get progress [user=%s document=%s]: %s", user, document, err))
+		return
+	}
+
+	patch.apply(progress)
+	err = progress.Validate()
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.dal.UpdateProgress(r.Context(), user, progress)
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("update progress [user=%s document=%s]: %s", user, document, err))
+		return
+	}
+
+	slog.InfoContext(r.Context(), "patched progress", "user", user, "document", document)
+	writeJSON(w, r, http.StatusOK, progress)
+}
+
+func (s *AdminServer) deleteProgress(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.pathUser(w, r)
+	if !ok {
+		return
+	}
+	document, ok := pathCanonicalDocument(w, r, s.bridge)
+	if !ok {
+		return
+	}
+
+	err := s.dal.DeleteProgress(r.Context(), user, document)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeJSONError(w, r, http.StatusNotFound, kosync.ErrDocNotFound)
+			return
+		}
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("delete progress [user=%s document=%s]: %s", user, document, err))
+		return
+	}
+
+	slog.InfoContext(r.Context(), "deleted progress", "user", user, "document", document)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *AdminServer) listDeviceProgress(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.pathUser(w, r)
+	if !ok {
+		return
+	}
+	document, ok := pathCanonicalDocument(w, r, s.bridge)
+	if !ok {
+		return
+	}
+	listDeviceProgress(w, r, s.dal, user, document, document)
+}
+
+func (s *AdminServer) listDevices(w http.ResponseWriter, r *http.Request) {
+	listDevices(w, r, s.dal, "")
+}
+
+func (s *AdminServer) listUserDevices(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.pathUser(w, r)
+	if !ok {
+		return
+	}
+	listDevices(w, r, s.dal, user)
+}
+
+func (s *AdminServer) patchDevice(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.pathUser(w, r)
+	if !ok {
+		return
+	}
+	patchDevice(w, r, s.dal, user, r.PathValue("device"))
+}
+
+func (s *AdminServer) listTokens(w http.ResponseWriter, r *http.Request) {
+	listTokens(w, r, s.dal, "")
+}
+
+func (s *AdminServer) listUserTokens(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.pathUser(w, r)
+	if !ok {
+		return
+	}
+	listTokens(w, r, s.dal, user)
+}
+
+type tokenRequest struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+// createToken issues a sync token, the user's Komga password is checked
+// once and not kept.
+func (s *AdminServer) createToken(w http.ResponseWriter, r *http.Request) {
+	// issueToken checks the password for the login as given and stores the
+	// token under the canonical user
+	login := r.PathValue("user")
+	var req tokenRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, kosync.DefaultMaxBodySize))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&req)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, fmt.Errorf("decode token request: %s", err))
+		return
+	}
+	issued, err := s.bridge.issueToken(r.Context(), login, req.Password, req.Name)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, kosync.ErrUnauthorized) {
+			status = http.StatusForbidden
+		} else if errors.Is(err, kosync.ErrBadRequest) {
+			status = http.StatusBadRequest
+		}
+		writeJSONError(w, r, status, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusCreated, issued)
+}
+
+func (s *AdminServer) revokeToken(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.pathUser(w, r)
+	if !ok {
+		return
+	}
+	revokeToken(w, r, s.dal, user, r.PathValue("token"))
+}
+
+func (s *AdminServer) listAliases(w http.ResponseWriter, r *http.Request) {
+	listAliases(w, r, s.dal)
+}
+
+type aliasRequest struct {
+	User string `json:"user"`
+}
+
+func (s *AdminServer) setAlias(w http.ResponseWriter, r *http.Request) {
+	var req aliasRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, kosync.DefaultMaxBodySize))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&req)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, fmt.Errorf("decode alias: %s", err))
+		return
+	}
+
+	alias, err := s.bridge.setAlias(r.Context(), r.PathValue("alias"), req.User)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, kosync.ErrBadRequest) {
+			status = http.StatusBadRequest
+		}
+		writeJSONError(w, r, status, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, alias)
+}
+
+func (s *AdminServer) deleteAlias(w http.ResponseWriter, r *http.Request) {
+	alias := s.bridge.users.Normalize(r.PathValue("alias"))
+	err := s.dal.DeleteAlias(r.Context(), alias)
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONError(w, r, http.StatusNotFound, errAliasNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("delete alias [alias=%s]: %s", alias, err))
+		return
+	}
+
+	slog.InfoContext(r.Context(), "deleted user alias", "alias", alias)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *AdminServer) listDocumentAliases(w http.ResponseWriter, r *http.Request) {
+	listDocumentAliases(w, r, s.dal)
+}
+
+type documentAliasRequest struct {
+	Document string `json:"document"`
+}
+
+type documentAliasResponse struct {
+	*store.DocumentAlias
+	// Merged is the number of users whose progress of the alias was merged
+	Merged int `json:"merged"`
+}
+
+func (s *AdminServer) setDocumentAlias(w http.ResponseWriter, r *http.Request) {
+	var req documentAliasRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, kosync.DefaultMaxBodySize))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&req)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, fmt.Errorf("decode document alias: %s", err))
+		return
+	}
+
+	alias, merged, err := s.bridge.setDocumentAlias(r.Context(), r.PathValue("alias"), req.Document)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, kosync.ErrBadRequest) {
+			status = http.StatusBadRequest
+		}
+		writeJSONError(w, r, status, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, &documentAliasResponse{DocumentAlias: alias, Merged: merged})
+}
+
+func (s *AdminServer) deleteDocumentAlias(w http.ResponseWriter, r *http.Request) {
+	alias, err := kosync.NormalizeDocumentHash(r.PathValue("alias"))
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	err = s.dal.DeleteDocumentAlias(r.Context(), alias)
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONError(w, r, http.StatusNotFound, errDocumentAliasNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("delete document alias [alias=%s]: %s", alias, err))
+		return
+	}
+
+	slog.InfoContext(r.Context(), "deleted document alias", "alias", alias)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *AdminServer) exportProgress(w http.ResponseWriter, r *http.Request) {
+	format := FormatJSONL
+	if raw := r.URL.Query().Get("format"); raw != "" {
+		var err error
+		format, err = ParseExportFormat(raw)
+		if err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, err)
+			return
+		}
+	}
+	var user string
+	if login := r.URL.Query().Get("user"); login != "" {
+		var err error
+		user, err = s.bridge.canonicalUser(r.Context(), login)
+		if err != nil {
+			writeJSONError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="kokosync-progress.%s"`, format))
+	count, err := ExportProgress(r.Context(), s.dal, w, format, user)
+	if err != nil {
+		// The status is already out, all we can do is cut the export short
+		slog.ErrorContext(r.Context(), "export failed", "error", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "exported progress", "user", user, "records", count)
+}
+
+func (s *AdminServer) importProgress(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format, err := ParseExportFormat(query.Get("format"))
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	policy, err := store.ParseConflictPolicy(query.Get("policy"))
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxImportSize)
+	res, err := ImportProgress(r.Context(), s.bridge, body, format, policy, query.Get("user"))
+	if errors.Is(err, kosync.ErrBadRequest) {
+		// Anything wrong with the input aborts the import, the details
+		// are in the message
+		writeJSONError(w, r, http.StatusBadRequest, fmt.Errorf("import: %s", err))
+		return
+	}
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("import: %s", err))
+		return
+	}
+
+	slog.InfoContext(r.Context(), "imported progress", "imported", res.Imported, "skipped", res.Skipped, "policy", policy)
+	writeJSON(w, r, http.StatusOK, res)
+}
+
+func (s *AdminServer) listWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if s.bridge.webhooks == nil {
+		writeJSONError(w, r, http.StatusNotFound, errors.New("no webhooks are configured"))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, s.bridge.webhooks.Deliveries())
+}
@@ -0,0 +1,716 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ficoos/kokosync/importer"
+	"github.com/ficoos/kokosync/kosync"
+	"github.com/ficoos/kokosync/store"
+	"golang.org/x/term"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(conf *Config, fs *flag.FlagSet, args []string) error
+}
+
+var commands = []*command{
+	{name: "serve", usage: "run the sync server (default)"},
+	{name: "export", usage: "export progress as JSON Lines or CSV", run: exportCommand},
+	{name: "import", usage: "import progress exported as JSON Lines or CSV", run: importCommand},
+	{name: "backup", usage: "back the SQLite database up while it is in use", run: backupCommand},
+	{name: "restore", usage: "replace the SQLite database with a backup", run: restoreCommand},
+	{name: "import-kosync", usage: "import progress from a koreader-sync-server Redis dump", run: importKosyncCommand},
+	{name: "import-sidecars", usage: "import progress from KOReader .sdr sidecar directories", run: importSidecarsCommand},
+	{name: "create-token", usage: "issue a sync token devices use in place of the Komga password", run: createTokenCommand},
+	{name: "list-tokens", usage: "list sync tokens", run: listTokensCommand},
+	{name: "revoke-token", usage: "revoke a sync token", run: revokeTokenCommand},
+	{name: "add-user-alias", usage: "let another login name sync as a user", run: addUserAliasCommand},
+	{name: "remove-user-alias", usage: "remove a login name alias", run: removeUserAliasCommand},
+	{name: "list-user-aliases", usage: "list login name aliases", run: listUserAliasesCommand},
+	{name: "add-document-alias", usage: "let another document hash share a document's progress", run: addDocumentAliasCommand},
+	{name: "remove-document-alias", usage: "remove a document hash alias", run: removeDocumentAliasCommand},
+	{name: "list-document-aliases", usage: "list document hash aliases", run: listDocumentAliasesCommand},
+	{name: "reencrypt", usage: "encrypt stored progress with the current key, or decrypt it", run: reencryptCommand},
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: %s [command] [flags]\n\ncommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-16s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintf(w, "\nconfiguration is read from %s* environment variables\n", EnvPrefix)
+}
+
+// runCommand runs a command other than serve.
+func runCommand(conf *Config, args []string) error {
+	name := args[0]
+	if name == "help" || name == "-h" || name == "-help" || name == "--help" {
+		usage(os.Stdout)
+		return nil
+	}
+	for _, c := range commands {
+		if c.name != name || c.run == nil {
+			continue
+		}
+		fs := flag.NewFlagSet(c.name, flag.ExitOnError)
+		return c.run(conf, fs, args[1:])
+	}
+
+	usage(os.Stderr)
+	return fmt.Errorf("unknown command %q", name)
+}
+
+// openBridge opens the store for commands that resolve user names the way
+// the server does.
+func openBridge(conf *Config) (*BridgeImpl, error) {
+	bridge, err := NewStore(conf.UpstreamURL, conf.DBPath, conf.DBOptions)
+	if err != nil {
+		return nil, err
+	}
+	bridge.users = conf.Users
+	return bridge, nil
+}
+
+func exportCommand(conf *Config, fs *flag.FlagSet, args []string) error {
+	user := fs.String("user", "", "only export this user's progress")
+	rawFormat := fs.String("format", "", "jsonl or csv, guessed from -o when not set, jsonl otherwise")
+	output := fs.String("o", "-", "output file, - for stdout")
+	fs.Parse(args)
+
+	format := FormatJSONL
+	if *rawFormat != "" {
+		var err error
+		format, err = ParseExportFormat(*rawFormat)
+		if err != nil {
+			return err
+		}
+	} else if f, ok := FormatFromFileName(*output); ok {
+		format = f
+	}
+
+	bridge, err := openBridge(conf)
+	if err != nil {
+		return err
+	}
+	defer bridge.dal.Close()
+	if *user != "" {
+		*user, err = bridge.canonicalUser(context.Background(), *user)
+		if err != nil {
+			return err
+		}
+	}
+
+	out := os.Stdout
+	if *output != "-" {
+		out, err = os.Create(*output)
+		if err != nil {
+			return err
+		}
+	}
+
+	count, err := ExportProgress(context.Background(), bridge.dal, out, format, *user)
+	if out != os.Stdout {
+		closeErr := out.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "exported %d records\n", count)
+	return nil
+}
+
+func importCommand(conf *Config, fs *flag.FlagSet, args []string) error {
+	user := fs.String("user", "", "owner of records that don't name a user")
+	rawFormat := fs.String("format", "", "jsonl or csv, guessed from the file name when not set")
+	rawPolicy := fs.String("policy", string(store.ConflictNewer), "what to do with existing progress: newer, overwrite or skip")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s import [flags] FILE|-\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected a single file to import")
+	}
+	input := fs.Arg(0)
+
+	policy, err := store.ParseConflictPolicy(*rawPolicy)
+	if err != nil {
+		return err
+	}
+
+	var format ExportFormat
+	if *rawFormat != "" {
+		format, err = ParseExportFormat(*rawFormat)
+		if err != nil {
+			return err
+		}
+	} else if f, ok := FormatFromFileName(input); ok {
+		format = f
+	} else {
+		return fmt.Errorf("can't tell the format of %s, use -format", input)
+	}
+
+	r := io.Reader(os.Stdin)
+	if input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	bridge, err := openBridge(conf)
+	if err != nil {
+		return err
+	}
+	defer bridge.dal.Close()
+
+	res, err := ImportProgress(context.Background(), bridge, r, format, policy, strings.TrimSpace(*user))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "imported %d records, skipped %d\n", res.Imported, res.Skipped)
+	return nil
+}
+
+func importKosyncCommand(conf *Config, fs *flag.FlagSet, args []string) error {
+	user := fs.String("user", "", "only import this user's progress")
+	rawPolicy := fs.String("policy", string(store.ConflictNewer), "what to do with existing progress: newer, overwrite or skip")
+	dryRun := fs.Bool("dry-run", false, "print the records as JSON Lines instead of importing them")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s import-kosync [flags] DUMP|-\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected a single dump to import")
+	}
+
+	policy, err := store.ParseConflictPolicy(*rawPolicy)
+	if err != nil {
+		return err
+	}
+
+	r := io.Reader(os.Stdin)
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	records, err := importer.ReadKosyncRedis(r)
+	if err != nil {
+		return err
+	}
+
+	return importRecords(conf, records, policy, *dryRun, *user)
+}
+
+func importSidecarsCommand(conf *Config, fs *flag.FlagSet, args []string) error {
+	var opts importer.SidecarOptions
+	fs.StringVar(&opts.User, "user", "", "owner of the progress (required)")
+	fs.StringVar(&opts.Device, "device", "KOReader", "device name recorded with the progress")
+	fs.StringVar(&opts.DeviceID, "device-id", "koreader-sidecars", "device id recorded with the progress")
+	rawPolicy := fs.String("policy", string(store.ConflictNewer), "what to do with existing progress: newer, overwrite or skip")
+	dryRun := fs.Bool("dry-run", false, "print the records as JSON Lines instead of importing them")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s import-sidecars [flags] DIR...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	opts.User = strings.TrimSpace(opts.User)
+	if fs.NArg() == 0 || opts.User == "" {
+		fs.Usage()
+		return errors.New("expected -user and at least one directory")
+	}
+
+	policy, err := store.ParseConflictPolicy(*rawPolicy)
+	if err != nil {
+		return err
+	}
+
+	var records []*importer.Record
+	for _, dir := range fs.Args() {
+		found, err := importer.ReadSidecars(dir, opts)
+		if err != nil {
+			return err
+		}
+		records = append(records, found...)
+	}
+
+	return importRecords(conf, records, policy, *dryRun, "")
+}
+
+// importRecords validates records read by an importer and imports them in a
+// single transaction, or prints them when dryRun is set. Users are stored
+// under their canonical name, only records of user are kept when it is set.
+// Dry runs don't open the store so they only normalize user names, aliases
+// aren't resolved.
+func importRecords(conf *Config, records []*importer.Record, policy store.ConflictPolicy, dryRun bool, user string) error {
+	for _, rec := range records {
+		err := rec.Validate()
+		if err != nil {
+			return fmt.Errorf("user %s document %s: %s", rec.User, rec.Document, err)
+		}
+	}
+
+	names := &userNames{users: conf.Users}
+	documents := documentAliases{}
+	var bridge *BridgeImpl
+	if !dryRun {
+		var err error
+		bridge, err = openBridge(conf)
+		if err != nil {
+			return err
+		}
+		defer bridge.dal.Close()
+		names, err = bridge.loadUserNames(context.Background())
+		if err != nil {
+			return err
+		}
+		documents, err = bridge.loadDocumentAliases(context.Background())
+		if err != nil {
+			return err
+		}
+	}
+	filtered := records[:0]
+	for _, rec := range records {
+		rec.User = names.canonical(rec.User)
+		rec.Document = documents.canonical(rec.Document)
+		if user == "" || rec.User == names.canonical(user) {
+			filtered = append(filtered, rec)
+		}
+	}
+	records = filtered
+
+	if dryRun {
+		enc := json.NewEncoder(os.Stdout)
+		for _, rec := range records {
+			err := enc.Encode(rec)
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(os.Stderr, "found %d records\n", len(records))
+		return nil
+	}
+
+	i := 0
+	imported, skipped, err := bridge.dal.ImportProgress(context.Background(), policy, func() (*store.ProgressRecord, error) {
+		if i == len(records) {
+			return nil, io.EOF
+		}
+		rec := records[i]
+		i++
+		return &store.ProgressRecord{User: rec.User, Progress: rec.Progress}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "imported %d records, skipped %d\n", imported, skipped)
+	return nil
+}
+
+func backupCommand(conf *Config, fs *flag.FlagSet, args []string) error {
+	keep := fs.Int("keep", 0, "when backing up to a directory, how many snapshots to keep, 0 keeps all")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s backup [flags] FILE|DIR\n\nbacking up to a directory writes a timestamped snapshot\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected a backup file or directory")
+	}
+	target := fs.Arg(0)
+
+	dal, err := store.Open(conf.DBPath, conf.DBOptions)
+	if err != nil {
+		return err
+	}
+	defer dal.Close()
+	b, ok := dal.(store.Backuper)
+	if !ok {
+		return errors.New("backups are only supported with SQLite")
+	}
+
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		target, err = WriteSnapshot(context.Background(), b, target, *keep)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = b.Backup(context.Background(), target)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "backed up to %s\n", target)
+	return nil
+}
+
+func restoreCommand(conf *Config, fs *flag.FlagSet, args []string) error {
+	check := fs.Bool("check", false, "only check the backup can be restored")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s restore [flags] FILE\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected a backup to restore")
+	}
+	snapshot := fs.Arg(0)
+
+	ctx := context.Background()
+	version, err := store.CheckSQLiteSnapshot(ctx, snapshot)
+	if err != nil {
+		return fmt.Errorf("check %s: %s", snapshot, err)
+	}
+	if *check {
+		fmt.Fprintf(os.Stderr, "%s is a valid backup with schema version %d\n", snapshot, version)
+		return nil
+	}
+
+	path, ok := store.SQLitePath(conf.DBPath)
+	if !ok {
+		return errors.New("restoring is only supported with SQLite")
+	}
+	err = store.RestoreSQLite(ctx, snapshot, path, conf.DBOptions)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "restored %s from %s\n", path, snapshot)
+	return nil
+}
+
+func reencryptCommand(conf *Config, fs *flag.FlagSet, args []string) error {
+	decrypt := fs.Bool("decrypt", false, "decrypt everything so encryption can be turned off")
+	fs.Parse(args)
+
+	cipher := conf.DBOptions.Cipher
+	if cipher == nil {
+		return fmt.Errorf("encryption isn't configured, set %sENCRYPTION_KEYS and %sENCRYPTION_INDEX_KEY", EnvPrefix, EnvPrefix)
+	}
+	// the store is opened as is, it may hold anything from plaintext to
+	// values encrypted with retired keys
+	opts := conf.DBOptions
+	opts.Cipher = nil
+	dal, err := store.Open(conf.DBPath, opts)
+	if err != nil {
+		return err
+	}
+	defer dal.Close()
+
+	count, err := store.Reencrypt(context.Background(), dal, cipher, *decrypt)
+	if err != nil {
+		return err
+	}
+
+	if *decrypt {
+		fmt.Fprintf(os.Stderr, "decrypted %d values\n", count)
+	} else {
+		fmt.Fprintf(os.Stderr, "encrypted %d values\n", count)
+	}
+	return nil
+}
+
+// readPassword prompts for a password without echoing it when standard
+// input is a terminal, otherwise it reads the first line of standard input.
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
+	}
+
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return strings.TrimRight(password, "\r\n"), nil
+}
+
+func createTokenCommand(conf *Config, fs *flag.FlagSet, args []string) error {
+	user := fs.String("user", "", "owner of the token (required)")
+	name := fs.String("name", "", "what the token is for, e.g. the device")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s create-token [flags]\n\nthe user's Komga password is read from standard input\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *user == "" {
+		fs.Usage()
+		return errors.New("expected -user")
+	}
+
+	password, err := readPassword(fmt.Sprintf("Komga password for %s: ", *user))
+	if err != nil {
+		return fmt.Errorf("read password: %s", err)
+	}
+
+	bridge, err := openBridge(conf)
+	if err != nil {
+		return err
+	}
+	defer bridge.dal.Close()
+
+	issued, err := bridge.issueToken(context.Background(), *user, password, *name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "issued token %s, use it as the password in KOReader, it isn't shown again\n", issued.ID)
+	fmt.Println(issued.Secret)
+	return nil
+}
+
+func listTokensCommand(conf *Config, fs *flag.FlagSet, args []string) error {
+	user := fs.String("user", "", "only list this user's tokens")
+	fs.Parse(args)
+
+	bridge, err := openBridge(conf)
+	if err != nil {
+		return err
+	}
+	defer bridge.dal.Close()
+	if *user != "" {
+		*user, err = bridge.canonicalUser(context.Background(), *user)
+		if err != nil {
+			return err
+		}
+	}
+
+	tokens, err := bridge.dal.ListTokens(context.Background(), *user)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tID\tNAME\tCREATED\tLAST USED")
+	for _, t := range tokens {
+		lastUsed := "never"
+		if t.LastUsed != 0 {
+			lastUsed = time.Unix(t.LastUsed, 0).UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", t.User, t.ID, t.Name, time.Unix(t.Created, 0).UTC().Format(time.RFC3339), lastUsed)
+	}
+	return tw.Flush()
+}
+
+func revokeTokenCommand(conf *Config, fs *flag.FlagSet, args []string) error {
+	user := fs.String("user", "", "owner of the token (required)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s revoke-token [flags] ID\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *user == "" || fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected -user and a token id")
+	}
+
+	bridge, err := openBridge(conf)
+	if err != nil {
+		return err
+	}
+	defer bridge.dal.Close()
+	owner, err := bridge.canonicalUser(context.Background(), *user)
+	if err != nil {
+		return err
+	}
+
+	err = bridge.dal.RevokeToken(context.Background(), owner, fs.Arg(0))
+	if errors.Is(err, store.ErrNotFound) {
+		return errTokenNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "revoked token %s\n", fs.Arg(0))
+	return nil
+}
+
+func addUserAliasCommand(conf *Config, fs *flag.FlagSet, args []string) error {
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s add-user-alias ALIAS USER\n", os.Args[0])
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("expected an alias and a user")
+	}
+
+	bridge, err := openBridge(conf)
+	if err != nil {
+		return err
+	}
+	defer bridge.dal.Close()
+
+	alias, err := bridge.setAlias(context.Background(), fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "%s now syncs as %s\n", alias.Alias, alias.User)
+	return nil
+}
+
+func removeUserAliasCommand(conf *Config, fs *flag.FlagSet, args []string) error {
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s remove-user-alias ALIAS\n", os.Args[0])
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected an alias")
+	}
+
+	dal, err := store.Open(conf.DBPath, conf.DBOptions)
+	if err != nil {
+		return err
+	}
+	defer dal.Close()
+
+	alias := conf.Users.Normalize(fs.Arg(0))
+	err = dal.DeleteAlias(context.Background(), alias)
+	if errors.Is(err, store.ErrNotFound) {
+		return errAliasNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "removed alias %s\n", alias)
+	return nil
+}
+
+func listUserAliasesCommand(conf *Config, fs *flag.FlagSet, args []string) error {
+	fs.Parse(args)
+
+	dal, err := store.Open(conf.DBPath, conf.DBOptions)
+	if err != nil {
+		return err
+	}
+	defer dal.Close()
+
+	aliases, err := dal.ListAliases(context.Background())
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ALIAS\tUSER")
+	for _, a := range aliases {
+		fmt.Fprintf(tw, "%s\t%s\n", a.Alias, a.User)
+	}
+	return tw.Flush()
+}
+
+func addDocumentAliasCommand(conf *Config, fs *flag.FlagSet, args []string) error {
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s add-document-alias ALIAS DOCUMENT\n\nprogress already saved under ALIAS is merged into DOCUMENT, the newer one wins\n", os.Args[0])
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("expected an alias and a document")
+	}
+
+	bridge, err := openBridge(conf)
+	if err != nil {
+		return err
+	}
+	defer bridge.dal.Close()
+
+	alias, merged, err := bridge.setDocumentAlias(context.Background(), fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "%s now shares the progress of %s, merged the progress of %d users\n", alias.Alias, alias.Document, merged)
+	return nil
+}
+
+func removeDocumentAliasCommand(conf *Config, fs *flag.FlagSet, args []string) error {
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s remove-document-alias ALIAS\n", os.Args[0])
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected an alias")
+	}
+	alias, err := kosync.NormalizeDocumentHash(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	dal, err := store.Open(conf.DBPath, conf.DBOptions)
+	if err != nil {
+		return err
+	}
+	defer dal.Close()
+
+	err = dal.DeleteDocumentAlias(context.Background(), alias)
+	if errors.Is(err, store.ErrNotFound) {
+		return errDocumentAliasNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "removed document alias %s\n", alias)
+	return nil
+}
+
+func listDocumentAliasesCommand(conf *Config, fs *flag.FlagSet, args []string) error {
+	fs.Parse(args)
+
+	dal, err := store.Open(conf.DBPath, conf.DBOptions)
+	if err != nil {
+		return err
+	}
+	defer dal.Close()
+
+	aliases, err := dal.ListDocumentAliases(context.Background())
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ALIAS\tDOCUMENT")
+	for _, a := range aliases {
+		fmt.Fprintf(tw, "%s\t%s\n", a.Alias, a.Document)
+	}
+	return tw.Flush()
+}
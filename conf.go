@@ -1,19 +1,54 @@
 package main
 
 import (
+	"encoding/base64"
 	"fmt"
+	"io/fs"
+	"log/slog"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/ficoos/kokosync/kosync"
+	"github.com/ficoos/kokosync/mqtt"
+	"github.com/ficoos/kokosync/store"
+	"github.com/ficoos/kokosync/webhook"
 )
 
 const EnvPrefix = "MKSYNC_"
 
 type Config struct {
-	DBPath        string
-	UpstreamURL   *url.URL
-	ListenAddress string
-	ProxyPrefix   string
+	DBPath            string
+	DBOptions         store.Options
+	Snapshots         SnapshotConfig
+	Webhooks          webhook.Config
+	MQTT              mqtt.Config
+	UpstreamURL       *url.URL
+	ListenAddresses   []string
+	UnixSocketOptions UnixSocketOptions
+	ProxyPrefix       string
+	TrustedProxies    []string
+	LogFormat         string
+	LogLevel          slog.Level
+
+	ReadyCheckUpstream bool
+	ReadyUpstreamTTL   time.Duration
+
+	RateLimit RateLimitConfig
+
+	MaxBodySize         int64
+	RejectUnknownFields bool
+
+	AdminToken           string
+	AdminListenAddresses []string
+	LegacyUser           string
+	Users                UserNormalization
+
+	WebUI         bool
+	SessionSecret string
+	SessionTTL    time.Duration
 }
 
 func ConfigFromEnvironment() (*Config, error) {
@@ -21,26 +56,383 @@ func ConfigFromEnvironment() (*Config, error) {
 	if len(dbPath) == 0 {
 		dbPath = "./data.db"
 	}
+	dbOptions := store.DefaultOptions
+	if v := strings.TrimSpace(os.Getenv(EnvPrefix + "SQLITE_JOURNAL_MODE")); v != "" {
+		dbOptions.JournalMode = v
+	}
+	if v := strings.TrimSpace(os.Getenv(EnvPrefix + "SQLITE_SYNCHRONOUS")); v != "" {
+		dbOptions.Synchronous = v
+	}
+	var err error
+	dbOptions.BusyTimeout, err = envDuration("SQLITE_BUSY_TIMEOUT", dbOptions.BusyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	dbOptions.MaxOpenConns, err = envInt("DB_MAX_OPEN_CONNS", dbOptions.MaxOpenConns)
+	if err != nil {
+		return nil, err
+	}
+	dbOptions.MaxIdleConns, err = envInt("DB_MAX_IDLE_CONNS", dbOptions.MaxIdleConns)
+	if err != nil {
+		return nil, err
+	}
+	dbOptions.Cipher, err = encryptionFromEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	snapshots := SnapshotConfig{Dir: strings.TrimSpace(os.Getenv(EnvPrefix + "SNAPSHOT_DIR"))}
+	snapshots.Interval, err = envDuration("SNAPSHOT_INTERVAL", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if snapshots.Interval <= 0 {
+		return nil, fmt.Errorf("%sSNAPSHOT_INTERVAL must be positive", EnvPrefix)
+	}
+	snapshots.Keep, err = envInt("SNAPSHOT_KEEP", 7)
+	if err != nil {
+		return nil, err
+	}
+	if snapshots.Keep < 0 {
+		return nil, fmt.Errorf("parse %sSNAPSHOT_KEEP: must not be negative", EnvPrefix)
+	}
+	webhooks := webhook.Config{URLs: splitList(os.Getenv(EnvPrefix + "WEBHOOK_URL"))}
+	webhooks.Secret, err = envSecret("WEBHOOK_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	webhooks.Events, err = webhook.ParseEvents(splitList(os.Getenv(EnvPrefix + "WEBHOOK_EVENTS")))
+	if err != nil {
+		return nil, err
+	}
+	webhooks.FinishedAt, err = envFloat("WEBHOOK_FINISHED_AT", 0.99)
+	if err != nil {
+		return nil, err
+	}
+	if webhooks.FinishedAt <= 0 || webhooks.FinishedAt > 1 {
+		return nil, fmt.Errorf("parse %sWEBHOOK_FINISHED_AT: must be above 0 and at most 1", EnvPrefix)
+	}
+	webhooks.MaxAttempts, err = envInt("WEBHOOK_ATTEMPTS", 5)
+	if err != nil {
+		return nil, err
+	}
+	if webhooks.MaxAttempts < 1 {
+		return nil, fmt.Errorf("parse %sWEBHOOK_ATTEMPTS: must be at least 1", EnvPrefix)
+	}
+	webhooks.Timeout, err = envDuration("WEBHOOK_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if webhooks.Timeout <= 0 {
+		return nil, fmt.Errorf("parse %sWEBHOOK_TIMEOUT: must be positive", EnvPrefix)
+	}
+	for _, raw := range webhooks.URLs {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("parse %sWEBHOOK_URL: %q is not an http(s) URL", EnvPrefix, raw)
+		}
+	}
+	mqttConf := mqtt.Config{
+		Broker:   strings.TrimSpace(os.Getenv(EnvPrefix + "MQTT_URL")),
+		Username: strings.TrimSpace(os.Getenv(EnvPrefix + "MQTT_USERNAME")),
+		ClientID: strings.TrimSpace(os.Getenv(EnvPrefix + "MQTT_CLIENT_ID")),
+		Topic:    strings.TrimSpace(os.Getenv(EnvPrefix + "MQTT_TOPIC")),
+	}
+	if mqttConf.ClientID == "" {
+		mqttConf.ClientID = "kokosync"
+	}
+	mqttConf.Password, err = envSecret("MQTT_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	qos, err := envInt("MQTT_QOS", 1)
+	if err != nil {
+		return nil, err
+	}
+	if qos != 0 && qos != 1 {
+		return nil, fmt.Errorf("parse %sMQTT_QOS: only 0 and 1 are supported", EnvPrefix)
+	}
+	mqttConf.QoS = byte(qos)
+	mqttConf.Retain, err = envBool("MQTT_RETAIN", true)
+	if err != nil {
+		return nil, err
+	}
+	mqttConf.KeepAlive, err = envDuration("MQTT_KEEP_ALIVE", 60*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if mqttConf.KeepAlive < 2*time.Second {
+		return nil, fmt.Errorf("parse %sMQTT_KEEP_ALIVE: must be at least 2s", EnvPrefix)
+	}
+	mqttConf.Timeout, err = envDuration("MQTT_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if mqttConf.Timeout <= 0 {
+		return nil, fmt.Errorf("parse %sMQTT_TIMEOUT: must be positive", EnvPrefix)
+	}
 	rawUpstreamAPIRoot := strings.TrimSpace(os.Getenv(EnvPrefix + "UPSTREAM_API_ROOT"))
-	listenAddress := strings.TrimSpace(os.Getenv(EnvPrefix + "LISTEN_ADDRESS"))
-	if listenAddress == "" {
-		listenAddress = "127.0.0.1:8889"
+	listenAddresses := splitList(os.Getenv(EnvPrefix + "LISTEN_ADDRESS"))
+	if len(listenAddresses) == 0 {
+		listenAddresses = []string{"127.0.0.1:8889"}
 	}
 
+	var unixOpts UnixSocketOptions
+	rawMode := strings.TrimSpace(os.Getenv(EnvPrefix + "UNIX_SOCKET_MODE"))
+	if rawMode != "" {
+		mode, err := strconv.ParseUint(rawMode, 8, 32)
+		if err != nil || mode > 0o777 {
+			return nil, fmt.Errorf("parse unix socket mode %q: expected octal permissions", rawMode)
+		}
+		unixOpts.Mode = fs.FileMode(mode)
+	}
+	unixOpts.Owner = strings.TrimSpace(os.Getenv(EnvPrefix + "UNIX_SOCKET_OWNER"))
+	unixOpts.Group = strings.TrimSpace(os.Getenv(EnvPrefix + "UNIX_SOCKET_GROUP"))
+
 	proxyPrefix := strings.TrimSpace(os.Getenv(EnvPrefix + "PROXY_PREFIX"))
 	if !strings.HasSuffix(proxyPrefix, "/") {
 		proxyPrefix += "/"
 	}
 
+	logFormat := strings.ToLower(strings.TrimSpace(os.Getenv(EnvPrefix + "LOG_FORMAT")))
+	logLevel, err := parseLogLevel(strings.TrimSpace(os.Getenv(EnvPrefix + "LOG_LEVEL")))
+	if err != nil {
+		return nil, err
+	}
+
+	readyCheckUpstream, err := envBool("READYZ_CHECK_UPSTREAM", false)
+	if err != nil {
+		return nil, err
+	}
+	readyUpstreamTTL, err := envDuration("READYZ_UPSTREAM_TTL", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	var rateLimit RateLimitConfig
+	rateLimit.IPRate, err = envFloat("RATE_LIMIT_IP_RPS", 2)
+	if err != nil {
+		return nil, err
+	}
+	rateLimit.IPBurst, err = envInt("RATE_LIMIT_IP_BURST", 20)
+	if err != nil {
+		return nil, err
+	}
+	if rateLimit.IPRate > 0 && rateLimit.IPBurst < 1 {
+		return nil, fmt.Errorf("parse %sRATE_LIMIT_IP_BURST: must be at least 1 while the rate limit is on", EnvPrefix)
+	}
+	rateLimit.UserRate, err = envFloat("RATE_LIMIT_USER_RPS", 2)
+	if err != nil {
+		return nil, err
+	}
+	rateLimit.UserBurst, err = envInt("RATE_LIMIT_USER_BURST", 20)
+	if err != nil {
+		return nil, err
+	}
+	if rateLimit.UserRate > 0 && rateLimit.UserBurst < 1 {
+		return nil, fmt.Errorf("parse %sRATE_LIMIT_USER_BURST: must be at least 1 while the rate limit is on", EnvPrefix)
+	}
+	rateLimit.LockoutThreshold, err = envInt("LOCKOUT_THRESHOLD", 10)
+	if err != nil {
+		return nil, err
+	}
+	if rateLimit.LockoutThreshold < 1 {
+		return nil, fmt.Errorf("parse %sLOCKOUT_THRESHOLD: must be at least 1", EnvPrefix)
+	}
+	rateLimit.LockoutDuration, err = envDuration("LOCKOUT_DURATION", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if rateLimit.LockoutDuration <= 0 {
+		return nil, fmt.Errorf("parse %sLOCKOUT_DURATION: must be positive", EnvPrefix)
+	}
+
+	maxBodySize, err := envInt("MAX_BODY_SIZE", kosync.DefaultMaxBodySize)
+	if err != nil {
+		return nil, err
+	}
+	if maxBodySize <= 0 {
+		return nil, fmt.Errorf("parse %sMAX_BODY_SIZE: must be positive", EnvPrefix)
+	}
+	rejectUnknownFields, err := envBool("REJECT_UNKNOWN_FIELDS", false)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := ParseUserNormalization(splitList(os.Getenv(EnvPrefix + "USER_NORMALIZATION")))
+	if err != nil {
+		return nil, fmt.Errorf("parse %sUSER_NORMALIZATION: %s", EnvPrefix, err)
+	}
+
+	adminToken, err := envSecret("ADMIN_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+
+	webUI, err := envBool("WEB_UI", false)
+	if err != nil {
+		return nil, err
+	}
+	sessionSecret, err := envSecret("SESSION_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	if webUI && sessionSecret == "" {
+		return nil, fmt.Errorf("%sWEB_UI needs %sSESSION_SECRET to sign sessions", EnvPrefix, EnvPrefix)
+	}
+	sessionTTL, err := envDuration("SESSION_TTL", 7*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
 	upstreamURL, err := url.Parse(rawUpstreamAPIRoot)
 	if err != nil {
 		return nil, fmt.Errorf("parse komga api root: %s", err)
 	}
 
 	return &Config{
-		DBPath:        dbPath,
-		UpstreamURL:   upstreamURL,
-		ListenAddress: listenAddress,
-		ProxyPrefix:   proxyPrefix,
+		DBPath:            dbPath,
+		DBOptions:         dbOptions,
+		Snapshots:         snapshots,
+		Webhooks:          webhooks,
+		MQTT:              mqttConf,
+		UpstreamURL:       upstreamURL,
+		ListenAddresses:   listenAddresses,
+		UnixSocketOptions: unixOpts,
+		ProxyPrefix:       proxyPrefix,
+		TrustedProxies:    splitList(os.Getenv(EnvPrefix + "TRUSTED_PROXIES")),
+		LogFormat:         logFormat,
+		LogLevel:          logLevel,
+
+		ReadyCheckUpstream: readyCheckUpstream,
+		ReadyUpstreamTTL:   readyUpstreamTTL,
+
+		RateLimit: rateLimit,
+
+		MaxBodySize:         int64(maxBodySize),
+		RejectUnknownFields: rejectUnknownFields,
+
+		AdminToken:           adminToken,
+		AdminListenAddresses: splitList(os.Getenv(EnvPrefix + "ADMIN_LISTEN_ADDRESS")),
+		LegacyUser:           strings.TrimSpace(os.Getenv(EnvPrefix + "LEGACY_USER")),
+		Users:                users,
+
+		WebUI:         webUI,
+		SessionSecret: sessionSecret,
+		SessionTTL:    sessionTTL,
 	}, nil
 }
+
+// splitList splits a comma separated list ignoring empty items.
+func splitList(raw string) []string {
+	var res []string
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			res = append(res, item)
+		}
+	}
+
+	return res
+}
+
+func envBool(name string, def bool) (bool, error) {
+	raw := strings.TrimSpace(os.Getenv(EnvPrefix + name))
+	if raw == "" {
+		return def, nil
+	}
+	res, err := strconv.ParseBool(raw)
+	if err != nil {
+		return def, fmt.Errorf("parse %s%s: %s", EnvPrefix, name, err)
+	}
+
+	return res, nil
+}
+
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	raw := strings.TrimSpace(os.Getenv(EnvPrefix + name))
+	if raw == "" {
+		return def, nil
+	}
+	res, err := time.ParseDuration(raw)
+	if err != nil {
+		return def, fmt.Errorf("parse %s%s: %s", EnvPrefix, name, err)
+	}
+
+	return res, nil
+}
+
+func envInt(name string, def int) (int, error) {
+	raw := strings.TrimSpace(os.Getenv(EnvPrefix + name))
+	if raw == "" {
+		return def, nil
+	}
+	res, err := strconv.Atoi(raw)
+	if err != nil {
+		return def, fmt.Errorf("parse %s%s: %s", EnvPrefix, name, err)
+	}
+
+	return res, nil
+}
+
+func envFloat(name string, def float64) (float64, error) {
+	raw := strings.TrimSpace(os.Getenv(EnvPrefix + name))
+	if raw == "" {
+		return def, nil
+	}
+	res, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return def, fmt.Errorf("parse %s%s: %s", EnvPrefix, name, err)
+	}
+
+	return res, nil
+}
+
+// encryptionFromEnvironment returns the cipher progress is encrypted with,
+// nil when encryption isn't configured.
+func encryptionFromEnvironment() (*store.Cipher, error) {
+	rawKeys, err := envSecret("ENCRYPTION_KEYS")
+	if err != nil {
+		return nil, err
+	}
+	rawIndexKey, err := envSecret("ENCRYPTION_INDEX_KEY")
+	if err != nil {
+		return nil, err
+	}
+	if rawKeys == "" && rawIndexKey == "" {
+		return nil, nil
+	}
+	if rawKeys == "" || rawIndexKey == "" {
+		return nil, fmt.Errorf("%sENCRYPTION_KEYS and %sENCRYPTION_INDEX_KEY must be set together", EnvPrefix, EnvPrefix)
+	}
+
+	keys, err := store.ParseKeys(rawKeys)
+	if err != nil {
+		return nil, fmt.Errorf("parse %sENCRYPTION_KEYS: %s", EnvPrefix, err)
+	}
+	indexKey, err := base64.StdEncoding.DecodeString(rawIndexKey)
+	if err != nil {
+		return nil, fmt.Errorf("decode %sENCRYPTION_INDEX_KEY: %s", EnvPrefix, err)
+	}
+
+	return store.NewCipher(keys, indexKey)
+}
+
+// envSecret reads a secret either directly from NAME or from the file
+// named by NAME_FILE so it doesn't have to be in the environment.
+func envSecret(name string) (string, error) {
+	value := strings.TrimSpace(os.Getenv(EnvPrefix + name))
+	file := strings.TrimSpace(os.Getenv(EnvPrefix + name + "_FILE"))
+	if file == "" {
+		return value, nil
+	}
+	if value != "" {
+		return "", fmt.Errorf("only one of %s%s and %s%s_FILE may be set", EnvPrefix, name, EnvPrefix, name)
+	}
+
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("read %s%s_FILE: %s", EnvPrefix, name, err)
+	}
+
+	return strings.TrimSpace(string(raw)), nil
+}
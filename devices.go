@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ficoos/kokosync/kosync"
+	"github.com/ficoos/kokosync/realip"
+	"github.com/ficoos/kokosync/store"
+)
+
+const maxDeviceLabelLength = 64
+
+// errDeviceBlocked is returned to blocked devices pushing progress, KOReader
+// treats it like a failed login.
+var errDeviceBlocked = fmt.Errorf("%w: device is blocked", kosync.ErrUnauthorized)
+
+var errDeviceNotFound = errors.New("device not found")
+
+// checkDevice rejects progress pushed by a blocked device, devices that
+// were never seen are fine.
+func (s *BridgeImpl) checkDevice(ctx context.Context, user string, deviceID string) error {
+	d, err := s.dal.GetDevice(ctx, user, deviceID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get device from db [device_id=%s]: %s", deviceID, err)
+	}
+	if d.Blocked {
+		slog.WarnContext(ctx, "blocked device tried to push progress", "user", user, "device_id", deviceID, "device", d.Name)
+		return errDeviceBlocked
+	}
+
+	return nil
+}
+
+// seenDevice records the device that pushed progress. The progress is
+// already saved so failing to record the device is only logged.
+func (s *BridgeImpl) seenDevice(ctx context.Context, user string, progress *kosync.Progress) {
+	d := &store.Device{
+		User:         user,
+		ID:           progress.DeviceID,
+		Name:         progress.Device,
+		LastSeen:     progress.Timestamp,
+		LastDocument: progress.Document,
+	}
+	if info := realip.FromContext(ctx); info != nil && info.IP.IsValid() {
+		d.LastIP = info.IP.String()
+	}
+	err := s.dal.SeenDevice(ctx, d)
+	if err != nil {
+		slog.WarnContext(ctx, "record device failed", "device_id", progress.DeviceID, "error", err)
+	}
+}
+
+type devicePatch struct {
+	Label   *string `json:"label"`
+	Blocked *bool   `json:"blocked"`
+}
+
+// patchDevice decodes a devicePatch from the request body, applies it to
+// a device of user and writes the updated device.
+func patchDevice(w http.ResponseWriter, r *http.Request, dal store.ProgressStore, user string, id string) {
+	var patch devicePatch
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, kosync.DefaultMaxBodySize))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&patch)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, fmt.Errorf("decode patch: %s", err))
+		return
+	}
+	if patch.Label != nil {
+		label := strings.TrimSpace(*patch.Label)
+		if utf8.RuneCountInString(label) > maxDeviceLabelLength {
+			writeJSONError(w, r, http.StatusBadRequest, fmt.Errorf("label is longer than %d characters", maxDeviceLabelLength))
+			return
+		}
+		patch.Label = &label
+	}
+
+	err = func() error {
+		if patch.Label != nil {
+			err := dal.RenameDevice(r.Context(), user, id, *patch.Label)
+			if err != nil {
+				return err
+			}
+		}
+		if patch.Blocked != nil {
+			return dal.BlockDevice(r.Context(), user, id, *patch.Blocked)
+		}
+		return nil
+	}()
+	var d *store.Device
+	if err == nil {
+		d, err = dal.GetDevice(r.Context(), user, id)
+	}
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeJSONError(w, r, http.StatusNotFound, errDeviceNotFound)
+			return
+		}
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("update device [user=%s device_id=%s]: %s", user, id, err))
+		return
+	}
+
+	slog.InfoContext(r.Context(), "updated device", "user", user, "device_id", id, "label", d.Label, "blocked", d.Blocked)
+	writeJSON(w, r, http.StatusOK, d)
+}
+
+// listDevices writes the devices of user, or of everyone when user is
+// empty.
+func listDevices(w http.ResponseWriter, r *http.Request, dal store.ProgressStore, user string) {
+	devices, err := dal.ListDevices(r.Context(), user)
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("list devices [user=%s]: %s", user, err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, devices)
+}
+
+// listDeviceProgress writes the progress every device of user saved for
+// document, named requested in the response.
+func listDeviceProgress(w http.ResponseWriter, r *http.Request, dal store.ProgressStore, user string, document string, requested string) {
+	progress, err := dal.ListDeviceProgress(r.Context(), user, document)
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("list device progress [user=%s document=%s]: %s", user, document, err))
+		return
+	}
+	if len(progress) == 0 {
+		writeJSONError(w, r, http.StatusNotFound, kosync.ErrDocNotFound)
+		return
+	}
+	for _, p := range progress {
+		p.Document = requested
+	}
+
+	writeJSON(w, r, http.StatusOK, progress)
+}
+
+// kosyncDeviceProgressHandler serves the progress of every device to
+// clients authenticating like KOReader does, so they can offer to jump to
+// where another device is.
+func kosyncDeviceProgressHandler(bridge *BridgeImpl) http.Handler {
+	return requireKosyncAuth(bridge, func(w http.ResponseWriter, r *http.Request, user string) {
+		document, ok := pathDocument(w, r)
+		if !ok {
+			return
+		}
+		canonical, err := bridge.canonicalDocument(r.Context(), document)
+		if err != nil {
+			writeJSONError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		// the device knows the document by the hash it asked for
+		listDeviceProgress(w, r, bridge.dal, user, canonical, document)
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/ficoos/kokosync/kosync"
+	"github.com/ficoos/kokosync/store"
+)
+
+var errDocumentAliasNotFound = errors.New("document alias not found")
+
+// canonicalDocument returns the document the progress of document is stored
+// under, document itself unless it is an alias.
+func (s *BridgeImpl) canonicalDocument(ctx context.Context, document string) (string, error) {
+	canonical, err := s.dal.ResolveDocumentAlias(ctx, document)
+	if errors.Is(err, store.ErrNotFound) {
+		return document, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("resolve document alias [document=%s]: %s", document, err)
+	}
+
+	return canonical, nil
+}
+
+// documentAliases maps document aliases to their document. Imports resolve
+// documents through it, a lookup per record would query the store while an
+// import holds it.
+type documentAliases map[string]string
+
+func (s *BridgeImpl) loadDocumentAliases(ctx context.Context) (documentAliases, error) {
+	aliases, err := s.dal.ListDocumentAliases(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list document aliases: %s", err)
+	}
+	res := documentAliases{}
+	for _, a := range aliases {
+		res[a.Alias] = a.Document
+	}
+
+	return res, nil
+}
+
+func (a documentAliases) canonical(document string) string {
+	if canonical, ok := a[document]; ok {
+		return canonical
+	}
+	return document
+}
+
+// setDocumentAlias makes alias share the progress of document. Progress
+// users already saved under alias is merged into document, the newer one
+// wins, only the latest progress of the alias is kept. It returns the
+// number of users whose progress was merged. Aliases of aliases are
+// refused.
+func (s *BridgeImpl) setDocumentAlias(ctx context.Context, alias string, document string) (*store.DocumentAlias, int, error) {
+	var err error
+	a := &store.DocumentAlias{}
+	a.Alias, err = kosync.NormalizeDocumentHash(alias)
+	if err != nil {
+		return nil, 0, fmt.Errorf("alias: %w", err)
+	}
+	a.Document, err = kosync.NormalizeDocumentHash(document)
+	if err != nil {
+		return nil, 0, fmt.Errorf("document: %w", err)
+	}
+	if a.Alias == a.Document {
+		return nil, 0, fmt.Errorf("%w: %s can't be an alias of itself", kosync.ErrBadRequest, a.Alias)
+	}
+	_, err = s.dal.ResolveDocumentAlias(ctx, a.Document)
+	if err == nil {
+		return nil, 0, fmt.Errorf("%w: %s is an alias itself", kosync.ErrBadRequest, a.Document)
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		return nil, 0, err
+	}
+	aliases, err := s.dal.ListDocumentAliases(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, existing := range aliases {
+		if existing.Document == a.Alias {
+			return nil, 0, fmt.Errorf("%w: %s has aliases of its own", kosync.ErrBadRequest, a.Alias)
+		}
+	}
+
+	merged, err := s.dal.MergeDocument(ctx, a)
+	if err != nil {
+		return nil, 0, err
+	}
+	slog.InfoContext(ctx, "set document alias", "alias", a.Alias, "document", a.Document, "merged", merged)
+	return a, merged, nil
+}
+
+func listDocumentAliases(w http.ResponseWriter, r *http.Request, dal store.ProgressStore) {
+	aliases, err := dal.ListDocumentAliases(r.Context())
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("list document aliases: %s", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, aliases)
+}
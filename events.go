@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ficoos/kokosync/kosync"
+	"github.com/ficoos/kokosync/store"
+)
+
+const (
+	// maxSubscriptions bounds the streams a single user can hold open
+	maxSubscriptions = 16
+	// subscriptionBuffer is how many events a slow client may fall behind
+	// before it is disconnected and has to catch up by reconnecting
+	subscriptionBuffer = 16
+	eventKeepAlive     = 30 * time.Second
+)
+
+var errTooManySubscriptions = errors.New("too many event streams")
+
+// EventHub fans progress changes out to the streams of the user that owns
+// the progress.
+type EventHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan *store.ProgressRecord]struct{}
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{subs: map[string]map[chan *store.ProgressRecord]struct{}{}}
+}
+
+// Subscribe returns a channel receiving user's progress changes, it is
+// closed when the subscriber falls behind or cancel is called.
+func (h *EventHub) Subscribe(user string) (<-chan *store.ProgressRecord, func(), error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subs, ok := h.subs[user]
+	if !ok {
+		subs = map[chan *store.ProgressRecord]struct{}{}
+		h.subs[user] = subs
+	}
+	if len(subs) >= maxSubscriptions {
+		return nil, nil, errTooManySubscriptions
+	}
+
+	ch := make(chan *store.ProgressRecord, subscriptionBuffer)
+	subs[ch] = struct{}{}
+	cancel := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.remove(user, ch)
+	}
+	return ch, cancel, nil
+}
+
+// remove must be called with h.mu held.
+func (h *EventHub) remove(user string, ch chan *store.ProgressRecord) {
+	subs := h.subs[user]
+	if _, ok := subs[ch]; !ok {
+		return
+	}
+	delete(subs, ch)
+	close(ch)
+	if len(subs) == 0 {
+		delete(h.subs, user)
+	}
+}
+
+// Publish sends rec to the streams of rec.User without blocking.
+func (h *EventHub) Publish(rec *store.ProgressRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[rec.User] {
+		select {
+		case ch <- rec:
+		default:
+			h.remove(rec.User, ch)
+		}
+	}
+}
+
+// Subscriptions returns the number of open streams.
+func (h *EventHub) Subscriptions() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, subs := range h.subs {
+		n += len(subs)
+	}
+	return n
+}
+
+// ServeEvents streams user's progress changes as Server-Sent Events until
+// the client goes away. Every change is a progress event carrying the
+// progress as JSON.
+func (h *EventHub) ServeEvents(w http.ResponseWriter, r *http.Request, user string) {
+	events, cancel, err := h.Subscribe(user)
+	if err != nil {
+		writeJSONError(w, r, http.StatusTooManyRequests, err)
+		return
+	}
+	defer cancel()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// nginx buffers responses unless told otherwise
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", (5 * time.Second).Milliseconds())
+	rc.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case rec, ok := <-events:
+			if !ok {
+				slog.DebugContext(r.Context(), "event stream fell behind", "user", user)
+				return
+			}
+			var data []byte
+			data, err = json.Marshal(rec)
+			if err == nil {
+				_, err = fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+			}
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			slog.DebugContext(r.Context(), "event stream closed", "user", user, "error", err)
+			return
+		}
+	}
+}
+
+// requireKosyncAuth authorizes requests the way KOReader authenticates,
+// for endpoints kokosync adds to the kosync API.
+func requireKosyncAuth(bridge *BridgeImpl, next func(w http.ResponseWriter, r *http.Request, user string)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := kosync.AuthFromRequest(r)
+		user, _, err := bridge.authorize(r.Context(), auth)
+		if err != nil {
+			// same statuses as GET /users/auth
+			status := http.StatusInternalServerError
+			if errors.Is(err, kosync.ErrUnauthorized) {
+				status = http.StatusForbidden
+			}
+			writeJSONError(w, r, status, err)
+			return
+		}
+
+		next(w, r, user)
+	})
+}
+
+// kosyncEventsHandler serves the event stream to clients authenticating
+// like KOReader does.
+func kosyncEventsHandler(bridge *BridgeImpl) http.Handler {
+	return requireKosyncAuth(bridge, bridge.events.ServeEvents)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ficoos/kokosync/kosync"
+	"github.com/ficoos/kokosync/store"
+)
+
+type ExportFormat string
+
+const (
+	// FormatJSONL is one store.ProgressRecord JSON object per line
+	FormatJSONL ExportFormat = "jsonl"
+	FormatCSV   ExportFormat = "csv"
+)
+
+var csvColumns = []string{"user", "document", "progress", "percentage", "device", "device_id", "timestamp"}
+
+func ParseExportFormat(raw string) (ExportFormat, error) {
+	switch f := ExportFormat(strings.ToLower(raw)); f {
+	case FormatJSONL, FormatCSV:
+		return f, nil
+	case "json", "ndjson":
+		return FormatJSONL, nil
+	}
+
+	return "", fmt.Errorf("unknown format %q, expected jsonl or csv", raw)
+}
+
+// FormatFromFileName guesses the format from the file extension.
+func FormatFromFileName(name string) (ExportFormat, bool) {
+	i := strings.LastIndexByte(name, '.')
+	if i < 0 {
+		return "", false
+	}
+	f, err := ParseExportFormat(name[i+1:])
+	return f, err == nil
+}
+
+func (f ExportFormat) ContentType() string {
+	if f == FormatCSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/x-ndjson"
+}
+
+// ExportProgress writes progress of user, or of every user when user is
+// empty, to w and returns the number of records written.
+func ExportProgress(ctx context.Context, dal store.ProgressStore, w io.Writer, format ExportFormat, user string) (int, error) {
+	count := 0
+	switch format {
+	case FormatJSONL:
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		err := dal.EachProgress(ctx, user, func(rec *store.ProgressRecord) error {
+			count++
+			return enc.Encode(rec)
+		})
+		if err != nil {
+			return count, err
+		}
+		return count, bw.Flush()
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		err := cw.Write(csvColumns)
+		if err != nil {
+			return 0, err
+		}
+		err = dal.EachProgress(ctx, user, func(rec *store.ProgressRecord) error {
+			count++
+			return cw.Write([]string{
+				rec.User,
+				rec.Document,
+				rec.Progress.Progress,
+				strconv.FormatFloat(rec.Percentage, 'f', -1, 64),
+				rec.Device,
+				rec.DeviceID,
+				strconv.FormatInt(rec.Timestamp, 10),
+			})
+		})
+		if err != nil {
+			return count, err
+		}
+		cw.Flush()
+		return count, cw.Error()
+	}
+
+	return 0, fmt.Errorf("unknown format %q", format)
+}
+
+// progressDecoder returns a function reading records from r until io.EOF.
+// Records without a user are assigned defaultUser, which makes plain
+// kosync.Progress objects importable. Users are stored as canonicalUser
+// returns them and documents as canonicalDocument does. Malformed records
+// are reported as kosync.ErrBadRequest.
+func progressDecoder(r io.Reader, format ExportFormat, defaultUser string, canonicalUser func(login string) string, canonicalDocument func(document string) string) (func() (*store.ProgressRecord, error), error) {
+	var decode func() (*store.ProgressRecord, error)
+	switch format {
+	case FormatJSONL:
+		dec := json.NewDecoder(r)
+		dec.DisallowUnknownFields()
+		decode = func() (*store.ProgressRecord, error) {
+			var rec store.ProgressRecord
+			err := dec.Decode(&rec)
+			if err != nil {
+				return nil, err
+			}
+			return &rec, nil
+		}
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		header, err := cr.Read()
+		if err != nil {
+			return nil, fmt.Errorf("%w: read csv header: %s", kosync.ErrBadRequest, err)
+		}
+		columns := map[string]int{}
+		for i, name := range header {
+			columns[strings.TrimSpace(name)] = i
+		}
+		for _, name := range csvColumns {
+			if _, ok := columns[name]; !ok && name != "user" && name != "timestamp" {
+				return nil, fmt.Errorf("%w: csv is missing the %s column", kosync.ErrBadRequest, name)
+			}
+		}
+		decode = func() (*store.ProgressRecord, error) {
+			row, err := cr.Read()
+			if err != nil {
+				return nil, err
+			}
+			get := func(name string) string {
+				i, ok := columns[name]
+				if !ok {
+					return ""
+				}
+				return row[i]
+			}
+			var rec store.ProgressRecord
+			rec.User = get("user")
+			rec.Document = get("document")
+			rec.Progress.Progress = get("progress")
+			rec.Device = get("device")
+			rec.DeviceID = get("device_id")
+			rec.Percentage, err = strconv.ParseFloat(get("percentage"), 64)
+			if err != nil {
+				return nil, fmt.Errorf("parse percentage: %s", err)
+			}
+			if ts := get("timestamp"); ts != "" {
+				rec.Timestamp, err = strconv.ParseInt(ts, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("parse timestamp: %s", err)
+				}
+			}
+			return &rec, nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	now := time.Now().Unix()
+	line := 0
+	return func() (*store.ProgressRecord, error) {
+		rec, err := decode()
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		line++
+		if err != nil {
+			return nil, fmt.Errorf("%w: record %d: %s", kosync.ErrBadRequest, line, err)
+		}
+		if rec.User == "" {
+			rec.User = defaultUser
+		}
+		rec.User = canonicalUser(rec.User)
+		if rec.User == "" {
+			return nil, fmt.Errorf("%w: record %d: no user", kosync.ErrBadRequest, line)
+		}
+		if rec.Timestamp == 0 {
+			rec.Timestamp = now
+		}
+		err = rec.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("%w: record %d: %s", kosync.ErrBadRequest, line, err)
+		}
+		rec.Document = canonicalDocument(rec.Document)
+		return rec, nil
+	}, nil
+}
+
+type ImportResult struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+// ImportProgress reads records from r and upserts them according to
+// policy. Either every record is imported or none are. Users are stored
+// under their canonical name, the one they sync as, and documents under
+// the document they are an alias of.
+func ImportProgress(ctx context.Context, bridge *BridgeImpl, r io.Reader, format ExportFormat, policy store.ConflictPolicy, defaultUser string) (*ImportResult, error) {
+	names, err := bridge.loadUserNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	documents, err := bridge.loadDocumentAliases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	next, err := progressDecoder(r, format, defaultUser, names.canonical, documents.canonical)
+	if err != nil {
+		return nil, err
+	}
+
+	imported, skipped, err := bridge.dal.ImportProgress(ctx, policy, next)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImportResult{Imported: imported, Skipped: skipped}, nil
+}
@@ -2,4 +2,10 @@ module github.com/ficoos/kokosync
 
 go 1.24.3
 
-require github.com/mattn/go-sqlite3 v1.14.28
+require (
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.28
+	golang.org/x/term v0.32.0
+)
+
+require golang.org/x/sys v0.33.0 // indirect
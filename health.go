@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ficoos/kokosync/kosync"
+	"github.com/ficoos/kokosync/store"
+)
+
+// readinessTimeout bounds how long a single check may take so a hung
+// dependency doesn't hang the probe.
+const readinessTimeout = 5 * time.Second
+
+type ComponentStatus struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+	Cached    bool      `json:"cached,omitempty"`
+}
+
+type ReadinessReport struct {
+	Status     string                      `json:"status"`
+	Components map[string]*ComponentStatus `json:"components"`
+}
+
+type Readiness struct {
+	dal store.ProgressStore
+
+	upstream    *url.URL
+	upstreamTTL time.Duration
+
+	mu             sync.Mutex
+	upstreamStatus *ComponentStatus
+	// upstreamCheck is closed when the upstream check in flight is done,
+	// probes arriving meanwhile wait for it rather than start their own
+	upstreamCheck chan struct{}
+}
+
+// NewReadiness creates readiness checks for dal and, when upstream is not
+// nil, the upstream server. Upstream results are reused for upstreamTTL so
+// frequent probes don't turn into a steady stream of requests to Komga.
+func NewReadiness(dal store.ProgressStore, upstream *url.URL, upstreamTTL time.Duration) *Readiness {
+	return &Readiness{
+		dal:         dal,
+		upstream:    upstream,
+		upstreamTTL: upstreamTTL,
+	}
+}
+
+func statusFromError(err error) *ComponentStatus {
+	res := &ComponentStatus{
+		Status:    "ok",
+		CheckedAt: time.Now().UTC(),
+	}
+	if err != nil {
+		res.Status = "fail"
+		res.Error = err.Error()
+	}
+
+	return res
+}
+
+func (r *Readiness) checkUpstream(ctx context.Context) *ComponentStatus {
+	r.mu.Lock()
+	if r.upstreamStatus != nil && time.Since(r.upstreamStatus.CheckedAt) < r.upstreamTTL {
+		cached := *r.upstreamStatus
+		r.mu.Unlock()
+		cached.Cached = true
+		return &cached
+	}
+	done := r.upstreamCheck
+	if done == nil {
+		done = make(chan struct{})
+		r.upstreamCheck = done
+		go r.pingUpstream(done)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return statusFromError(fmt.Errorf("upstream check: %s", ctx.Err()))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := *r.upstreamStatus
+	return &res
+}
+
+// pingUpstream checks upstream without holding r.mu and closes done. It
+// has a timeout of its own since the probe that started it may give up
+// while others still wait.
+func (r *Readiness) pingUpstream(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), readinessTimeout)
+	defer cancel()
+	us := kosync.NewClient(r.upstream, "", "")
+	us.SetObserver(observeUpstream)
+	status := statusFromError(us.Ping(ctx))
+
+	r.mu.Lock()
+	r.upstreamStatus = status
+	r.upstreamCheck = nil
+	r.mu.Unlock()
+	close(done)
+}
+
+func (r *Readiness) Check(ctx context.Context) *ReadinessReport {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	report := &ReadinessReport{
+		Status: "ok",
+		Components: map[string]*ComponentStatus{
+			"database": statusFromError(r.dal.Ping(ctx)),
+		},
+	}
+	if r.upstream != nil {
+		report.Components["upstream"] = r.checkUpstream(ctx)
+	}
+
+	for _, c := range report.Components {
+		if c.Status != "ok" {
+			report.Status = "fail"
+		}
+	}
+
+	return report
+}
+
+func livenessHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	report := r.Check(req.Context())
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+		for name, c := range report.Components {
+			if c.Status != "ok" {
+				slog.WarnContext(req.Context(), "not ready", "component", name, "error", c.Error)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.Encode(report)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+type jsonError struct {
+	Message string `json:"message"`
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.WarnContext(r.Context(), "write response", "uri", r.RequestURI, "error", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	message := http.StatusText(status)
+	if status == http.StatusInternalServerError {
+		slog.ErrorContext(r.Context(), "request failed", "uri", r.RequestURI, "error", err)
+	} else if err != nil {
+		message = err.Error()
+	}
+	writeJSON(w, r, status, &jsonError{Message: message})
+}
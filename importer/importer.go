@@ -0,0 +1,52 @@
+// Package importer reads reading progress kept by other tools so it can be
+// seeded into kokosync.
+package importer
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/ficoos/kokosync/kosync"
+)
+
+// Record is progress owned by a user, the same shape kokosync exports.
+type Record struct {
+	User string `json:"user"`
+	kosync.Progress
+}
+
+// PartialMD5 computes the document hash KOReader uses: the md5 of 1KiB
+// samples taken at exponentially growing offsets (0, 1KiB, 4KiB, 16KiB ...
+// 1GiB) of the file.
+func PartialMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	const step, size = 1024, 1024
+	h := md5.New()
+	buf := make([]byte, size)
+	for i := -1; i <= 10; i++ {
+		// KOReader computes lshift(step, 2*i) with LuaJIT's 32 bit shifts,
+		// the -1 iteration wraps around to offset 0
+		var offset int64
+		if i >= 0 {
+			offset = int64(step) << (2 * i)
+		}
+		n, err := f.ReadAt(buf, offset)
+		if n == 0 {
+			if err != nil && !errors.Is(err, io.EOF) {
+				return "", err
+			}
+			break
+		}
+		h.Write(buf[:n])
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,62 @@
+package importer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// bookContent returns n bytes of a fake book.
+func bookContent(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte((i*31 + 7) % 256)
+	}
+	return b
+}
+
+func writeBook(t *testing.T, path string, n int) {
+	t.Helper()
+	err := os.WriteFile(path, bookContent(n), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The expected hashes are what KOReader's util.partialMD5 returns for the
+// same content: samples at lshift(1024, 2*i) for i = -1 .. 10 with LuaJIT's
+// 32 bit shifts, stopping at the first one past the end of the file.
+func TestPartialMD5(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		want string
+	}{
+		// one sample of the whole file, the md5 of the contents
+		{"smaller than a sample", 300, "919e4e6eef1223bc54e857dfde80c3ce"},
+		{"one sample", 1024, "63b2177a7af739b5cc52ab1d1c714702"},
+		// samples at 0, 0, 1KiB, 4KiB, 16KiB and 64KiB, the last one short
+		{"several samples", 70000, "7c495b34b24f561520622156e96f834d"},
+		{"two MiB", 2 << 20, "9176994efdf840ffd6a4fb8d1cd31fb1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "book.epub")
+			writeBook(t, path, tt.size)
+			got, err := PartialMD5(path)
+			if err != nil {
+				t.Fatalf("partial md5: %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPartialMD5Missing(t *testing.T) {
+	_, err := PartialMD5(filepath.Join(t.TempDir(), "missing.epub"))
+	if err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,269 @@
+package importer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseLuaTable parses the subset of Lua KOReader uses to serialize
+// settings: an optional comment header followed by `return { ... }` made of
+// strings, numbers, booleans and nested tables. Tables become
+// map[string]any with integer keys formatted as strings.
+func parseLuaTable(src string) (map[string]any, error) {
+	p := &luaParser{src: src}
+	p.skipSpace()
+	if !p.consumeWord("return") {
+		return nil, p.errorf("expected return")
+	}
+	p.skipSpace()
+	v, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	t, ok := v.(map[string]any)
+	if !ok {
+		return nil, p.errorf("expected a table")
+	}
+
+	return t, nil
+}
+
+type luaParser struct {
+	src string
+	pos int
+}
+
+func (p *luaParser) errorf(format string, args ...any) error {
+	line := strings.Count(p.src[:p.pos], "\n") + 1
+	return fmt.Errorf("lua line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *luaParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *luaParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *luaParser) skipSpace() {
+	for !p.eof() {
+		c := p.src[p.pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			p.pos++
+		case strings.HasPrefix(p.src[p.pos:], "--"):
+			end := strings.IndexByte(p.src[p.pos:], '\n')
+			if end < 0 {
+				p.pos = len(p.src)
+			} else {
+				p.pos += end + 1
+			}
+		default:
+			return
+		}
+	}
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+func (p *luaParser) consumeWord(word string) bool {
+	if !strings.HasPrefix(p.src[p.pos:], word) {
+		return false
+	}
+	end := p.pos + len(word)
+	if end < len(p.src) && isIdentChar(p.src[end]) {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+func (p *luaParser) parseValue() (any, error) {
+	c := p.peek()
+	switch {
+	case c == '{':
+		return p.parseTable()
+	case c == '"' || c == '\'':
+		return p.parseString()
+	case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		return p.parseNumber()
+	case p.consumeWord("true"):
+		return true, nil
+	case p.consumeWord("false"):
+		return false, nil
+	case p.consumeWord("nil"):
+		return nil, nil
+	}
+
+	return nil, p.errorf("unexpected %q", c)
+}
+
+func (p *luaParser) parseTable() (map[string]any, error) {
+	p.pos++ // {
+	res := map[string]any{}
+	next := 1
+	for {
+		p.skipSpace()
+		if p.peek() == '}' {
+			p.pos++
+			return res, nil
+		}
+		if p.eof() {
+			return nil, p.errorf("unterminated table")
+		}
+
+		var key string
+		start := p.pos
+		switch {
+		case p.peek() == '[':
+			p.pos++
+			p.skipSpace()
+			k, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			key = fmt.Sprint(k)
+			if f, ok := k.(float64); ok {
+				key = strconv.FormatFloat(f, 'f', -1, 64)
+			}
+			p.skipSpace()
+			if p.peek() != ']' {
+				return nil, p.errorf("expected ]")
+			}
+			p.pos++
+			p.skipSpace()
+			if p.peek() != '=' {
+				return nil, p.errorf("expected =")
+			}
+			p.pos++
+		case isIdentChar(p.peek()) && !(p.peek() >= '0' && p.peek() <= '9'):
+			for !p.eof() && isIdentChar(p.peek()) {
+				p.pos++
+			}
+			ident := p.src[start:p.pos]
+			p.skipSpace()
+			if p.peek() == '=' {
+				p.pos++
+				key = ident
+			} else {
+				// a positional true/false/nil
+				p.pos = start
+				key = strconv.Itoa(next)
+				next++
+			}
+		default:
+			key = strconv.Itoa(next)
+			next++
+		}
+
+		p.skipSpace()
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		res[key] = v
+
+		p.skipSpace()
+		if p.peek() == ',' || p.peek() == ';' {
+			p.pos++
+		}
+	}
+}
+
+func (p *luaParser) parseNumber() (float64, error) {
+	start := p.pos
+	if p.peek() == '-' {
+		p.pos++
+	}
+	for !p.eof() {
+		c := p.peek()
+		if (c >= '0' && c <= '9') || c == '.' || c == 'e' || c == 'E' || c == 'x' || c == 'X' ||
+			(c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F') ||
+			((c == '-' || c == '+') && (p.src[p.pos-1] == 'e' || p.src[p.pos-1] == 'E')) {
+			p.pos++
+			continue
+		}
+		break
+	}
+	raw := p.src[start:p.pos]
+	if strings.HasPrefix(strings.TrimPrefix(raw, "-"), "0x") || strings.HasPrefix(strings.TrimPrefix(raw, "-"), "0X") {
+		i, err := strconv.ParseInt(raw, 0, 64)
+		if err != nil {
+			return 0, p.errorf("bad number %q", raw)
+		}
+		return float64(i), nil
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, p.errorf("bad number %q", raw)
+	}
+
+	return f, nil
+}
+
+func (p *luaParser) parseString() (string, error) {
+	quote := p.peek()
+	p.pos++
+	var sb strings.Builder
+	for {
+		if p.eof() {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.src[p.pos]
+		p.pos++
+		if c == quote {
+			return sb.String(), nil
+		}
+		if c != '\\' {
+			sb.WriteByte(c)
+			continue
+		}
+
+		if p.eof() {
+			return "", p.errorf("unterminated string")
+		}
+		c = p.src[p.pos]
+		p.pos++
+		switch c {
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'a':
+			sb.WriteByte('\a')
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'v':
+			sb.WriteByte('\v')
+		case '\n':
+			sb.WriteByte('\n')
+		case '\\', '"', '\'':
+			sb.WriteByte(c)
+		default:
+			if c < '0' || c > '9' {
+				return "", p.errorf("unknown escape \\%c", c)
+			}
+			// up to three decimal digits
+			n := int(c - '0')
+			for i := 0; i < 2 && !p.eof() && p.peek() >= '0' && p.peek() <= '9'; i++ {
+				n = n*10 + int(p.peek()-'0')
+				p.pos++
+			}
+			if n > 255 {
+				return "", p.errorf("bad escape \\%d", n)
+			}
+			sb.WriteByte(byte(n))
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package importer
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLuaTable(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want map[string]any
+	}{
+		{
+			name: "empty",
+			src:  "return {}",
+			want: map[string]any{},
+		},
+		{
+			name: "header comment",
+			src:  "-- we can read Lua syntax here!\n-- another line\nreturn {\n    [\"a\"] = 1,\n}\n",
+			want: map[string]any{"a": 1.0},
+		},
+		{
+			name: "keys",
+			src:  `return { ["quoted"] = "q", bare = "b", [2] = "two", [1.5] = "float", [true] = "bool" }`,
+			want: map[string]any{"quoted": "q", "bare": "b", "2": "two", "1.5": "float", "true": "bool"},
+		},
+		{
+			name: "positional",
+			src:  `return { "a", 'b', 3, true, nil, { "c" }; x = 1, "d" }`,
+			want: map[string]any{
+				"1": "a", "2": "b", "3": 3.0, "4": true, "5": nil,
+				"6": map[string]any{"1": "c"},
+				"x": 1.0, "7": "d",
+			},
+		},
+		{
+			name: "numbers",
+			src:  `return { a = -1, b = 0.25, c = 1e3, d = -2.5E-2, e = 0x1F, f = .5 }`,
+			want: map[string]any{"a": -1.0, "b": 0.25, "c": 1000.0, "d": -0.025, "e": 31.0, "f": 0.5},
+		},
+		{
+			name: "escapes",
+			src:  "return { a = \"q\\\"uote\\\\ \\'\", b = 'it\\'s \"fine\"', c = \"tab\\tnl\\n\", d = \"line\\\nbreak\", e = \"\\65\\066\\0677\", f = \"\\a\\b\\f\\v\\r\" }",
+			want: map[string]any{
+				"a": "q\"uote\\ '",
+				"b": "it's \"fine\"",
+				"c": "tab\tnl\n",
+				"d": "line\nbreak",
+				"e": "AB" + "C7",
+				"f": "\a\b\f\v\r",
+			},
+		},
+		{
+			name: "nested",
+			src:  `return { a = { b = { c = { "deep" } } }, ["d"] = {} }`,
+			want: map[string]any{
+				"a": map[string]any{"b": map[string]any{"c": map[string]any{"1": "deep"}}},
+				"d": map[string]any{},
+			},
+		},
+		{
+			name: "comments between values",
+			src:  "return {\n  a = 1, -- the first\n  -- b = 2,\n  c = 3 --last\n}",
+			want: map[string]any{"a": 1.0, "c": 3.0},
+		},
+		{
+			name: "identifiers starting like words",
+			src:  `return { trueish = true, nilly = false, returned = "r" }`,
+			want: map[string]any{"trueish": true, "nilly": false, "returned": "r"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLuaTable(tt.src)
+			if err != nil {
+				t.Fatalf("parse: %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLuaTableErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"no return", `{ a = 1 }`, "expected return"},
+		{"not a table", `return "a"`, "expected a table"},
+		{"return prefix", `returned { }`, "expected return"},
+		{"unterminated table", "return {\n a = 1,", "lua line 2: unterminated table"},
+		{"unterminated string", `return { a = "abc }`, "unterminated string"},
+		{"unknown escape", `return { a = "\q" }`, `unknown escape \q`},
+		{"escape out of range", `return { a = "\256" }`, `bad escape \256`},
+		{"bad number", `return { a = 1.2.3 }`, `bad number "1.2.3"`},
+		{"missing bracket", `return { ["a" = 1 }`, "expected ]"},
+		{"missing equals", `return { ["a"] 1 }`, "expected ="},
+		{"function", `return { a = function() end }`, "unexpected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseLuaTable(tt.src)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+// TestParseSidecarFixture parses a metadata file as KOReader writes it.
+func TestParseSidecarFixture(t *testing.T) {
+	src, err := os.ReadFile("testdata/library/Some Book.sdr/metadata.epub.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := parseLuaTable(string(src))
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+
+	checks := []struct {
+		path []string
+		want any
+	}{
+		{[]string{"last_xpointer"}, "/body/DocFragment[12]/body/div/p[3]/text().45"},
+		{[]string{"percent_finished"}, 0.41374045801527},
+		{[]string{"doc_pages"}, 312.0},
+		{[]string{"hyphenation"}, true},
+		{[]string{"floating_punctuation"}, false},
+		{[]string{"doc_props", "authors"}, "Jane O'Doe"},
+		{[]string{"doc_props", "description"}, "<p>A book\rwith a \"blurb\".</p>"},
+		{[]string{"doc_props", "keywords"}, "Fiction\nAdventure"},
+		{[]string{"doc_props", "pages"}, nil},
+		{[]string{"annotations", "1", "chapter"}, `Chapter 3: "Dawn"`},
+		{[]string{"annotations", "1", "text"}, "It was a C:\\path and a tab\tand\na new line"},
+		{[]string{"summary", "status"}, "reading"},
+		{[]string{"bookmarks"}, map[string]any{}},
+		{[]string{"reading_order", "1"}, "spine"},
+		{[]string{"reading_order", "2"}, "toc"},
+		{[]string{"reading_order", "4"}, -150.0},
+		{[]string{"reading_order", "5"}, true},
+		{[]string{"reading_order", "6", "1"}, "nested"},
+	}
+	for _, c := range checks {
+		var v any = meta
+		for _, key := range c.path {
+			v = v.(map[string]any)[key]
+		}
+		if !reflect.DeepEqual(v, c.want) {
+			t.Errorf("%s: got %#v, want %#v", strings.Join(c.path, "."), v, c.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package importer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The official koreader-sync-server keeps every document of a user in a
+// Redis hash named user:<username>:document:<document hash> with the
+// fields percentage, progress, device, device_id and timestamp.
+const (
+	redisUserPrefix  = "user:"
+	redisDocumentSep = ":document:"
+)
+
+// ReadKosyncRedis reads progress from a dump of a koreader-sync-server
+// Redis database. Two layouts are accepted, both possibly mixed in the same
+// stream:
+//
+//   - redis-dump style JSON lines: {"key": "...", "type": "hash", "value": {...}}
+//   - JSON objects mapping keys to hashes: {"user:alice:document:...": {...}, ...}
+//
+// Keys that aren't progress hashes, like user:<name>:key, are skipped.
+func ReadKosyncRedis(r io.Reader) ([]*Record, error) {
+	dec := json.NewDecoder(r)
+	var res []*Record
+	for i := 1; ; i++ {
+		var raw map[string]json.RawMessage
+		err := dec.Decode(&raw)
+		if errors.Is(err, io.EOF) {
+			return res, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("value %d: %s", i, err)
+		}
+
+		values := map[string]json.RawMessage{}
+		if _, ok := raw["key"]; ok {
+			key, err := rawString(raw["key"])
+			if err != nil {
+				return nil, fmt.Errorf("value %d: key: %s", i, err)
+			}
+			var typ string
+			if raw["type"] != nil {
+				typ, err = rawString(raw["type"])
+				if err != nil {
+					return nil, fmt.Errorf("value %d: type: %s", i, err)
+				}
+			}
+			if typ == "" || typ == "hash" {
+				values[key] = raw["value"]
+			}
+		} else {
+			values = raw
+		}
+
+		for key, value := range values {
+			if !isRedisDocumentKey(key) {
+				continue
+			}
+			var hash map[string]any
+			err = json.Unmarshal(value, &hash)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %s", key, err)
+			}
+			rec, err := redisRecord(key, hash)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %s", key, err)
+			}
+			res = append(res, rec)
+		}
+	}
+}
+
+func rawString(raw json.RawMessage) (string, error) {
+	var s string
+	err := json.Unmarshal(raw, &s)
+	return s, err
+}
+
+func isRedisDocumentKey(key string) bool {
+	return strings.HasPrefix(key, redisUserPrefix) && strings.Contains(key, redisDocumentSep)
+}
+
+// hashString returns a hash field as a string, dumps store everything as
+// strings but tolerate numbers.
+func hashString(hash map[string]any, field string) string {
+	switch v := hash[field].(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func redisRecord(key string, hash map[string]any) (*Record, error) {
+	rest := strings.TrimPrefix(key, redisUserPrefix)
+	i := strings.LastIndex(rest, redisDocumentSep)
+	var rec Record
+	rec.User = rest[:i]
+	rec.Document = rest[i+len(redisDocumentSep):]
+	rec.Progress.Progress = hashString(hash, "progress")
+	rec.Device = hashString(hash, "device")
+	rec.DeviceID = hashString(hash, "device_id")
+
+	var err error
+	if raw := hashString(hash, "percentage"); raw != "" {
+		rec.Percentage, err = strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse percentage: %s", err)
+		}
+	}
+	if raw := hashString(hash, "timestamp"); raw != "" {
+		ts, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse timestamp: %s", err)
+		}
+		rec.Timestamp = int64(ts)
+	}
+
+	return &rec, nil
+}
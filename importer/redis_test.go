@@ -0,0 +1,88 @@
+package importer
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ficoos/kokosync/kosync"
+)
+
+// sortRecords orders records by user and document, objects are maps so
+// their keys come out in any order.
+func sortRecords(records []*Record) {
+	slices.SortFunc(records, func(a, b *Record) int {
+		return strings.Compare(a.User+" "+a.Document, b.User+" "+b.Document)
+	})
+}
+
+func TestReadKosyncRedis(t *testing.T) {
+	dump := `
+{"key":"user:alice:key","type":"string","value":"5f4dcc3b5aa765d61d8327deb882cf99"}
+{"key":"user:alice:document:0123456789abcdef0123456789abcdef","type":"hash","value":{"percentage":"0.25","progress":"/body/DocFragment[3]/body/p[1]/text().0","device":"kobo","device_id":"K1","timestamp":"1700000000"}}
+{"key":"user:alice:document:fedcba9876543210fedcba9876543210","type":"hash","ttl":-1,"value":{"percentage":0.5,"progress":"12","device":"phone","device_id":"P1","timestamp":1700000100}}
+{"key":"user:bob:document:0123456789abcdef0123456789abcdef","value":{"percentage":"1","progress":"/body/DocFragment[9]","device":"kindle","device_id":"B1","timestamp":"1700000200.0"}}
+{"key":"user:bob:document:00000000000000000000000000000000","type":"string","value":"not a hash"}
+{"key":"stats:syncs","type":"hash","value":{"count":"3"}}
+{
+  "user:carol:key": "e10adc3949ba59abbe56e057f20f883e",
+  "user:carol:document:11111111111111111111111111111111": {"percentage":"0.75","progress":"/body/DocFragment[1]/body/p[2]/text().5","device":"kobo","device_id":"C1","timestamp":"1700000300"},
+  "user:a:document:b:document:22222222222222222222222222222222": {"percentage":"0.1","progress":"3","device":"kobo","device_id":"D1"},
+  "version": "1"
+}
+`
+	records, err := ReadKosyncRedis(strings.NewReader(dump))
+	if err != nil {
+		t.Fatalf("read: %s", err)
+	}
+	sortRecords(records)
+
+	record := func(user string, document string, progress string, percentage float64, device string, deviceID string, timestamp int64) *Record {
+		return &Record{User: user, Progress: kosync.Progress{
+			Document:   document,
+			Progress:   progress,
+			Percentage: percentage,
+			Device:     device,
+			DeviceID:   deviceID,
+			Timestamp:  timestamp,
+		}}
+	}
+	want := []*Record{
+		// the user is everything up to the last :document:
+		record("a:document:b", "22222222222222222222222222222222", "3", 0.1, "kobo", "D1", 0),
+		record("alice", "0123456789abcdef0123456789abcdef", "/body/DocFragment[3]/body/p[1]/text().0", 0.25, "kobo", "K1", 1700000000),
+		record("alice", "fedcba9876543210fedcba9876543210", "12", 0.5, "phone", "P1", 1700000100),
+		record("bob", "0123456789abcdef0123456789abcdef", "/body/DocFragment[9]", 1, "kindle", "B1", 1700000200),
+		record("carol", "11111111111111111111111111111111", "/body/DocFragment[1]/body/p[2]/text().5", 0.75, "kobo", "C1", 1700000300),
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("got %d records, want %d", len(records), len(want))
+		for i, rec := range records {
+			t.Logf("record %d: %+v", i, rec)
+		}
+	}
+}
+
+func TestReadKosyncRedisErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		dump string
+		want string
+	}{
+		{"bad json", `{"key":`, "value 1"},
+		{"key not a string", `{"key":1,"value":{}}`, "value 1: key"},
+		{"type not a string", `{"key":"user:a:document:x","type":1,"value":{}}`, "value 1: type"},
+		{"hash not an object", "{}\n" + `{"user:a:document:x":"str"}`, "key user:a:document:x"},
+		{"bad percentage", `{"user:a:document:x":{"percentage":"half"}}`, "parse percentage"},
+		{"bad timestamp", `{"user:a:document:x":{"timestamp":"yesterday"}}`, "parse timestamp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadKosyncRedis(strings.NewReader(tt.dump))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package importer
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SidecarOptions fills in what sidecar files don't record.
+type SidecarOptions struct {
+	User     string
+	Device   string
+	DeviceID string
+}
+
+// ReadSidecars walks root for KOReader sidecar directories (Book.sdr next to
+// Book.epub) and returns the progress recorded in their metadata.*.lua
+// files. The document hash is the partial_md5_checksum KOReader stored or,
+// for older sidecars, the partial md5 of the book next to the sidecar.
+// Books that were never opened past the first page are skipped.
+func ReadSidecars(root string, opts SidecarOptions) ([]*Record, error) {
+	var res []*Record
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isSidecarMetadata(path) {
+			return nil
+		}
+		rec, err := readSidecar(path, opts)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		if rec != nil {
+			res = append(res, rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func isSidecarMetadata(path string) bool {
+	name := filepath.Base(path)
+	return strings.HasSuffix(filepath.Dir(path), ".sdr") &&
+		strings.HasPrefix(name, "metadata.") && strings.HasSuffix(name, ".lua")
+}
+
+func readSidecar(path string, opts SidecarOptions) (*Record, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := parseLuaTable(string(src))
+	if err != nil {
+		return nil, err
+	}
+
+	var rec Record
+	rec.User = opts.User
+	rec.Device = opts.Device
+	rec.DeviceID = opts.DeviceID
+	rec.Timestamp = info.ModTime().Unix()
+	rec.Percentage, _ = meta["percent_finished"].(float64)
+
+	// reflowable documents (epub, fb2 ...) sync an xpointer, paged
+	// documents (pdf, djvu ...) the page number
+	if xp, ok := meta["last_xpointer"].(string); ok && xp != "" {
+		rec.Progress.Progress = xp
+	} else if page, ok := meta["last_page"].(float64); ok {
+		rec.Progress.Progress = strconv.FormatFloat(page, 'f', -1, 64)
+	}
+	if rec.Progress.Progress == "" {
+		return nil, nil
+	}
+
+	rec.Document, _ = meta["partial_md5_checksum"].(string)
+	if rec.Document == "" {
+		book, err := sidecarBook(path)
+		if err != nil {
+			return nil, err
+		}
+		rec.Document, err = PartialMD5(book)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &rec, nil
+}
+
+// sidecarBook finds the book a sidecar belongs to: Book.sdr/metadata.epub.lua
+// is the sidecar of Book.epub.
+func sidecarBook(path string) (string, error) {
+	dir := filepath.Dir(path)
+	ext := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "metadata."), ".lua")
+	book := strings.TrimSuffix(dir, ".sdr") + "." + ext
+	_, err := os.Stat(book)
+	if err != nil {
+		return "", fmt.Errorf("no partial_md5_checksum and can't find the book: %s", err)
+	}
+
+	return book, nil
+}
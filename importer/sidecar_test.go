@@ -0,0 +1,127 @@
+package importer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ficoos/kokosync/kosync"
+)
+
+var sidecarOptions = SidecarOptions{User: "alice", Device: "kobo", DeviceID: "K1"}
+
+func writeSidecar(t *testing.T, path string, src string, modified time.Time) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte(src), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(path, modified, modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadSidecarsFixture(t *testing.T) {
+	path := "testdata/library/Some Book.sdr/metadata.epub.lua"
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := ReadSidecars("testdata/library", sidecarOptions)
+	if err != nil {
+		t.Fatalf("read sidecars: %s", err)
+	}
+	want := []*Record{{
+		User: "alice",
+		Progress: kosync.Progress{
+			Document:   "5b1cf3d1f4d5d3bda1a9b50f73d5c7e2",
+			Progress:   "/body/DocFragment[12]/body/div/p[3]/text().45",
+			Percentage: 0.41374045801527,
+			Device:     "kobo",
+			DeviceID:   "K1",
+			Timestamp:  info.ModTime().Unix(),
+		},
+	}}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("got %+v, want %+v", records[0], want[0])
+	}
+}
+
+func TestReadSidecars(t *testing.T) {
+	root := t.TempDir()
+	modified := time.Unix(1700000000, 0)
+	// no partial_md5_checksum, the book next to the sidecar is hashed
+	writeBook(t, filepath.Join(root, "Old Book.epub"), 70000)
+	writeSidecar(t, filepath.Join(root, "Old Book.sdr", "metadata.epub.lua"), `return {
+    ["last_xpointer"] = "/body/DocFragment[2]/body/p[1]/text().0",
+    ["percent_finished"] = 0.1,
+}`, modified)
+	// paged documents save the page
+	writeSidecar(t, filepath.Join(root, "sub", "Paper.sdr", "metadata.pdf.lua"), `return {
+    ["last_page"] = 17,
+    ["partial_md5_checksum"] = "00000000000000000000000000000017",
+    ["percent_finished"] = 0.5,
+}`, modified)
+	// never read past the first page
+	writeSidecar(t, filepath.Join(root, "New Book.sdr", "metadata.epub.lua"), `return {
+    ["partial_md5_checksum"] = "00000000000000000000000000000001",
+}`, modified)
+	// not sidecars
+	writeSidecar(t, filepath.Join(root, "metadata.epub.lua"), "not lua", modified)
+	writeSidecar(t, filepath.Join(root, "Other.sdr", "notes.lua"), "not lua", modified)
+
+	records, err := ReadSidecars(root, sidecarOptions)
+	if err != nil {
+		t.Fatalf("read sidecars: %s", err)
+	}
+	record := func(document string, progress string, percentage float64) *Record {
+		return &Record{User: "alice", Progress: kosync.Progress{
+			Document:   document,
+			Progress:   progress,
+			Percentage: percentage,
+			Device:     "kobo",
+			DeviceID:   "K1",
+			Timestamp:  modified.Unix(),
+		}}
+	}
+	want := []*Record{
+		record("7c495b34b24f561520622156e96f834d", "/body/DocFragment[2]/body/p[1]/text().0", 0.1),
+		record("00000000000000000000000000000017", "17", 0.5),
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("got %d records, want %d", len(records), len(want))
+		for i, rec := range records {
+			t.Logf("record %d: %+v", i, rec)
+		}
+	}
+}
+
+func TestReadSidecarsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"book missing", `return { ["last_page"] = 3 }`, "can't find the book"},
+		{"bad lua", `return { ["last_page"] = }`, "lua line 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeSidecar(t, filepath.Join(root, "Book.sdr", "metadata.epub.lua"), tt.src, time.Now())
+			_, err := ReadSidecars(root, sidecarOptions)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
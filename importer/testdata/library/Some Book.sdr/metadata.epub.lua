@@ -0,0 +1,56 @@
+-- we can read Lua syntax here!
+return {
+    ["annotations"] = {
+        [1] = {
+            ["chapter"] = "Chapter 3: \"Dawn\"",
+            ["color"] = "yellow",
+            ["datetime"] = "2024-03-02 21:14:05",
+            ["drawer"] = "lighten",
+            ["page"] = "/body/DocFragment[5]/body/p[3]/text().0",
+            ["pos0"] = "/body/DocFragment[5]/body/p[3]/text().0",
+            ["pos1"] = "/body/DocFragment[5]/body/p[3]/text().42",
+            ["text"] = "It was a C:\\path and a tab\9and\
+a new line",
+        },
+    },
+    ["bookmarks"] = {},
+    ["cre_dom_version"] = 20240114,
+    ["css"] = "./data/epub.css",
+    ["doc_pages"] = 312,
+    ["doc_path"] = "/mnt/onboard/Books/Some Book.epub",
+    ["doc_props"] = {
+        ["authors"] = "Jane O'Doe",
+        ["description"] = "<p>A book\013with a \"blurb\".</p>",
+        ["identifiers"] = "uuid:0c6f2f34-d0ce-4ac6-9a3c-7e0b5a0a1f6b",
+        ["keywords"] = "Fiction\
+Adventure",
+        ["language"] = "en",
+        ["pages"] = nil,
+        ["title"] = "Some Book",
+    },
+    ["font_face"] = "Noto Serif",
+    ["hyphenation"] = true,
+    ["last_xpointer"] = "/body/DocFragment[12]/body/div/p[3]/text().45",
+    ["partial_md5_checksum"] = "5b1cf3d1f4d5d3bda1a9b50f73d5c7e2",
+    ["percent_finished"] = 0.41374045801527,
+    ["readermenu_tab_index"] = 2,
+    ["stats"] = {
+        ["authors"] = "Jane O'Doe",
+        ["highlights"] = 1,
+        ["notes"] = 0,
+        ["pages"] = 312,
+        ["performance_in_pages"] = {},
+        ["title"] = "Some Book",
+    },
+    ["summary"] = {
+        ["modified"] = "2024-03-02",
+        ["status"] = "reading",
+    },
+    ["copt_font_gamma"] = 15,
+    ["copt_line_spacing"] = 100,
+    ["floating_punctuation"] = false,
+    ["highlight_disabled"] = false,
+    ["kopt_page_margin"] = 0.05,
+    ["page_overlap_style"] = "dim",
+    ["reading_order"] = { "spine", 'toc', 3, -1.5e2, true, { "nested" }, },
+}
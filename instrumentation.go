@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ficoos/kokosync/kosync"
+	"github.com/ficoos/kokosync/metrics"
+	"github.com/ficoos/kokosync/webhook"
+)
+
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	httpRequests = metricsRegistry.NewCounter(
+		"kokosync_http_requests_total",
+		"Number of kosync requests handled.",
+		"route", "status",
+	)
+	httpRequestDuration = metricsRegistry.NewHistogram(
+		"kokosync_http_request_duration_seconds",
+		"Latency of kosync requests.",
+		nil,
+		"route", "status",
+	)
+	upstreamRequests = metricsRegistry.NewCounter(
+		"kokosync_upstream_requests_total",
+		"Number of requests sent to the upstream kosync server.",
+		"operation", "result",
+	)
+	upstreamRequestDuration = metricsRegistry.NewHistogram(
+		"kokosync_upstream_request_duration_seconds",
+		"Latency of requests sent to the upstream kosync server.",
+		nil,
+		"operation",
+	)
+	rateLimited = metricsRegistry.NewCounter(
+		"kokosync_rate_limited_total",
+		"Number of kosync requests refused by the rate limiter.",
+		"reason",
+	)
+	webhookDeliveries = metricsRegistry.NewCounter(
+		"kokosync_webhook_deliveries_total",
+		"Number of webhook delivery attempts.",
+		"event", "result",
+	)
+	mqttPublishes = metricsRegistry.NewCounter(
+		"kokosync_mqtt_publishes_total",
+		"Number of MQTT publish attempts.",
+		"result",
+	)
+	dbQueryDuration = metricsRegistry.NewHistogram(
+		"kokosync_db_query_duration_seconds",
+		"Latency of database queries.",
+		[]float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		"query", "result",
+	)
+)
+
+// observeUpstream is a kosync.Observer recording upstream metrics.
+func observeUpstream(operation string, elapsed time.Duration, err error) {
+	upstreamRequestDuration.Observe(elapsed.Seconds(), operation)
+	upstreamRequests.Inc(operation, upstreamResult(err))
+}
+
+func upstreamResult(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, kosync.ErrUnauthorized):
+		return "unauthorized"
+	case errors.Is(err, kosync.ErrDocNotFound):
+		return "not_found"
+	default:
+		return "error"
+	}
+}
+
+func observeWebhook(event webhook.Event, result string) {
+	webhookDeliveries.Inc(string(event), result)
+}
+
+func observeMQTT(result string) {
+	mqttPublishes.Inc(result)
+}
+
+// observeQuery records the latency of a database query.
+func observeQuery(query string, elapsed time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	dbQueryDuration.Observe(elapsed.Seconds(), query, result)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrumentHandler records request metrics labeled with the route pattern
+// next matched. next must be the http.ServeMux doing the routing so the
+// pattern it sets on the request is visible here.
+func instrumentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		statusText := strconv.Itoa(status)
+		httpRequests.Inc(route, statusText)
+		httpRequestDuration.Observe(time.Since(start).Seconds(), route, statusText)
+	})
+}
@@ -2,12 +2,16 @@ package kosync
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"time"
 
+	"github.com/ficoos/kokosync/reqid"
 	"github.com/ficoos/kokosync/urlutil"
 )
 
@@ -17,6 +21,9 @@ type Progress struct {
 	Percentage float64 `json:"percentage"`
 	Device     string  `json:"device"`
 	DeviceID   string  `json:"device_id"`
+	// Timestamp is the unix time the progress was saved at, set by the
+	// server.
+	Timestamp int64 `json:"timestamp,omitempty"`
 }
 
 func (p *Progress) String() string {
@@ -35,11 +42,15 @@ type UpdateProgressResult struct {
 	Timestamp int64  `json:"timestamp"`
 }
 
+// Observer is notified about the outcome of every upstream request.
+type Observer func(operation string, elapsed time.Duration, err error)
+
 type Client struct {
 	userName   string
 	userKey    string
 	apiRoot    *url.URL
 	httpClient *http.Client
+	observer   Observer
 }
 
 func NewClient(apiRoot *url.URL, userName, userKey string) *Client {
@@ -51,7 +62,23 @@ func NewClient(apiRoot *url.URL, userName, userKey string) *Client {
 	}
 }
 
-func (c *Client) request(method string, url *url.URL, payload any, result any) error {
+// SetObserver sets a function to be called after every request.
+func (c *Client) SetObserver(observer Observer) {
+	c.observer = observer
+}
+
+func (c *Client) request(ctx context.Context, operation string, method string, url *url.URL, payload any, result any) error {
+	if c.observer == nil {
+		return c.doRequest(ctx, method, url, payload, result)
+	}
+
+	start := time.Now()
+	err := c.doRequest(ctx, method, url, payload, result)
+	c.observer(operation, time.Since(start), err)
+	return err
+}
+
+func (c *Client) doRequest(ctx context.Context, method string, url *url.URL, payload any, result any) error {
 	var body io.ReadCloser
 	if payload != nil {
 		var buff bytes.Buffer
@@ -62,7 +89,7 @@ func (c *Client) request(method string, url *url.URL, payload any, result any) e
 		}
 		body = io.NopCloser(bytes.NewReader(buff.Bytes()))
 	}
-	req := &http.Request{
+	req := (&http.Request{
 		Method: method,
 		URL:    url,
 		Header: http.Header{
@@ -71,11 +98,17 @@ func (c *Client) request(method string, url *url.URL, payload any, result any) e
 			"X-Auth-Key":   []string{c.userKey},
 		},
 		Body: body,
+	}).WithContext(ctx)
+	if id := reqid.FromContext(ctx); id != "" {
+		req.Header.Set(reqid.Header, id)
 	}
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("send http request")
+		// The error includes the URL but never the headers so it's safe to
+		// pass on.
+		return fmt.Errorf("send http request: %s", err)
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
@@ -87,8 +120,6 @@ func (c *Client) request(method string, url *url.URL, payload any, result any) e
 		return fmt.Errorf("server retuned an error: %s [%d]", resp.Status, resp.StatusCode)
 	}
 
-	defer resp.Body.Close()
-
 	if result != nil {
 		dec := json.NewDecoder(resp.Body)
 		err = dec.Decode(result)
@@ -100,11 +131,11 @@ func (c *Client) request(method string, url *url.URL, payload any, result any) e
 	return nil
 }
 
-func (c *Client) Progress(document string) (*Progress, error) {
+func (c *Client) Progress(ctx context.Context, document string) (*Progress, error) {
 	u := urlutil.Join(c.apiRoot, "/syncs/progress/", document)
 	var result Progress
 	// TODO: handle not found
-	err := c.request(http.MethodGet, u, nil, &result)
+	err := c.request(ctx, "progress", http.MethodGet, u, nil, &result)
 	if err != nil {
 		return nil, err
 	}
@@ -112,12 +143,24 @@ func (c *Client) Progress(document string) (*Progress, error) {
 	return &result, nil
 }
 
-func (c *Client) UpdateProgress(progress *Progress) (*UpdateProgressResult, error) {
+func (c *Client) UpdateProgress(ctx context.Context, progress *Progress) (*UpdateProgressResult, error) {
 	var result UpdateProgressResult
-	err := c.request(http.MethodPut, urlutil.Join(c.apiRoot, "/syncs/progress"), progress, &result)
+	err := c.request(ctx, "update_progress", http.MethodPut, urlutil.Join(c.apiRoot, "/syncs/progress"), progress, &result)
 	return &result, err
 }
 
-func (c *Client) Authorize() error {
-	return c.request(http.MethodGet, urlutil.Join(c.apiRoot, "/users/auth"), nil, nil)
+func (c *Client) Authorize(ctx context.Context) error {
+	return c.request(ctx, "authorize", http.MethodGet, urlutil.Join(c.apiRoot, "/users/auth"), nil, nil)
+}
+
+// Ping checks that the server is reachable and responding. The client
+// doesn't need valid credentials, a rejected login still proves the server
+// is up.
+func (c *Client) Ping(ctx context.Context) error {
+	err := c.request(ctx, "ping", http.MethodGet, urlutil.Join(c.apiRoot, "/users/auth"), nil, nil)
+	if errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrDocNotFound) {
+		return nil
+	}
+
+	return err
 }
@@ -1,10 +1,11 @@
 package kosync
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 )
 
@@ -34,21 +35,36 @@ func translateError(err error) int {
 	return http.StatusInternalServerError
 }
 
-func (a *Auth) String() string {
+// String never includes the key, it's the user's (hashed) password.
+func (a Auth) String() string {
 	return fmt.Sprintf("[user=%s key=REDACTED]", a.User)
 }
 
-func (a *Auth) Repr() string {
-	return fmt.Sprintf("[user=%s key=%s]", a.User, a.Key)
+// LogValue implements slog.LogValuer so the key is redacted in structured
+// logs as well.
+func (a Auth) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("user", a.User),
+		slog.String("key", "REDACTED"),
+	)
 }
 
+// GoString keeps %#v from exposing the key.
+func (a Auth) GoString() string {
+	return a.String()
+}
+
+// Server implements the kosync API, ctx is the request context and carries
+// the request ID.
 type Server interface {
-	UpdateProgress(auth *Auth, progress *Progress) (*UpdateProgressResult, error)
-	GetProgress(auth *Auth, documentHash string) (*Progress, error)
-	Authorize(auth *Auth) error
+	UpdateProgress(ctx context.Context, auth *Auth, progress *Progress) (*UpdateProgressResult, error)
+	GetProgress(ctx context.Context, auth *Auth, documentHash string) (*Progress, error)
+	Authorize(ctx context.Context, auth *Auth) error
 }
 
-func extractAuth(r *http.Request) *Auth {
+// AuthFromRequest returns the credentials KOReader sends with every
+// request.
+func AuthFromRequest(r *http.Request) *Auth {
 	var res Auth
 	res.User = r.Header.Get("X-Auth-User")
 	res.Key = r.Header.Get("X-Auth-Key")
@@ -56,66 +72,136 @@ func extractAuth(r *http.Request) *Auth {
 	return &res
 }
 
-func NewServer(server Server) http.Handler {
+// DefaultMaxBodySize is the default limit on request bodies, a progress
+// update is a few hundred bytes.
+const DefaultMaxBodySize = 64 << 10
+
+type serverOptions struct {
+	maxBodySize         int64
+	rejectUnknownFields bool
+}
+
+type ServerOption func(*serverOptions)
+
+// WithMaxBodySize sets the largest request body accepted.
+func WithMaxBodySize(size int64) ServerOption {
+	return func(o *serverOptions) {
+		o.maxBodySize = size
+	}
+}
+
+// WithRejectUnknownFields makes progress updates containing fields this
+// package doesn't know about fail instead of ignoring the extra fields.
+func WithRejectUnknownFields(reject bool) ServerOption {
+	return func(o *serverOptions) {
+		o.rejectUnknownFields = reject
+	}
+}
+
+type errorResponse struct {
+	Message string `json:"message"`
+}
+
+// writeError writes the one and only response for a failed request.
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	message := http.StatusText(status)
+	if status == http.StatusInternalServerError {
+		slog.ErrorContext(r.Context(), "request failed", "uri", r.RequestURI, "error", err)
+	} else {
+		slog.DebugContext(r.Context(), "request rejected", "uri", r.RequestURI, "status", status, "error", err)
+		if status == http.StatusBadRequest {
+			message = err.Error()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&errorResponse{Message: message})
+}
+
+func writeResult(w http.ResponseWriter, r *http.Request, result any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err := json.NewEncoder(w).Encode(result)
+	if err != nil {
+		// Too late to change the status
+		slog.WarnContext(r.Context(), "write response", "uri", r.RequestURI, "error", err)
+	}
+}
+
+func (o *serverOptions) decodeProgress(w http.ResponseWriter, r *http.Request) (*Progress, int, error) {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, o.maxBodySize))
+	if o.rejectUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+
+	var p Progress
+	err := dec.Decode(&p)
+	if err == nil && dec.More() {
+		err = errors.New("unexpected data after progress object")
+	}
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, http.StatusRequestEntityTooLarge, err
+		}
+		return nil, http.StatusBadRequest, fmt.Errorf("%w: decode progress: %s", ErrBadRequest, err)
+	}
+
+	err = p.Validate()
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	return &p, http.StatusOK, nil
+}
+
+func NewServer(server Server, opts ...ServerOption) http.Handler {
+	o := &serverOptions{maxBodySize: DefaultMaxBodySize}
+	for _, opt := range opts {
+		opt(o)
+	}
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /users/auth", func(w http.ResponseWriter, r *http.Request) {
-		auth := extractAuth(r)
-		err := server.Authorize(auth)
-		status := translateError(err)
-		w.Header().Add("Content-Type", "application/json")
-		w.WriteHeader(status)
-		if status == http.StatusInternalServerError {
-			log.Printf("ERROR: %s: %s", r.RequestURI, err)
-		}
-		if err == nil {
-			w.Write([]byte(`{ "authorized": "OK" }`))
+		err := server.Authorize(r.Context(), AuthFromRequest(r))
+		if err != nil {
+			writeError(w, r, translateError(err), err)
+			return
 		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{ "authorized": "OK" }`))
 	})
 	mux.HandleFunc("GET /syncs/progress/{documenthash}", func(w http.ResponseWriter, r *http.Request) {
-		hash := r.PathValue("documenthash")
-		progress, err := server.GetProgress(extractAuth(r), hash)
-		status := translateError(err)
-		w.Header().Add("Content-Type", "application/json")
-		w.WriteHeader(status)
-		if status == http.StatusInternalServerError {
-			log.Printf("ERROR: %s: %s", r.RequestURI, err)
-		}
+		hash, err := NormalizeDocumentHash(r.PathValue("documenthash"))
 		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		enc := json.NewEncoder(w)
-		err = enc.Encode(progress)
+		progress, err := server.GetProgress(r.Context(), AuthFromRequest(r), hash)
 		if err != nil {
-			log.Printf("ERROR: %s: %s", r.RequestURI, err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, r, translateError(err), err)
+			return
 		}
+
+		writeResult(w, r, progress)
 	})
 	mux.HandleFunc("PUT /syncs/progress", func(w http.ResponseWriter, r *http.Request) {
-		dec := json.NewDecoder(r.Body)
-		var p Progress
-		err := dec.Decode(&p)
-		if err != nil {
-			log.Printf("ERROR: %s: %s", r.RequestURI, err)
-			w.WriteHeader(http.StatusBadRequest)
-		}
-		res, err := server.UpdateProgress(extractAuth(r), &p)
-		status := translateError(err)
-		w.Header().Add("Content-Type", "application/json")
-		w.WriteHeader(status)
-		if status == http.StatusInternalServerError {
-			log.Printf("ERROR: %s: %s", r.RequestURI, err)
-		}
+		p, status, err := o.decodeProgress(w, r)
 		if err != nil {
+			writeError(w, r, status, err)
 			return
 		}
 
-		enc := json.NewEncoder(w)
-		err = enc.Encode(res)
+		res, err := server.UpdateProgress(r.Context(), AuthFromRequest(r), p)
 		if err != nil {
-			log.Printf("ERROR: %s: %s", r.RequestURI, err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, r, translateError(err), err)
+			return
 		}
+
+		writeResult(w, r, res)
 	})
 
 	return mux
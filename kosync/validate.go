@@ -0,0 +1,75 @@
+package kosync
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// DocumentHashLength is the length of the hex encoded md5 KOReader uses
+	// to identify documents, either of the file contents or of its name.
+	DocumentHashLength = 32
+
+	MaxProgressLength = 4096
+	MaxDeviceLength   = 256
+)
+
+// NormalizeDocumentHash validates a document hash and returns it in lower
+// case.
+func NormalizeDocumentHash(hash string) (string, error) {
+	if len(hash) != DocumentHashLength {
+		return "", fmt.Errorf("%w: document hash must be %d hex characters", ErrBadRequest, DocumentHashLength)
+	}
+	for _, c := range hash {
+		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')) {
+			return "", fmt.Errorf("%w: document hash must be hex encoded", ErrBadRequest)
+		}
+	}
+
+	return strings.ToLower(hash), nil
+}
+
+func validateString(name string, value string, maxLength int) error {
+	if value == "" {
+		return fmt.Errorf("%w: %s is required", ErrBadRequest, name)
+	}
+	if len(value) > maxLength {
+		return fmt.Errorf("%w: %s is longer than %d bytes", ErrBadRequest, name, maxLength)
+	}
+	if !utf8.ValidString(value) {
+		return fmt.Errorf("%w: %s is not valid utf-8", ErrBadRequest, name)
+	}
+
+	return nil
+}
+
+// Validate checks a progress update is well formed and normalizes the
+// document hash. Errors wrap ErrBadRequest.
+func (p *Progress) Validate() error {
+	var err error
+	p.Document, err = NormalizeDocumentHash(p.Document)
+	if err != nil {
+		return err
+	}
+
+	if math.IsNaN(p.Percentage) || p.Percentage < 0 || p.Percentage > 1 {
+		return fmt.Errorf("%w: percentage must be between 0 and 1", ErrBadRequest)
+	}
+
+	err = validateString("progress", p.Progress, MaxProgressLength)
+	if err != nil {
+		return err
+	}
+	err = validateString("device", p.Device, MaxDeviceLength)
+	if err != nil {
+		return err
+	}
+	err = validateString("device_id", p.DeviceID, MaxDeviceLength)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
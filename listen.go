@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// systemd passes socket activated file descriptors starting at 3.
+const sdListenFDsStart = 3
+
+type UnixSocketOptions struct {
+	// Mode is applied to the socket file when non zero.
+	Mode fs.FileMode
+	// Owner and Group are user/group names or numeric ids, empty means
+	// leave as is.
+	Owner string
+	Group string
+}
+
+// Listen opens a listener for every address of every set and returns
+// them per set. The sets are bound together so the sockets passed by
+// systemd can be split between them.
+//
+// Supported address forms are:
+//
+//	host:port            tcp (dual stack when the host allows it)
+//	tcp:host:port        same as above
+//	tcp4:host:port       IPv4 only
+//	tcp6:[host]:port     IPv6 only
+//	unix:/path/to/socket unix domain socket
+//	systemd              socket activated sockets no systemd:name of any set asks for
+//	systemd:name         socket activated sockets named name (FileDescriptorName=)
+func Listen(sets [][]string, unixOpts UnixSocketOptions) ([][]net.Listener, error) {
+	var all []net.Listener
+	closeAll := func() {
+		for _, l := range all {
+			l.Close()
+		}
+	}
+
+	// named are the names asked for explicitly, which a bare systemd leaves
+	// for them
+	named := map[string]bool{}
+	for _, addrs := range sets {
+		for _, addr := range addrs {
+			network, address := splitListenAddress(addr)
+			if network == "systemd" && address != "" {
+				named[address] = true
+			}
+		}
+	}
+
+	var activated []net.Listener
+	var activatedNames []string
+	activatedUsed := false
+	res := make([][]net.Listener, len(sets))
+	for i, addrs := range sets {
+		for _, addr := range addrs {
+			network, address := splitListenAddress(addr)
+			switch network {
+			case "tcp", "tcp4", "tcp6":
+				l, err := net.Listen(network, address)
+				if err != nil {
+					closeAll()
+					return nil, fmt.Errorf("listen on %s: %s", addr, err)
+				}
+				res[i] = append(res[i], l)
+				all = append(all, l)
+			case "unix":
+				l, err := listenUnix(address, unixOpts)
+				if err != nil {
+					closeAll()
+					return nil, fmt.Errorf("listen on %s: %s", addr, err)
+				}
+				res[i] = append(res[i], l)
+				all = append(all, l)
+			case "systemd":
+				if activated == nil {
+					var err error
+					// systemdListeners can only be called once, it
+					// unsets the environment it reads
+					activated, activatedNames, err = systemdListeners()
+					if err != nil {
+						closeAll()
+						return nil, fmt.Errorf("socket activation: %s", err)
+					}
+				}
+				found := false
+				for j, l := range activated {
+					if l == nil {
+						continue
+					}
+					if (address == "" && named[activatedNames[j]]) || (address != "" && activatedNames[j] != address) {
+						continue
+					}
+					res[i] = append(res[i], l)
+					all = append(all, l)
+					activated[j] = nil
+					found = true
+				}
+				if !found {
+					closeAll()
+					return nil, fmt.Errorf("listen on %s: no matching socket activated listeners", addr)
+				}
+				activatedUsed = true
+			default:
+				closeAll()
+				return nil, fmt.Errorf("listen on %s: unsupported network %q", addr, network)
+			}
+		}
+	}
+
+	if activatedUsed {
+		// Close anything systemd passed in that wasn't asked for
+		for _, l := range activated {
+			if l != nil {
+				l.Close()
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func splitListenAddress(addr string) (network string, address string) {
+	if addr == "systemd" {
+		return "systemd", ""
+	}
+	prefix, rest, ok := strings.Cut(addr, ":")
+	if ok {
+		switch prefix {
+		case "tcp", "tcp4", "tcp6", "unix", "systemd":
+			return prefix, rest
+		}
+	}
+
+	return "tcp", addr
+}
+
+func listenUnix(path string, opts UnixSocketOptions) (net.Listener, error) {
+	// A socket left behind by a previous instance that wasn't shut down
+	// cleanly would make the bind fail.
+	st, err := os.Lstat(path)
+	if err == nil {
+		if st.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return nil, fmt.Errorf("remove stale socket: %s", err)
+		}
+	}
+
+	// The socket is bound in a directory only we can enter and moved into
+	// place once its permissions are set, nobody can connect to it before
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".kokosync-socket-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// Close would remove tmp, unixListener removes path instead
+	l.SetUnlinkOnClose(false)
+
+	err = applyUnixSocketOptions(tmp, opts)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return &unixListener{UnixListener: l, path: path}, nil
+}
+
+// unixListener is a socket bound elsewhere and moved to path, it removes
+// path when first closed.
+type unixListener struct {
+	*net.UnixListener
+	path   string
+	unlink sync.Once
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.unlink.Do(func() { os.Remove(l.path) })
+	return err
+}
+
+func applyUnixSocketOptions(path string, opts UnixSocketOptions) error {
+	if opts.Mode != 0 {
+		err := os.Chmod(path, opts.Mode)
+		if err != nil {
+			return fmt.Errorf("chmod socket: %s", err)
+		}
+	}
+
+	if opts.Owner == "" && opts.Group == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if opts.Owner != "" {
+		id, err := lookupID(opts.Owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("lookup socket owner: %s", err)
+		}
+		uid = id
+	}
+	if opts.Group != "" {
+		id, err := lookupID(opts.Group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return fmt.Errorf("lookup socket group: %s", err)
+		}
+		gid = id
+	}
+
+	err := os.Chown(path, uid, gid)
+	if err != nil {
+		return fmt.Errorf("chown socket: %s", err)
+	}
+
+	return nil
+}
+
+func lookupID(nameOrID string, lookup func(string) (string, error)) (int, error) {
+	id, err := strconv.Atoi(nameOrID)
+	if err == nil {
+		return id, nil
+	}
+
+	raw, err := lookup(nameOrID)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(raw)
+}
+
+// systemdListeners returns the listeners passed in by systemd socket
+// activation (see sd_listen_fds(3)) along with their names.
+func systemdListeners() ([]net.Listener, []string, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil, errors.New("no sockets passed by systemd")
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil, errors.New("no sockets passed by systemd")
+	}
+
+	var names []string
+	if rawNames := os.Getenv("LISTEN_FDNAMES"); rawNames != "" {
+		names = strings.Split(rawNames, ":")
+	}
+
+	// Don't let child processes think they are socket activated
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, count)
+	listenerNames := make([]string, count)
+	for i := range count {
+		fd := sdListenFDsStart + i
+		syscall.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		// FileListener dups the descriptor
+		f.Close()
+		if err != nil {
+			for _, l := range listeners[:i] {
+				l.Close()
+			}
+			return nil, nil, fmt.Errorf("fd %d: %s", fd, err)
+		}
+		listeners[i] = l
+		listenerNames[i] = name
+	}
+
+	return listeners, listenerNames, nil
+}
@@ -0,0 +1,132 @@
+package locator
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// positionLength is the length of a Readium position, EPUB resources get
+// one position for every 1024 bytes.
+const positionLength = 1024
+
+// ErrOutOfSpine is returned for fragments and hrefs the spine doesn't have.
+var ErrOutOfSpine = errors.New("fragment is outside the spine")
+
+// SpineItem is a resource in the reading order of an EPUB.
+type SpineItem struct {
+	Href string
+	Type string
+	// Length is the size of the resource in bytes, it weights the
+	// progression of the item. Unknown lengths count as one position.
+	Length int
+}
+
+// Spine is the reading order of an EPUB, DocFragment[n] is Spine[n-1].
+type Spine []SpineItem
+
+// Locations are the Readium locations of a Locator.
+type Locations struct {
+	// Progression is within the resource, 0 to 1.
+	Progression float64 `json:"progression"`
+	// TotalProgression is within the publication, 0 to 1.
+	TotalProgression float64 `json:"totalProgression"`
+	// Position is the 1-based Readium position.
+	Position int `json:"position"`
+}
+
+// Locator is a Readium locator, the format Komga stores progression in.
+type Locator struct {
+	Href      string    `json:"href"`
+	Type      string    `json:"type"`
+	Locations Locations `json:"locations"`
+}
+
+func (item SpineItem) positions() int {
+	return max(1, (item.Length+positionLength-1)/positionLength)
+}
+
+func (item SpineItem) weight() float64 {
+	if item.Length <= 0 {
+		return positionLength
+	}
+	return float64(item.Length)
+}
+
+// bounds returns where item i starts and ends in the publication and the
+// position it starts at.
+func (s Spine) bounds(i int) (start float64, end float64, position int) {
+	var total, before float64
+	for j, item := range s {
+		if j < i {
+			before += item.weight()
+			position += item.positions()
+		}
+		total += item.weight()
+	}
+	return before / total, (before + s[i].weight()) / total, position + 1
+}
+
+// Locate turns x and the percentage KOReader synced with it into a Locator.
+// KOReader doesn't say where in the fragment x is without the book, so the
+// progression within the resource is approximated from percentage and the
+// lengths of the spine items.
+func (s Spine) Locate(x *XPointer, percentage float64) (*Locator, error) {
+	i, ok := x.SpineIndex()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s has no DocFragment", ErrInvalid, x)
+	}
+	if i >= len(s) {
+		return nil, fmt.Errorf("%w: DocFragment[%d] of %d", ErrOutOfSpine, x.Fragment, len(s))
+	}
+
+	start, end, position := s.bounds(i)
+	progression := clamp((percentage - start) / (end - start))
+	positions := s[i].positions()
+	return &Locator{
+		Href: s[i].Href,
+		Type: s[i].Type,
+		Locations: Locations{
+			Progression:      progression,
+			TotalProgression: start + progression*(end-start),
+			Position:         position + min(positions-1, int(progression*float64(positions))),
+		},
+	}, nil
+}
+
+// XPointer turns l into the start of its fragment and the percentage to
+// sync with it, the inverse of Locate as far as it goes.
+func (s Spine) XPointer(l *Locator) (*XPointer, float64, error) {
+	for i, item := range s {
+		if item.Href != l.Href {
+			continue
+		}
+		start, end, _ := s.bounds(i)
+		percentage := l.Locations.TotalProgression
+		if percentage == 0 {
+			percentage = start + clamp(l.Locations.Progression)*(end-start)
+		}
+		return &XPointer{Fragment: i + 1, HasOffset: true}, clamp(percentage), nil
+	}
+
+	return nil, 0, fmt.Errorf("%w: %s", ErrOutOfSpine, l.Href)
+}
+
+// SpineCFI returns an EPUB CFI for the spine item x points into, assuming
+// the spine is the third child of the package document as it is in most
+// books. The path within the item isn't translated, KOReader counts
+// elements of the same name while CFIs count all children.
+func (x *XPointer) SpineCFI() (string, error) {
+	i, ok := x.SpineIndex()
+	if !ok {
+		return "", fmt.Errorf("%w: %s has no DocFragment", ErrInvalid, x)
+	}
+	return fmt.Sprintf("epubcfi(/6/%d!)", (i+1)*2), nil
+}
+
+func clamp(f float64) float64 {
+	if math.IsNaN(f) {
+		return 0
+	}
+	return math.Max(0, math.Min(1, f))
+}
@@ -0,0 +1,185 @@
+package locator
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+// testSpine is weighted 0.2, 0.6 and 0.2 and has 1, 3 and 1 positions.
+var testSpine = Spine{
+	{Href: "OEBPS/cover.xhtml", Type: "application/xhtml+xml", Length: 1024},
+	{Href: "OEBPS/ch01.xhtml", Type: "application/xhtml+xml", Length: 3072},
+	{Href: "OEBPS/ch02.xhtml", Type: "application/xhtml+xml"},
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestLocate(t *testing.T) {
+	tests := []struct {
+		name       string
+		xpointer   string
+		percentage float64
+		want       Locator
+	}{
+		{
+			name:       "first fragment",
+			xpointer:   "/body/DocFragment[1].0",
+			percentage: 0.1,
+			want:       Locator{Href: "OEBPS/cover.xhtml", Locations: Locations{Progression: 0.5, TotalProgression: 0.1, Position: 1}},
+		},
+		{
+			name:       "middle of fragment",
+			xpointer:   "/body/DocFragment[2]/body/div/p[3]/text().45",
+			percentage: 0.5,
+			want:       Locator{Href: "OEBPS/ch01.xhtml", Locations: Locations{Progression: 0.5, TotalProgression: 0.5, Position: 3}},
+		},
+		{
+			name:       "before fragment",
+			xpointer:   "/body/DocFragment[2]/body/p.0",
+			percentage: 0.05,
+			want:       Locator{Href: "OEBPS/ch01.xhtml", Locations: Locations{Progression: 0, TotalProgression: 0.2, Position: 2}},
+		},
+		{
+			name:       "after fragment",
+			xpointer:   "/body/DocFragment[2]/body/p.0",
+			percentage: 0.95,
+			want:       Locator{Href: "OEBPS/ch01.xhtml", Locations: Locations{Progression: 1, TotalProgression: 0.8, Position: 4}},
+		},
+		{
+			name:       "unknown length",
+			xpointer:   "/body/DocFragment[3].0",
+			percentage: 1,
+			want:       Locator{Href: "OEBPS/ch02.xhtml", Locations: Locations{Progression: 1, TotalProgression: 1, Position: 5}},
+		},
+		{
+			name:       "percentage out of range",
+			xpointer:   "/body/DocFragment[1].0",
+			percentage: -3,
+			want:       Locator{Href: "OEBPS/cover.xhtml", Locations: Locations{Progression: 0, TotalProgression: 0, Position: 1}},
+		},
+		{
+			name:       "nan percentage",
+			xpointer:   "/body/DocFragment[3].0",
+			percentage: math.NaN(),
+			want:       Locator{Href: "OEBPS/ch02.xhtml", Locations: Locations{Progression: 0, TotalProgression: 0.8, Position: 5}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, err := ParseXPointer(tt.xpointer)
+			if err != nil {
+				t.Fatalf("parse %q: %s", tt.xpointer, err)
+			}
+			l, err := testSpine.Locate(x, tt.percentage)
+			if err != nil {
+				t.Fatalf("locate %q: %s", tt.xpointer, err)
+			}
+			tt.want.Type = "application/xhtml+xml"
+			if l.Href != tt.want.Href || l.Type != tt.want.Type || l.Locations.Position != tt.want.Locations.Position ||
+				!near(l.Locations.Progression, tt.want.Locations.Progression) ||
+				!near(l.Locations.TotalProgression, tt.want.Locations.TotalProgression) {
+				t.Fatalf("locate %q at %v = %+v, expected %+v", tt.xpointer, tt.percentage, *l, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocateErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		spine    Spine
+		xpointer string
+		err      error
+	}{
+		{"empty spine", nil, "/body/DocFragment[1].0", ErrOutOfSpine},
+		{"past the spine", testSpine, "/body/DocFragment[4].0", ErrOutOfSpine},
+		{"no fragment", testSpine, "/FictionBook/body/section[2]/p[5]/text().0", ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, err := ParseXPointer(tt.xpointer)
+			if err != nil {
+				t.Fatalf("parse %q: %s", tt.xpointer, err)
+			}
+			l, err := tt.spine.Locate(x, 0.5)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("locate %q = %+v, %v, expected %v", tt.xpointer, l, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestXPointer(t *testing.T) {
+	tests := []struct {
+		name       string
+		locator    Locator
+		xpointer   string
+		percentage float64
+	}{
+		{
+			name:       "total progression",
+			locator:    Locator{Href: "OEBPS/ch01.xhtml", Locations: Locations{Progression: 0.5, TotalProgression: 0.5}},
+			xpointer:   "/body/DocFragment[2].0",
+			percentage: 0.5,
+		},
+		{
+			name:       "progression only",
+			locator:    Locator{Href: "OEBPS/ch01.xhtml", Locations: Locations{Progression: 0.25}},
+			xpointer:   "/body/DocFragment[2].0",
+			percentage: 0.35,
+		},
+		{
+			name:       "progression out of range",
+			locator:    Locator{Href: "OEBPS/ch02.xhtml", Locations: Locations{Progression: 7}},
+			xpointer:   "/body/DocFragment[3].0",
+			percentage: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, percentage, err := testSpine.XPointer(&tt.locator)
+			if err != nil {
+				t.Fatalf("xpointer of %+v: %s", tt.locator, err)
+			}
+			if x.String() != tt.xpointer || !near(percentage, tt.percentage) {
+				t.Fatalf("xpointer of %+v = %s at %v, expected %s at %v", tt.locator, x, percentage, tt.xpointer, tt.percentage)
+			}
+		})
+	}
+
+	for _, spine := range []Spine{nil, testSpine} {
+		_, _, err := spine.XPointer(&Locator{Href: "OEBPS/missing.xhtml"})
+		if !errors.Is(err, ErrOutOfSpine) {
+			t.Fatalf("xpointer of a missing href returned %v, expected ErrOutOfSpine", err)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for fragment := 1; fragment <= len(testSpine); fragment++ {
+		for _, percentage := range []float64{0, 0.1, 0.2, 0.45, 0.8, 0.9, 1} {
+			x := &XPointer{Fragment: fragment, HasOffset: true}
+			l, err := testSpine.Locate(x, percentage)
+			if err != nil {
+				t.Fatalf("locate %s: %s", x, err)
+			}
+			back, total, err := testSpine.XPointer(l)
+			if err != nil {
+				t.Fatalf("xpointer of %+v: %s", *l, err)
+			}
+			if back.String() != x.String() || !near(total, l.Locations.TotalProgression) {
+				t.Fatalf("%s at %v located as %+v returned %s at %v", x, percentage, *l, back, total)
+			}
+			again, err := testSpine.Locate(back, total)
+			if err != nil {
+				t.Fatalf("locate %s: %s", back, err)
+			}
+			if again.Locations.Position != l.Locations.Position || !near(again.Locations.Progression, l.Locations.Progression) {
+				t.Fatalf("%s at %v located as %+v, then as %+v", x, percentage, *l, *again)
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Package locator translates the positions KOReader syncs into the
+// locators Komga and Readium use.
+package locator
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalid is returned for progress that isn't a KOReader xpointer, e.g.
+// the page numbers KOReader syncs for PDFs.
+var ErrInvalid = errors.New("invalid xpointer")
+
+// Step is one element of an xpointer path such as p[3].
+type Step struct {
+	Name string
+	// Index is the 1-based position among the siblings named Name, 0 when
+	// the pointer leaves it out because the element is the only one.
+	Index int
+}
+
+func (s Step) String() string {
+	if s.Index == 0 {
+		return s.Name
+	}
+	return s.Name + "[" + strconv.Itoa(s.Index) + "]"
+}
+
+// XPointer is a parsed KOReader xpointer such as
+// /body/DocFragment[12]/body/div/p[3]/text().45.
+type XPointer struct {
+	// Fragment is the 1-based DocFragment index, the spine item of an EPUB.
+	// It is 0 for books that aren't split into fragments, e.g. FB2.
+	Fragment int
+	// Path are the steps below the fragment, or below the root when there
+	// is no fragment. Text nodes are steps named text().
+	Path []Step
+	// Offset is the character offset into the last step, valid when
+	// HasOffset is set.
+	Offset    int
+	HasOffset bool
+}
+
+// ParseXPointer parses a KOReader xpointer.
+func ParseXPointer(s string) (*XPointer, error) {
+	if !strings.HasPrefix(s, "/") {
+		return nil, fmt.Errorf("%w: %q doesn't start with /", ErrInvalid, s)
+	}
+
+	x := &XPointer{}
+	rest := s[1:]
+	if i := strings.LastIndexByte(rest, '.'); i >= 0 && !strings.ContainsRune(rest[i:], '/') {
+		offset, err := strconv.Atoi(rest[i+1:])
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("%w: bad offset in %q", ErrInvalid, s)
+		}
+		x.Offset, x.HasOffset = offset, true
+		rest = rest[:i]
+	}
+
+	var steps []Step
+	for _, part := range strings.Split(rest, "/") {
+		step, err := parseStep(part)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s in %q", ErrInvalid, err, s)
+		}
+		steps = append(steps, step)
+	}
+
+	if len(steps) >= 2 && steps[0] == (Step{Name: "body"}) && steps[1].Name == "DocFragment" {
+		if steps[1].Index == 0 {
+			return nil, fmt.Errorf("%w: DocFragment without an index in %q", ErrInvalid, s)
+		}
+		x.Fragment = steps[1].Index
+		steps = steps[2:]
+	}
+	if len(steps) > 0 {
+		x.Path = steps
+	}
+
+	return x, nil
+}
+
+func parseStep(s string) (Step, error) {
+	step := Step{Name: s}
+	if i := strings.IndexByte(s, '['); i >= 0 {
+		if !strings.HasSuffix(s, "]") {
+			return step, fmt.Errorf("unterminated index in %q", s)
+		}
+		index, err := strconv.Atoi(s[i+1 : len(s)-1])
+		if err != nil || index < 1 {
+			return step, fmt.Errorf("bad index in %q", s)
+		}
+		step.Name, step.Index = s[:i], index
+	}
+	if step.Name == "" {
+		return step, errors.New("empty step")
+	}
+	if step.Name != "text()" && strings.ContainsAny(step.Name, "()[]") {
+		return step, fmt.Errorf("bad step %q", s)
+	}
+
+	return step, nil
+}
+
+// SpineIndex returns the 0-based spine position of the fragment x points
+// into, false when x has no fragment.
+func (x *XPointer) SpineIndex() (int, bool) {
+	if x.Fragment == 0 {
+		return 0, false
+	}
+	return x.Fragment - 1, true
+}
+
+// String formats x the way KOReader does.
+func (x *XPointer) String() string {
+	var b strings.Builder
+	if x.Fragment != 0 {
+		fmt.Fprintf(&b, "/body/DocFragment[%d]", x.Fragment)
+	}
+	for _, step := range x.Path {
+		b.WriteByte('/')
+		b.WriteString(step.String())
+	}
+	if b.Len() == 0 {
+		b.WriteByte('/')
+	}
+	if x.HasOffset {
+		fmt.Fprintf(&b, ".%d", x.Offset)
+	}
+	return b.String()
+}
@@ -0,0 +1,144 @@
+package locator
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseXPointer(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want XPointer
+	}{
+		{
+			name: "text offset",
+			in:   "/body/DocFragment[12]/body/div/p[3]/text().45",
+			want: XPointer{
+				Fragment:  12,
+				Path:      []Step{{Name: "body"}, {Name: "div"}, {Name: "p", Index: 3}, {Name: "text()"}},
+				Offset:    45,
+				HasOffset: true,
+			},
+		},
+		{
+			name: "indexed text node",
+			in:   "/body/DocFragment[3]/body/section/p[14]/text()[2].17",
+			want: XPointer{
+				Fragment:  3,
+				Path:      []Step{{Name: "body"}, {Name: "section"}, {Name: "p", Index: 14}, {Name: "text()", Index: 2}},
+				Offset:    17,
+				HasOffset: true,
+			},
+		},
+		{
+			name: "fragment start",
+			in:   "/body/DocFragment[7].0",
+			want: XPointer{Fragment: 7, HasOffset: true},
+		},
+		{
+			name: "element without offset",
+			in:   "/body/DocFragment[2]/body/div[2]/h2",
+			want: XPointer{
+				Fragment: 2,
+				Path:     []Step{{Name: "body"}, {Name: "div", Index: 2}, {Name: "h2"}},
+			},
+		},
+		{
+			name: "fb2 without fragment",
+			in:   "/FictionBook/body/section[2]/p[5]/text().0",
+			want: XPointer{
+				Path:      []Step{{Name: "FictionBook"}, {Name: "body"}, {Name: "section", Index: 2}, {Name: "p", Index: 5}, {Name: "text()"}},
+				HasOffset: true,
+			},
+		},
+		{
+			name: "namespaced element",
+			in:   "/body/DocFragment[4]/body/epub:switch/p.3",
+			want: XPointer{
+				Fragment:  4,
+				Path:      []Step{{Name: "body"}, {Name: "epub:switch"}, {Name: "p"}},
+				Offset:    3,
+				HasOffset: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, err := ParseXPointer(tt.in)
+			if err != nil {
+				t.Fatalf("parse %q: %s", tt.in, err)
+			}
+			if !reflect.DeepEqual(*x, tt.want) {
+				t.Fatalf("parse %q = %+v, expected %+v", tt.in, *x, tt.want)
+			}
+			if s := x.String(); s != tt.in {
+				t.Fatalf("%q formats as %q", tt.in, s)
+			}
+		})
+	}
+}
+
+func TestParseXPointerInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"pdf page", "42"},
+		{"empty", ""},
+		{"root", "/"},
+		{"fragment without index", "/body/DocFragment/body/p"},
+		{"zero index", "/body/DocFragment[0]/body/p"},
+		{"zero step index", "/body/DocFragment[2]/body/p[0]"},
+		{"negative index", "/body/DocFragment[2]/body/p[-1]"},
+		{"trailing slash", "/body/DocFragment[2]/body/"},
+		{"empty step", "/body//p"},
+		{"unterminated index", "/body/DocFragment[2/p"},
+		{"bad offset", "/body/DocFragment[2]/body/p.x"},
+		{"negative offset", "/body/DocFragment[2]/body/p.-1"},
+		{"bad step", "/body/DocFragment[2]/body/node()"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, err := ParseXPointer(tt.in)
+			if !errors.Is(err, ErrInvalid) {
+				t.Fatalf("parse %q = %+v, %v, expected ErrInvalid", tt.in, x, err)
+			}
+		})
+	}
+}
+
+func TestSpineIndex(t *testing.T) {
+	tests := []struct {
+		in    string
+		index int
+		ok    bool
+	}{
+		{"/body/DocFragment[1].0", 0, true},
+		{"/body/DocFragment[12]/body/div/p[3]/text().45", 11, true},
+		{"/FictionBook/body/section[2]/p[5]/text().0", 0, false},
+	}
+	for _, tt := range tests {
+		x, err := ParseXPointer(tt.in)
+		if err != nil {
+			t.Fatalf("parse %q: %s", tt.in, err)
+		}
+		index, ok := x.SpineIndex()
+		if index != tt.index || ok != tt.ok {
+			t.Errorf("spine index of %q = %d, %t, expected %d, %t", tt.in, index, ok, tt.index, tt.ok)
+		}
+	}
+}
+
+func TestSpineCFI(t *testing.T) {
+	x := &XPointer{Fragment: 3}
+	cfi, err := x.SpineCFI()
+	if err != nil || cfi != "epubcfi(/6/6!)" {
+		t.Fatalf("cfi of DocFragment[3] = %q, %v", cfi, err)
+	}
+	_, err = (&XPointer{Path: []Step{{Name: "FictionBook"}}}).SpineCFI()
+	if !errors.Is(err, ErrInvalid) {
+		t.Fatalf("cfi without a fragment returned %v, expected ErrInvalid", err)
+	}
+}
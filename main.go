@@ -1,107 +1,362 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"hash/fnv"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ficoos/kokosync/kosync"
+	"github.com/ficoos/kokosync/mqtt"
+	"github.com/ficoos/kokosync/realip"
+	"github.com/ficoos/kokosync/reqid"
+	"github.com/ficoos/kokosync/store"
+	"github.com/ficoos/kokosync/webhook"
 )
 
 type BridgeImpl struct {
 	upstream *url.URL
-	dal      *DAL
+	dal      store.ProgressStore
+	events   *EventHub
+	// webhooks is nil when no webhook is configured
+	webhooks *webhook.Dispatcher
+	// webhookLocks serialize updates of a document by a user so webhooks
+	// see every change once, see lockProgress
+	webhookLocks [64]sync.Mutex
+	// mqtt is nil when no broker is configured
+	mqtt  *mqtt.Publisher
+	users UserNormalization
 }
 
-func NewStore(upstream *url.URL, database string) (*BridgeImpl, error) {
-	dal, err := NewDAL(database)
+func NewStore(upstream *url.URL, database string, opts store.Options) (*BridgeImpl, error) {
+	dal, err := store.Open(database, opts)
 	if err != nil {
 		return nil, fmt.Errorf("open database: %s", err)
 	}
 
-	return &BridgeImpl{upstream: upstream, dal: dal}, nil
+	return &BridgeImpl{upstream: upstream, dal: dal, events: NewEventHub()}, nil
 }
 
-// Authorize implements kosync.Server.
-func (s *BridgeImpl) Authorize(auth *kosync.Auth) error {
-	log.Printf("authorize: auth=%s", auth.Key)
+func (s *BridgeImpl) upstreamClient(auth *kosync.Auth) *kosync.Client {
 	us := kosync.NewClient(s.upstream, auth.User, auth.Key)
-	return us.Authorize()
+	us.SetObserver(observeUpstream)
+	return us
+}
+
+// Authorize implements kosync.Server.
+func (s *BridgeImpl) Authorize(ctx context.Context, auth *kosync.Auth) error {
+	slog.DebugContext(ctx, "authorize", "auth", auth)
+	_, _, err := s.authorize(ctx, auth)
+	return err
 }
 
 // GetProgress implements kosync.Store.
-func (s *BridgeImpl) GetProgress(auth *kosync.Auth, documentHash string) (*kosync.Progress, error) {
-	log.Printf("get progress: auth=%s, document-hash=%s", auth, documentHash)
-	us := kosync.NewClient(s.upstream, auth.User, auth.Key)
-	err := us.Authorize()
+func (s *BridgeImpl) GetProgress(ctx context.Context, auth *kosync.Auth, documentHash string) (*kosync.Progress, error) {
+	slog.DebugContext(ctx, "get progress", "auth", auth, "document", documentHash)
+	user, _, err := s.authorize(ctx, auth)
 	if err != nil {
-		return nil, fmt.Errorf("authorize: %s", err)
+		return nil, fmt.Errorf("authorize: %w", err)
 	}
 
-	p, err := s.dal.GetProgress(documentHash)
+	document, err := s.canonicalDocument(ctx, documentHash)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	p, err := s.dal.GetProgress(ctx, user, document)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
 			return nil, kosync.ErrDocNotFound
 		}
-		return nil, fmt.Errorf("get progress from db [document=%s]: %s", documentHash, err)
+		return nil, fmt.Errorf("get progress from db [document=%s]: %s", document, err)
 	}
 
+	// the device knows the document by the hash it asked for
+	p.Document = documentHash
 	return p, nil
 }
 
 // UpdateProgress implements kosync.Store.
-func (s *BridgeImpl) UpdateProgress(auth *kosync.Auth, progress *kosync.Progress) (*kosync.UpdateProgressResult, error) {
-	log.Printf("update progress: auth=%s, progress=%s", auth, progress)
-	us := kosync.NewClient(s.upstream, auth.User, auth.Key)
-	err := us.Authorize()
+func (s *BridgeImpl) UpdateProgress(ctx context.Context, auth *kosync.Auth, progress *kosync.Progress) (*kosync.UpdateProgressResult, error) {
+	slog.DebugContext(ctx, "update progress", "auth", auth, "progress", progress)
+	user, us, err := s.authorize(ctx, auth)
 	if err != nil {
-		return nil, fmt.Errorf("authorize: %s", err)
+		return nil, fmt.Errorf("authorize: %w", err)
 	}
 
-	err = s.dal.UpdateProgress(progress)
+	err = s.checkDevice(ctx, user, progress.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+	// progress is saved, and published, under the canonical document
+	requested := progress.Document
+	progress.Document, err = s.canonicalDocument(ctx, requested)
 	if err != nil {
-		return nil, fmt.Errorf("save progres to db [document=%s]: %s", progress.Document, err)
+		return nil, err
 	}
-	_, err = us.UpdateProgress(progress)
+
+	err = s.saveProgress(ctx, user, progress)
 	if err != nil {
-		log.Printf("warning: update upstream: %s", err)
+		return nil, err
+	}
+	s.seenDevice(ctx, user, progress)
+	s.events.Publish(&store.ProgressRecord{User: user, Progress: *progress})
+	if s.mqtt != nil {
+		s.mqtt.PublishProgress(user, progress)
+	}
+	// Devices using a sync token don't have a Komga key to sync upstream
+	// with
+	if us != nil {
+		// The timestamp is ours, upstream keeps its own
+		upstreamProgress := *progress
+		upstreamProgress.Document = requested
+		upstreamProgress.Timestamp = 0
+		_, err = us.UpdateProgress(ctx, &upstreamProgress)
+		if err != nil {
+			slog.WarnContext(ctx, "update upstream failed", "document", requested, "error", err)
+		}
 	}
 
 	return &kosync.UpdateProgressResult{
-		Document:  progress.Document,
-		Timestamp: time.Now().Unix(),
+		Document:  requested,
+		Timestamp: progress.Timestamp,
 	}, nil
 }
 
 var _ kosync.Server = &BridgeImpl{}
 
+// saveProgress saves progress for user as of now and tells the webhooks
+// what changed.
+func (s *BridgeImpl) saveProgress(ctx context.Context, user string, progress *kosync.Progress) error {
+	if s.webhooks == nil {
+		progress.Timestamp = time.Now().Unix()
+		err := s.dal.UpdateProgress(ctx, user, progress)
+		if err != nil {
+			return fmt.Errorf("save progres to db [document=%s]: %s", progress.Document, err)
+		}
+		return nil
+	}
+
+	defer s.lockProgress(user, progress.Document)()
+	previous, err := s.dal.GetProgress(ctx, user, progress.Document)
+	if errors.Is(err, store.ErrNotFound) {
+		previous, err = nil, nil
+	}
+	if err != nil {
+		return fmt.Errorf("get progress from db [document=%s]: %s", progress.Document, err)
+	}
+	progress.Timestamp = time.Now().Unix()
+	err = s.dal.UpdateProgress(ctx, user, progress)
+	if err != nil {
+		return fmt.Errorf("save progres to db [document=%s]: %s", progress.Document, err)
+	}
+	s.webhooks.ProgressChanged(user, previous, progress)
+	return nil
+}
+
+// lockProgress returns a function releasing the lock on the progress of
+// document by user. Without it two updates could read the same previous
+// progress and both report the document started or finished. Locks are
+// striped, unrelated updates rarely wait on each other.
+func (s *BridgeImpl) lockProgress(user string, document string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(user))
+	h.Write([]byte{0})
+	h.Write([]byte(document))
+	mu := &s.webhookLocks[h.Sum32()%uint32(len(s.webhookLocks))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
 func main() {
 	conf, err := ConfigFromEnvironment()
 	if err != nil {
-		log.Fatalf("load config from environemnt: %s", err)
+		fatal("load config from environment", err)
 	}
 
-	srv, err := NewStore(conf.UpstreamURL, conf.DBPath)
+	logger, err := NewLogger(os.Stderr, conf.LogFormat, conf.LogLevel)
 	if err != nil {
-		log.Fatalf("initialize server: %s", err)
+		fatal("initialize logging", err)
 	}
+	slog.SetDefault(logger)
 
-	l, err := net.Listen("tcp4", conf.ListenAddress)
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] != "serve" {
+		err = runCommand(conf, args)
+		if err != nil {
+			fatal(args[0], err)
+		}
+		return
+	}
+
+	runServer(conf, logger)
+}
+
+func runServer(conf *Config, logger *slog.Logger) {
+	store.SetObserver(observeQuery)
+	srv, err := NewStore(conf.UpstreamURL, conf.DBPath, conf.DBOptions)
 	if err != nil {
-		log.Fatalf("bind address: %s", err)
+		fatal("initialize server", err)
 	}
+	srv.users = conf.Users
 
+	if conf.LegacyUser != "" {
+		claimed, err := srv.dal.ClaimLegacyProgress(context.Background(), conf.LegacyUser)
+		if err != nil {
+			fatal("claim legacy progress", err)
+		}
+		if claimed > 0 {
+			slog.Info("claimed legacy progress", "user", conf.LegacyUser, "documents", claimed)
+		}
+	} else {
+		warnLegacyProgress(srv.dal)
+	}
+
+	if len(conf.Webhooks.URLs) > 0 {
+		srv.webhooks = webhook.NewDispatcher(conf.Webhooks)
+		srv.webhooks.SetObserver(observeWebhook)
+	}
+
+	if conf.MQTT.Broker != "" {
+		srv.mqtt, err = mqtt.NewPublisher(conf.MQTT)
+		if err != nil {
+			fatal("initialize mqtt", err)
+		}
+		srv.mqtt.SetObserver(observeMQTT)
+		metricsRegistry.NewGaugeFunc(
+			"kokosync_mqtt_connected",
+			"Whether kokosync is connected to the MQTT broker.",
+			func() float64 {
+				if srv.mqtt.Connected() {
+					return 1
+				}
+				return 0
+			},
+		)
+		go srv.mqtt.Run(context.Background())
+	}
+
+	if conf.Snapshots.Dir != "" {
+		b, ok := srv.dal.(store.Backuper)
+		if !ok {
+			fatal("schedule snapshots", errors.New("snapshots are only supported with SQLite"))
+		}
+		go runSnapshots(context.Background(), b, conf.Snapshots)
+	}
+
+	resolver, err := realip.NewResolver(conf.TrustedProxies)
+	if err != nil {
+		fatal("initialize trusted proxies", err)
+	}
+	if !resolver.TrustsUnix() {
+		for _, addr := range conf.ListenAddresses {
+			if network, _ := splitListenAddress(addr); network == "unix" {
+				slog.Warn("clients on unix sockets can't be told apart and are only rate limited per user, set "+EnvPrefix+"TRUSTED_PROXIES=unix when a reverse proxy connects over it", "address", addr)
+			}
+		}
+	}
+
+	if len(conf.AdminListenAddresses) > 0 && conf.AdminToken == "" {
+		fatal("initialize admin api", errors.New("an admin listen address requires an admin token"))
+	}
+	// Both are bound at once so they can share the sockets systemd passed
+	sets, err := Listen([][]string{conf.ListenAddresses, conf.AdminListenAddresses}, conf.UnixSocketOptions)
+	if err != nil {
+		fatal("bind address", err)
+	}
+	listeners, adminListeners := sets[0], sets[1]
+
+	limiter := NewRateLimiter(conf.RateLimit, conf.Users)
+	kosyncHandler := kosync.NewServer(srv,
+		kosync.WithMaxBodySize(conf.MaxBodySize),
+		kosync.WithRejectUnknownFields(conf.RejectUnknownFields),
+	)
 	mux := http.NewServeMux()
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
-	mux.Handle(conf.ProxyPrefix, http.StripPrefix(strings.TrimSuffix(conf.ProxyPrefix, "/"), kosync.NewServer(srv)))
+	var readyUpstream *url.URL
+	if conf.ReadyCheckUpstream {
+		readyUpstream = conf.UpstreamURL
+	}
+	readiness := NewReadiness(srv.dal, readyUpstream, conf.ReadyUpstreamTTL)
+	// healthz predates the split and is kept for existing deployments
+	mux.HandleFunc("/healthz", livenessHandler)
+	mux.HandleFunc("/livez", livenessHandler)
+	mux.Handle("/readyz", readiness)
+	mux.Handle("/metrics", metricsRegistry.Handler())
+	// event streams are long lived, keep them out of the request metrics
+	mux.Handle("GET "+conf.ProxyPrefix+"syncs/events", limiter.Middleware(kosyncEventsHandler(srv)))
+	mux.Handle("GET "+conf.ProxyPrefix+"syncs/progress/{document}/devices", limiter.Middleware(instrumentHandler(kosyncDeviceProgressHandler(srv))))
+	metricsRegistry.NewGaugeFunc(
+		"kokosync_event_streams",
+		"Number of open progress event streams.",
+		func() float64 { return float64(srv.events.Subscriptions()) },
+	)
+	mux.Handle(conf.ProxyPrefix, http.StripPrefix(strings.TrimSuffix(conf.ProxyPrefix, "/"), limiter.Middleware(instrumentHandler(kosyncHandler))))
+
+	if conf.WebUI {
+		ui := NewWebUI(srv, limiter, conf.SessionSecret, conf.SessionTTL, conf.ProxyPrefix+"ui/")
+		stripped := http.StripPrefix(strings.TrimSuffix(conf.ProxyPrefix, "/"), ui)
+		mux.Handle(conf.ProxyPrefix+"ui", stripped)
+		mux.Handle(conf.ProxyPrefix+"ui/", stripped)
+	}
 
-	http.Serve(l, mux)
+	var adminHandler http.Handler
+	if conf.AdminToken != "" {
+		adminHandler = NewAdminServer(srv, conf.AdminToken)
+		if adminListeners == nil {
+			// Out in the open the token is guessed at like any password
+			mux.Handle("/admin/", limiter.Middleware(adminHandler))
+		}
+	}
+
+	errs := make(chan error, len(listeners)+len(adminListeners))
+	errorLog := slog.NewLogLogger(logger.Handler(), slog.LevelWarn)
+	serve(listeners, &http.Server{
+		Handler:  reqid.Middleware(resolver.Middleware(accessLog(mux))),
+		ErrorLog: errorLog,
+	}, errs)
+	if adminListeners != nil {
+		serve(adminListeners, &http.Server{
+			Handler:  reqid.Middleware(resolver.Middleware(accessLog(adminHandler))),
+			ErrorLog: errorLog,
+		}, errs)
+	}
+
+	fatal("serve", <-errs)
+}
+
+// warnLegacyProgress warns about progress saved before progress was per
+// user, devices get nothing for it until it is claimed.
+func warnLegacyProgress(dal store.ProgressStore) {
+	users, err := dal.ListUsers(context.Background())
+	if err != nil {
+		fatal("list users", err)
+	}
+	for _, u := range users {
+		if u.User == "" {
+			slog.Warn("progress saved before progress was per user isn't served to anyone, set "+EnvPrefix+"LEGACY_USER to the user it belongs to", "documents", u.Documents)
+		}
+	}
+}
+
+// serve starts serving on every listener in the background, errors are
+// sent to errs.
+func serve(listeners []net.Listener, srv *http.Server, errs chan<- error) {
+	for _, l := range listeners {
+		slog.Info("listening", "network", l.Addr().Network(), "address", l.Addr().String())
+		go func() {
+			errs <- srv.Serve(l)
+		}()
+	}
 }
@@ -0,0 +1,261 @@
+// Package mqtt publishes reading progress to an MQTT broker.
+//
+// It speaks just enough MQTT 3.1.1 to publish: connecting, publishing at
+// QoS 0 or 1 and keeping the connection alive.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+const (
+	packetConnect    = 1
+	packetConnack    = 2
+	packetPublish    = 3
+	packetPuback     = 4
+	packetPingreq    = 12
+	packetPingresp   = 13
+	packetDisconnect = 14
+
+	protocolLevel = 4
+
+	connectFlagCleanSession = 0x02
+	connectFlagPassword     = 0x40
+	connectFlagUsername     = 0x80
+)
+
+var connackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+type ConnectOptions struct {
+	// Broker is a mqtt:// or mqtts:// URL, the port defaults to 1883 and
+	// 8883 respectively
+	Broker    *url.URL
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+	// Timeout bounds connecting and waiting for acknowledgements
+	Timeout time.Duration
+}
+
+// Client is a connection to a broker. It is not safe for concurrent use.
+type Client struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+	id      uint16
+}
+
+// Dial connects to the broker and starts a clean session.
+func Dial(ctx context.Context, opts ConnectOptions) (*Client, error) {
+	var useTLS bool
+	port := "1883"
+	switch opts.Broker.Scheme {
+	case "mqtt", "tcp":
+	case "mqtts", "ssl", "tls":
+		useTLS = true
+		port = "8883"
+	default:
+		return nil, fmt.Errorf("unsupported broker scheme %q", opts.Broker.Scheme)
+	}
+	if opts.Broker.Port() != "" {
+		port = opts.Broker.Port()
+	}
+	addr := net.JoinHostPort(opts.Broker.Hostname(), port)
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	if useTLS {
+		d := &tls.Dialer{Config: &tls.Config{ServerName: opts.Broker.Hostname()}}
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{conn: conn, r: bufio.NewReader(conn), timeout: opts.Timeout}
+	err = c.connect(opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Client) connect(opts ConnectOptions) error {
+	flags := byte(connectFlagCleanSession)
+	if opts.Username != "" {
+		flags |= connectFlagUsername
+		if opts.Password != "" {
+			flags |= connectFlagPassword
+		}
+	}
+	var body []byte
+	body = appendString(body, "MQTT")
+	body = append(body, protocolLevel, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(opts.KeepAlive/time.Second))
+	body = appendString(body, opts.ClientID)
+	if flags&connectFlagUsername != 0 {
+		body = appendString(body, opts.Username)
+	}
+	if flags&connectFlagPassword != 0 {
+		body = appendString(body, opts.Password)
+	}
+	err := c.write(packetConnect<<4, body)
+	if err != nil {
+		return err
+	}
+
+	kind, body, err := c.read()
+	if err != nil {
+		return err
+	}
+	if kind != packetConnack || len(body) != 2 {
+		return fmt.Errorf("expected CONNACK, got packet type %d", kind)
+	}
+	if body[1] != 0 {
+		msg, ok := connackErrors[body[1]]
+		if !ok {
+			msg = fmt.Sprintf("return code %d", body[1])
+		}
+		return fmt.Errorf("connection refused: %s", msg)
+	}
+
+	return nil
+}
+
+// Publish sends payload to topic. With qos 1 it waits for the broker to
+// acknowledge the message.
+func (c *Client) Publish(topic string, payload []byte, qos byte, retain bool) error {
+	header := byte(packetPublish<<4) | qos<<1
+	if retain {
+		header |= 1
+	}
+	var body []byte
+	body = appendString(body, topic)
+	var id uint16
+	if qos > 0 {
+		// 0 isn't a valid packet identifier
+		c.id = c.id%0xffff + 1
+		id = c.id
+		body = binary.BigEndian.AppendUint16(body, id)
+	}
+	body = append(body, payload...)
+	err := c.write(header, body)
+	if err != nil || qos == 0 {
+		return err
+	}
+
+	for {
+		kind, body, err := c.read()
+		if err != nil {
+			return err
+		}
+		if kind == packetPuback && len(body) == 2 && binary.BigEndian.Uint16(body) == id {
+			return nil
+		}
+	}
+}
+
+// Ping checks the connection is alive and tells the broker so.
+func (c *Client) Ping() error {
+	err := c.write(packetPingreq<<4, nil)
+	if err != nil {
+		return err
+	}
+	for {
+		kind, _, err := c.read()
+		if err != nil {
+			return err
+		}
+		if kind == packetPingresp {
+			return nil
+		}
+	}
+}
+
+// Close disconnects cleanly from the broker.
+func (c *Client) Close() error {
+	c.write(packetDisconnect<<4, nil)
+	return c.conn.Close()
+}
+
+func (c *Client) write(header byte, body []byte) error {
+	packet := []byte{header}
+	packet = appendLength(packet, len(body))
+	packet = append(packet, body...)
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+// read returns the type and the body of the next packet.
+func (c *Client) read() (byte, []byte, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	header, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := 0
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed packet length")
+		}
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(c.r, body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return header >> 4, body, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// appendLength appends the variable length encoding of n.
+func appendLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
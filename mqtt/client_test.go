@@ -0,0 +1,351 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// packet is an MQTT control packet as the stand-in broker received it.
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// broker is a local stand-in for an MQTT broker. It acknowledges
+// connections with connackCode and QoS 1 publishes unless drop says to
+// close the connection instead.
+type broker struct {
+	t           *testing.T
+	ln          net.Listener
+	connackCode byte
+	// drop is called for every PUBLISH, the connection is closed without
+	// acknowledging when it returns true
+	drop func(n int) bool
+
+	mu        sync.Mutex
+	packets   []packet
+	publishes int
+	conns     int
+	received  chan packet
+}
+
+func newBroker(t *testing.T) *broker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	b := &broker{t: t, ln: ln, received: make(chan packet, 100)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *broker) url() *url.URL {
+	return &url.URL{Scheme: "mqtt", Host: b.ln.Addr().String()}
+}
+
+func (b *broker) serve(conn net.Conn) {
+	defer conn.Close()
+	b.mu.Lock()
+	b.conns++
+	b.mu.Unlock()
+	r := bufio.NewReader(conn)
+	for {
+		p, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.packets = append(b.packets, p)
+		drop := false
+		if p.kind == packetPublish {
+			b.publishes++
+			drop = b.drop != nil && b.drop(b.publishes)
+		}
+		b.mu.Unlock()
+		b.received <- p
+
+		switch {
+		case drop:
+			return
+		case p.kind == packetConnect:
+			conn.Write([]byte{packetConnack << 4, 2, 0, b.connackCode})
+		case p.kind == packetPublish && p.flags&0x06 == 0x02:
+			topicLength := int(binary.BigEndian.Uint16(p.body))
+			id := p.body[2+topicLength : 4+topicLength]
+			conn.Write([]byte{packetPuback << 4, 2, id[0], id[1]})
+		case p.kind == packetPingreq:
+			conn.Write([]byte{packetPingresp << 4, 0})
+		case p.kind == packetDisconnect:
+			return
+		}
+	}
+}
+
+// next returns the next packet the broker received.
+func (b *broker) next() packet {
+	b.t.Helper()
+	select {
+	case p := <-b.received:
+		return p
+	case <-time.After(5 * time.Second):
+		b.t.Fatal("timed out waiting for a packet")
+		return packet{}
+	}
+}
+
+// readPacket decodes a packet independently of Client.read.
+func readPacket(r *bufio.Reader) (packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	length, multiplier := 0, 1
+	for {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return packet{}, err
+		}
+		length += int(digit&127) * multiplier
+		multiplier *= 128
+		if digit&128 == 0 {
+			break
+		}
+		if multiplier > 128*128*128 {
+			return packet{}, fmt.Errorf("malformed remaining length")
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return packet{kind: header >> 4, flags: header & 0x0f, body: body}, err
+}
+
+// decodeString returns the length prefixed string at the start of b and
+// the rest of b.
+func decodeString(t *testing.T, b []byte) (string, []byte) {
+	t.Helper()
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+		t.Fatalf("truncated string in %x", b)
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	return string(b[2 : 2+n]), b[2+n:]
+}
+
+func dial(t *testing.T, b *broker, opts ConnectOptions) *Client {
+	t.Helper()
+	opts.Broker = b.url()
+	if opts.Timeout == 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	c, err := Dial(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestConnect(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		flags    byte
+	}{
+		{"anonymous", "", "", connectFlagCleanSession},
+		{"username", "kokosync", "", connectFlagCleanSession | connectFlagUsername},
+		{"password", "kokosync", "s3cret", connectFlagCleanSession | connectFlagUsername | connectFlagPassword},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBroker(t)
+			dial(t, b, ConnectOptions{ClientID: "kokosync-1", Username: tt.username, Password: tt.password, KeepAlive: 90 * time.Second})
+
+			p := b.next()
+			if p.kind != packetConnect || p.flags != 0 {
+				t.Fatalf("first packet is type %d flags %d, expected CONNECT", p.kind, p.flags)
+			}
+			protocol, rest := decodeString(t, p.body)
+			if protocol != "MQTT" || rest[0] != protocolLevel {
+				t.Fatalf("protocol %q level %d", protocol, rest[0])
+			}
+			if rest[1] != tt.flags {
+				t.Fatalf("connect flags are %08b, expected %08b", rest[1], tt.flags)
+			}
+			if keepAlive := binary.BigEndian.Uint16(rest[2:]); keepAlive != 90 {
+				t.Fatalf("keep alive is %d, expected 90", keepAlive)
+			}
+			clientID, rest := decodeString(t, rest[4:])
+			if clientID != "kokosync-1" {
+				t.Fatalf("client id is %q", clientID)
+			}
+			var username, password string
+			if tt.flags&connectFlagUsername != 0 {
+				username, rest = decodeString(t, rest)
+			}
+			if tt.flags&connectFlagPassword != 0 {
+				password, rest = decodeString(t, rest)
+			}
+			if username != tt.username || password != tt.password || len(rest) != 0 {
+				t.Fatalf("username %q password %q and %d trailing bytes", username, password, len(rest))
+			}
+		})
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	b := newBroker(t)
+	b.connackCode = 4
+	_, err := Dial(context.Background(), ConnectOptions{Broker: b.url(), ClientID: "kokosync", Timeout: 5 * time.Second})
+	if err == nil || !strings.Contains(err.Error(), "bad user name or password") {
+		t.Fatalf("dial returned %v, expected a refused connection", err)
+	}
+}
+
+func TestUnsupportedScheme(t *testing.T) {
+	_, err := Dial(context.Background(), ConnectOptions{Broker: &url.URL{Scheme: "ws", Host: "localhost"}, Timeout: time.Second})
+	if err == nil {
+		t.Fatal("dial accepted a ws:// broker")
+	}
+}
+
+func TestAppendLength(t *testing.T) {
+	tests := []struct {
+		n    int
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+		{268435455, []byte{0xff, 0xff, 0xff, 0x7f}},
+	}
+	for _, tt := range tests {
+		if got := appendLength(nil, tt.n); !bytes.Equal(got, tt.want) {
+			t.Errorf("length %d encodes as %x, expected %x", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		qos     byte
+		retain  bool
+		flags   byte
+		lengths int
+	}{
+		{"qos 0", 10, 0, false, 0x00, 1},
+		{"retained", 10, 0, true, 0x01, 1},
+		{"qos 1", 10, 1, false, 0x02, 1},
+		{"qos 1 retained", 10, 1, true, 0x03, 1},
+		{"two length bytes", 200, 1, true, 0x03, 2},
+		{"three length bytes", 20000, 1, false, 0x02, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBroker(t)
+			c := dial(t, b, ConnectOptions{ClientID: "kokosync"})
+			b.next()
+
+			payload := bytes.Repeat([]byte("x"), tt.size)
+			err := c.Publish("kokosync/alice/doc", payload, tt.qos, tt.retain)
+			if err != nil {
+				t.Fatalf("publish: %s", err)
+			}
+
+			p := b.next()
+			if p.kind != packetPublish || p.flags != tt.flags {
+				t.Fatalf("packet type %d flags %04b, expected PUBLISH with %04b", p.kind, p.flags, tt.flags)
+			}
+			if n := len(appendLength(nil, len(p.body))); n != tt.lengths {
+				t.Fatalf("remaining length %d takes %d bytes, expected %d", len(p.body), n, tt.lengths)
+			}
+			topic, rest := decodeString(t, p.body)
+			if topic != "kokosync/alice/doc" {
+				t.Fatalf("topic is %q", topic)
+			}
+			if tt.qos > 0 {
+				if id := binary.BigEndian.Uint16(rest); id != 1 {
+					t.Fatalf("packet id is %d, expected 1", id)
+				}
+				rest = rest[2:]
+			}
+			if !bytes.Equal(rest, payload) {
+				t.Fatalf("payload of %d bytes, expected %d", len(rest), len(payload))
+			}
+		})
+	}
+}
+
+func TestPacketIDs(t *testing.T) {
+	b := newBroker(t)
+	c := dial(t, b, ConnectOptions{ClientID: "kokosync"})
+	b.next()
+
+	var ids []uint16
+	for i := range 3 {
+		if i == 2 {
+			// the identifier after 65535 wraps around to 1, not 0
+			c.id = 0xffff
+		}
+		err := c.Publish("t", []byte("p"), 1, false)
+		if err != nil {
+			t.Fatalf("publish: %s", err)
+		}
+		p := b.next()
+		_, rest := decodeString(t, p.body)
+		ids = append(ids, binary.BigEndian.Uint16(rest))
+	}
+	if ids[0] != 1 || ids[1] != 2 || ids[2] != 1 {
+		t.Fatalf("packet ids are %v, expected [1 2 1]", ids)
+	}
+}
+
+func TestPing(t *testing.T) {
+	b := newBroker(t)
+	c := dial(t, b, ConnectOptions{ClientID: "kokosync"})
+	b.next()
+
+	err := c.Ping()
+	if err != nil {
+		t.Fatalf("ping: %s", err)
+	}
+	if p := b.next(); p.kind != packetPingreq {
+		t.Fatalf("sent packet type %d, expected PINGREQ", p.kind)
+	}
+}
+
+func TestPublishWithoutAck(t *testing.T) {
+	b := newBroker(t)
+	b.drop = func(int) bool { return true }
+	c := dial(t, b, ConnectOptions{ClientID: "kokosync"})
+
+	err := c.Publish("t", []byte("p"), 1, false)
+	if err == nil {
+		t.Fatal("publish succeeded on a dropped connection")
+	}
+}
@@ -0,0 +1,278 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ficoos/kokosync/kosync"
+)
+
+// DefaultTopic is the topic template used when none is configured.
+const DefaultTopic = "kokosync/{user}/{document}"
+
+const (
+	// maxPending bounds the topics waiting to be published, updates to
+	// other topics beyond it are dropped
+	maxPending = 1024
+	maxBackoff = time.Minute
+)
+
+var topicPlaceholder = regexp.MustCompile(`\{[^}]*\}`)
+
+// topicFields are the placeholders a topic template can use.
+var topicFields = map[string]func(user string, p *kosync.Progress) string{
+	"{user}":      func(user string, p *kosync.Progress) string { return user },
+	"{document}":  func(user string, p *kosync.Progress) string { return p.Document },
+	"{device}":    func(user string, p *kosync.Progress) string { return p.Device },
+	"{device_id}": func(user string, p *kosync.Progress) string { return p.DeviceID },
+}
+
+// topicEscaper keeps values from adding topic levels or wildcards.
+var topicEscaper = strings.NewReplacer("/", "_", "+", "_", "#", "_", "\x00", "_")
+
+type Config struct {
+	// Broker is the broker URL, publishing is disabled when empty
+	Broker   string
+	Username string
+	Password string
+	ClientID string
+	// Topic is the topic template, see DefaultTopic
+	Topic     string
+	QoS       byte
+	Retain    bool
+	KeepAlive time.Duration
+	Timeout   time.Duration
+}
+
+// Message is the payload published for a progress update.
+type Message struct {
+	User string `json:"user"`
+	kosync.Progress
+}
+
+// Observer is notified about the outcome of every publish.
+type Observer func(result string)
+
+// Publisher publishes progress updates in the background. Only the latest
+// update of a topic is kept while the broker is unreachable since every
+// message replaces the retained one anyway.
+type Publisher struct {
+	conf     Config
+	broker   *url.URL
+	observer Observer
+
+	mu      sync.Mutex
+	pending map[string][]byte
+	// order is the order topics became pending in
+	order     []string
+	wake      chan struct{}
+	connected atomic.Bool
+}
+
+// NewPublisher checks conf and returns a publisher, nothing is published
+// until Run is called.
+func NewPublisher(conf Config) (*Publisher, error) {
+	broker, err := url.Parse(conf.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("parse broker url: %s", err)
+	}
+	if broker.Hostname() == "" {
+		return nil, fmt.Errorf("broker url %q has no host", conf.Broker)
+	}
+	if broker.User != nil {
+		if conf.Username == "" {
+			conf.Username = broker.User.Username()
+		}
+		if password, ok := broker.User.Password(); ok && conf.Password == "" {
+			conf.Password = password
+		}
+	}
+	if conf.Topic == "" {
+		conf.Topic = DefaultTopic
+	}
+	err = checkTopic(conf.Topic)
+	if err != nil {
+		return nil, err
+	}
+	if conf.QoS > 1 {
+		return nil, fmt.Errorf("unsupported qos %d, only 0 and 1 are supported", conf.QoS)
+	}
+
+	return &Publisher{
+		conf:    conf,
+		broker:  broker,
+		pending: map[string][]byte{},
+		wake:    make(chan struct{}, 1),
+	}, nil
+}
+
+func checkTopic(template string) error {
+	if strings.ContainsAny(template, "+#") {
+		return fmt.Errorf("topic %q contains wildcards", template)
+	}
+	for _, placeholder := range topicPlaceholder.FindAllString(template, -1) {
+		if _, ok := topicFields[placeholder]; !ok {
+			return fmt.Errorf("unknown placeholder %s in topic %q", placeholder, template)
+		}
+	}
+
+	return nil
+}
+
+// SetObserver sets a function to be called after every publish.
+func (p *Publisher) SetObserver(observer Observer) {
+	p.observer = observer
+}
+
+// Connected reports whether there is a connection to the broker.
+func (p *Publisher) Connected() bool {
+	return p.connected.Load()
+}
+
+// Topic returns the topic progress of user is published to.
+func (p *Publisher) Topic(user string, progress *kosync.Progress) string {
+	return topicPlaceholder.ReplaceAllStringFunc(p.conf.Topic, func(placeholder string) string {
+		return topicEscaper.Replace(topicFields[placeholder](user, progress))
+	})
+}
+
+// PublishProgress queues progress of user for publishing without blocking.
+func (p *Publisher) PublishProgress(user string, progress *kosync.Progress) {
+	topic := p.Topic(user, progress)
+	payload, err := json.Marshal(&Message{User: user, Progress: *progress})
+	if err != nil {
+		slog.Error("encode mqtt message", "topic", topic, "error", err)
+		return
+	}
+
+	p.mu.Lock()
+	if _, ok := p.pending[topic]; !ok {
+		if len(p.order) >= maxPending {
+			p.mu.Unlock()
+			slog.Warn("mqtt queue full, dropping update", "topic", topic)
+			p.observe("dropped")
+			return
+		}
+		p.order = append(p.order, topic)
+	}
+	p.pending[topic] = payload
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the oldest pending topic and its latest payload.
+func (p *Publisher) next() (string, []byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.order) == 0 {
+		return "", nil, false
+	}
+	topic := p.order[0]
+	p.order = p.order[1:]
+	payload := p.pending[topic]
+	delete(p.pending, topic)
+	return topic, payload, true
+}
+
+// requeue puts back a payload that failed to publish unless a newer one
+// for the same topic arrived meanwhile.
+func (p *Publisher) requeue(topic string, payload []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.pending[topic]; ok {
+		return
+	}
+	p.order = append([]string{topic}, p.order...)
+	p.pending[topic] = payload
+}
+
+// Run publishes queued updates until ctx is done, reconnecting with
+// exponential backoff whenever the connection fails.
+func (p *Publisher) Run(ctx context.Context) {
+	var client *Client
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+		p.connected.Store(false)
+	}()
+	disconnect := func(err error) {
+		slog.Warn("mqtt connection lost", "broker", p.broker.Redacted(), "error", err)
+		client.Close()
+		client = nil
+		p.connected.Store(false)
+	}
+
+	keepAlive := time.NewTicker(p.conf.KeepAlive / 2)
+	defer keepAlive.Stop()
+	failures := 0
+	for {
+		if client == nil {
+			var err error
+			client, err = Dial(ctx, ConnectOptions{
+				Broker:    p.broker,
+				ClientID:  p.conf.ClientID,
+				Username:  p.conf.Username,
+				Password:  p.conf.Password,
+				KeepAlive: p.conf.KeepAlive,
+				Timeout:   p.conf.Timeout,
+			})
+			if err != nil {
+				failures++
+				delay := min(time.Second<<min(failures-1, 6), maxBackoff)
+				slog.Warn("connect to mqtt broker", "broker", p.broker.Redacted(), "error", err, "retry_in", delay)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(delay):
+				}
+				continue
+			}
+			failures = 0
+			p.connected.Store(true)
+			slog.Info("connected to mqtt broker", "broker", p.broker.Redacted())
+		}
+
+		topic, payload, ok := p.next()
+		if ok {
+			err := client.Publish(topic, payload, p.conf.QoS, p.conf.Retain)
+			if err != nil {
+				p.requeue(topic, payload)
+				p.observe("failed")
+				disconnect(err)
+				continue
+			}
+			p.observe("ok")
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.wake:
+		case <-keepAlive.C:
+			err := client.Ping()
+			if err != nil {
+				disconnect(err)
+			}
+		}
+	}
+}
+
+func (p *Publisher) observe(result string) {
+	if p.observer != nil {
+		p.observer(result)
+	}
+}
@@ -0,0 +1,110 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ficoos/kokosync/kosync"
+)
+
+func TestTopic(t *testing.T) {
+	p, err := NewPublisher(Config{Broker: "mqtt://localhost", Topic: "books/{user}/{device}/{document}"})
+	if err != nil {
+		t.Fatalf("new publisher: %s", err)
+	}
+	topic := p.Topic("alice/x", &kosync.Progress{Document: "d+1", Device: "kobo#2"})
+	if topic != "books/alice_x/kobo_2/d_1" {
+		t.Fatalf("topic is %q", topic)
+	}
+}
+
+func TestNewPublisherErrors(t *testing.T) {
+	for _, conf := range []Config{
+		{Broker: "mqtt://"},
+		{Broker: "mqtt://localhost", Topic: "kokosync/#"},
+		{Broker: "mqtt://localhost", Topic: "kokosync/{nope}"},
+		{Broker: "mqtt://localhost", QoS: 2},
+	} {
+		_, err := NewPublisher(conf)
+		if err == nil {
+			t.Errorf("new publisher accepted %+v", conf)
+		}
+	}
+}
+
+func TestPublisherRequeue(t *testing.T) {
+	b := newBroker(t)
+	// drop the connection instead of acknowledging the first publish
+	b.drop = func(n int) bool { return n == 1 }
+	p, err := NewPublisher(Config{
+		Broker:    b.url().String(),
+		Username:  "kokosync",
+		Password:  "s3cret",
+		ClientID:  "kokosync",
+		QoS:       1,
+		Retain:    true,
+		KeepAlive: time.Minute,
+		Timeout:   5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("new publisher: %s", err)
+	}
+	results := make(chan string, 10)
+	p.SetObserver(func(result string) { results <- result })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	progress := &kosync.Progress{Document: "0123456789abcdef0123456789abcdef", Percentage: 0.5, Device: "kobo"}
+	p.PublishProgress("alice", progress)
+	for _, want := range []string{"failed", "ok"} {
+		select {
+		case got := <-results:
+			if got != want {
+				t.Fatalf("publish %s, expected %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for publish to be %s", want)
+		}
+	}
+
+	var publishes []packet
+	for len(b.received) > 0 {
+		if pkt := <-b.received; pkt.kind == packetPublish {
+			publishes = append(publishes, pkt)
+		}
+	}
+	if len(publishes) != 2 {
+		t.Fatalf("broker received %d publishes, expected 2", len(publishes))
+	}
+	for _, pkt := range publishes {
+		topic, rest := decodeString(t, pkt.body)
+		var msg Message
+		err := json.Unmarshal(rest[2:], &msg)
+		if err != nil {
+			t.Fatalf("decode message: %s", err)
+		}
+		if topic != "kokosync/alice/"+progress.Document || msg.User != "alice" || msg.Progress != *progress {
+			t.Fatalf("published %+v to %s", msg, topic)
+		}
+	}
+	b.mu.Lock()
+	conns := b.conns
+	b.mu.Unlock()
+	if conns != 2 {
+		t.Fatalf("publisher connected %d times, expected 2", conns)
+	}
+	if !p.Connected() {
+		t.Fatal("publisher isn't connected after reconnecting")
+	}
+}
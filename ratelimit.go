@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ficoos/kokosync/kosync"
+	"github.com/ficoos/kokosync/realip"
+)
+
+// sweepInterval is how often idle limiter state is dropped.
+const sweepInterval = time.Minute
+
+type RateLimitConfig struct {
+	// IPRate and UserRate are sustained requests per second, 0 disables
+	// the limit. Burst is the bucket size.
+	IPRate    float64
+	IPBurst   int
+	UserRate  float64
+	UserBurst int
+
+	// After LockoutThreshold consecutive rejected logins from the same IP,
+	// or for the same user from the same IP, further requests are refused
+	// for LockoutDuration. Lockouts aren't per user alone since anyone can
+	// send X-Auth-User.
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// wait refills the bucket and returns how long until it holds a token, 0
+// when it does.
+func (b *tokenBucket) wait(now time.Time, rate float64, burst int) time.Duration {
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		return 0
+	}
+
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+func (b *tokenBucket) full(now time.Time, rate float64, burst int) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst)
+}
+
+type failureState struct {
+	count       int
+	lockedUntil time.Time
+	last        time.Time
+}
+
+type limiterKey struct {
+	kind  string
+	value string
+}
+
+// RateLimiter throttles requests per client IP and per X-Auth-User and
+// locks out clients that keep failing to log in. Login attempts are
+// forwarded to Komga so without it kokosync is an unthrottled password
+// guessing proxy.
+type RateLimiter struct {
+	conf RateLimitConfig
+	// users normalizes X-Auth-User so every spelling of a login shares
+	// its limits
+	users UserNormalization
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[limiterKey]*tokenBucket
+	failures  map[limiterKey]*failureState
+	lastSweep time.Time
+}
+
+func NewRateLimiter(conf RateLimitConfig, users UserNormalization) *RateLimiter {
+	return &RateLimiter{
+		conf:     conf,
+		users:    users,
+		now:      time.Now,
+		buckets:  map[limiterKey]*tokenBucket{},
+		failures: map[limiterKey]*failureState{},
+	}
+}
+
+func (l *RateLimiter) rate(kind string) (float64, int) {
+	switch kind {
+	case "ip":
+		return l.conf.IPRate, l.conf.IPBurst
+	case "user":
+		return l.conf.UserRate, l.conf.UserBurst
+	}
+	// login keys only count failures
+	return 0, 0
+}
+
+// allow checks all keys and returns the reason and wait time if the
+// request should be refused.
+func (l *RateLimiter) allow(keys []limiterKey) (string, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	for _, key := range keys {
+		f, ok := l.failures[key]
+		if ok && now.Before(f.lockedUntil) {
+			return "lockout", f.lockedUntil.Sub(now)
+		}
+	}
+
+	// Tokens are only taken once every bucket has one, a request refused
+	// for the user doesn't use up the IP's
+	var buckets []*tokenBucket
+	for _, key := range keys {
+		rate, burst := l.rate(key.kind)
+		if rate <= 0 {
+			continue
+		}
+		b, ok := l.buckets[key]
+		if !ok {
+			b = &tokenBucket{tokens: float64(burst), last: now}
+			l.buckets[key] = b
+		}
+		if wait := b.wait(now, rate, burst); wait > 0 {
+			return "rate_" + key.kind, wait
+		}
+		buckets = append(buckets, b)
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+
+	return "", 0
+}
+
+// loginOutcome is where credential checks report to the rate limiter, only
+// rejected credentials count towards lockouts, not e.g. blocked devices.
+type loginOutcome struct {
+	checked  bool
+	rejected bool
+}
+
+type loginOutcomeKey struct{}
+
+// recordLogin tells the rate limiter handling the request of ctx the
+// outcome of a credential check. Errors other than kosync.ErrUnauthorized,
+// like Komga being down, say nothing about the credentials.
+func recordLogin(ctx context.Context, err error) {
+	o, ok := ctx.Value(loginOutcomeKey{}).(*loginOutcome)
+	if !ok {
+		return
+	}
+	switch {
+	case err == nil:
+		o.checked, o.rejected = true, false
+	case errors.Is(err, kosync.ErrUnauthorized):
+		o.checked, o.rejected = true, true
+	}
+}
+
+func (l *RateLimiter) recordResult(keys []limiterKey, outcome *loginOutcome) {
+	if !outcome.checked {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	for _, key := range keys {
+		if !outcome.rejected {
+			delete(l.failures, key)
+			continue
+		}
+
+		f, ok := l.failures[key]
+		if !ok {
+			f = &failureState{}
+			l.failures[key] = f
+		}
+		f.count++
+		f.last = now
+		if f.count >= l.conf.LockoutThreshold {
+			f.count = 0
+			f.lockedUntil = now.Add(l.conf.LockoutDuration)
+			slog.Warn("locking out after repeated login failures", key.kind, key.value, "until", f.lockedUntil)
+		}
+	}
+}
+
+// sweep drops state that no longer affects decisions so the maps don't
+// grow without bound, must be called with l.mu held.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		rate, burst := l.rate(key.kind)
+		if b.full(now, rate, burst) {
+			delete(l.buckets, key)
+		}
+	}
+	for key, f := range l.failures {
+		if now.After(f.lockedUntil) && now.Sub(f.last) > l.conf.LockoutDuration {
+			delete(l.failures, key)
+		}
+	}
+}
+
+// clientIP returns the address of the client or "" when it is unknown,
+// e.g. for unix socket peers that aren't trusted proxies.
+func clientIP(r *http.Request) string {
+	if info := realip.FromContext(r.Context()); info != nil {
+		if !info.IP.IsValid() {
+			return ""
+		}
+		return info.IP.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	a, err := netip.ParseAddr(host)
+	if err != nil {
+		return ""
+	}
+	return a.Unmap().String()
+}
+
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Failures are counted per IP and per user and IP. Clients with an
+		// unknown IP can't be told apart, sharing one IP key would let one
+		// of them lock out all, so they are only limited per user.
+		var keys, lockoutKeys []limiterKey
+		ip := clientIP(r)
+		if ip != "" {
+			keys = append(keys, limiterKey{kind: "ip", value: ip})
+			lockoutKeys = append(lockoutKeys, limiterKey{kind: "ip", value: ip})
+		}
+		if user := l.users.Normalize(r.Header.Get("X-Auth-User")); user != "" {
+			login := limiterKey{kind: "login", value: ip + " " + user}
+			keys = append(keys, limiterKey{kind: "user", value: user}, login)
+			lockoutKeys = append(lockoutKeys, login)
+		}
+
+		reason, wait := l.allow(keys)
+		if reason != "" {
+			rateLimited.Inc(reason)
+			slog.InfoContext(r.Context(), "request throttled", "reason", reason, "ip", ip, "retry_after", wait)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"message":"too many requests"}`))
+			return
+		}
+
+		outcome := &loginOutcome{}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), loginOutcomeKey{}, outcome)))
+		l.recordResult(lockoutKeys, outcome)
+	})
+}
@@ -0,0 +1,254 @@
+// Package realip works out the address of the client that made a request
+// that may have passed through trusted reverse proxies.
+package realip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Info describes the client as seen by the outermost trusted hop.
+type Info struct {
+	// IP is invalid when the client address is unknown, e.g. for requests
+	// arriving over a unix socket without proxy headers or when a proxy
+	// reports an obfuscated or unknown client.
+	IP     netip.Addr
+	Scheme string
+	Host   string
+	// Proxied is true when the values came from proxy headers.
+	Proxied bool
+}
+
+// String returns the client IP or "unknown".
+func (i *Info) String() string {
+	if !i.IP.IsValid() {
+		return "unknown"
+	}
+	return i.IP.String()
+}
+
+type contextKey struct{}
+
+func NewContext(ctx context.Context, info *Info) context.Context {
+	return context.WithValue(ctx, contextKey{}, info)
+}
+
+// FromContext returns the client info stored by the middleware or nil.
+func FromContext(ctx context.Context) *Info {
+	info, _ := ctx.Value(contextKey{}).(*Info)
+	return info
+}
+
+type Resolver struct {
+	trusted   []netip.Prefix
+	trustUnix bool
+}
+
+// NewResolver creates a resolver that only honors proxy headers sent by
+// peers in one of the trusted networks. Entries are CIDRs or single
+// addresses, "unix" trusts peers connecting over a unix socket.
+func NewResolver(trusted []string) (*Resolver, error) {
+	res := &Resolver{}
+	for _, t := range trusted {
+		if t == "unix" {
+			res.trustUnix = true
+			continue
+		}
+		if strings.Contains(t, "/") {
+			p, err := netip.ParsePrefix(t)
+			if err != nil {
+				return nil, fmt.Errorf("parse trusted proxy %q: %s", t, err)
+			}
+			res.trusted = append(res.trusted, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(t)
+		if err != nil {
+			return nil, fmt.Errorf("parse trusted proxy %q: %s", t, err)
+		}
+		a = a.Unmap()
+		res.trusted = append(res.trusted, netip.PrefixFrom(a, a.BitLen()))
+	}
+
+	return res, nil
+}
+
+// TrustsUnix reports whether peers connecting over a unix socket are
+// trusted proxies.
+func (r *Resolver) TrustsUnix() bool {
+	return r.trustUnix
+}
+
+func (r *Resolver) isTrusted(a netip.Addr) bool {
+	a = a.Unmap()
+	for _, p := range r.trusted {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+type hop struct {
+	addr   netip.Addr
+	ok     bool
+	scheme string
+	host   string
+}
+
+// Resolve works out the client info for req. Forwarded (RFC 7239) takes
+// precedence over X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host.
+func (r *Resolver) Resolve(req *http.Request) *Info {
+	info := &Info{
+		Scheme: "http",
+		Host:   req.Host,
+	}
+	if req.TLS != nil {
+		info.Scheme = "https"
+	}
+
+	peerTrusted := false
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err == nil {
+		info.IP = peer.Unmap()
+		peerTrusted = r.isTrusted(peer)
+	} else if r.trustUnix && (req.RemoteAddr == "" || req.RemoteAddr == "@") {
+		// What net/http reports for unix socket peers
+		peerTrusted = true
+	}
+
+	if !peerTrusted {
+		return info
+	}
+
+	var hops []hop
+	if fwd := req.Header.Values("Forwarded"); len(fwd) > 0 {
+		hops = parseForwarded(fwd)
+	} else {
+		hops = parseXForwarded(req.Header)
+	}
+	if len(hops) == 0 {
+		return info
+	}
+
+	// Walk from the nearest hop outwards, the client is the first address
+	// not belonging to a trusted proxy. Anything to its left could have
+	// been forged by the client.
+	chosen := -1
+	for i := len(hops) - 1; i >= 0; i-- {
+		chosen = i
+		if !hops[i].ok || !r.isTrusted(hops[i].addr) {
+			break
+		}
+	}
+	h := hops[chosen]
+	// An obfuscated or unknown client stays unknown, the hop after it is
+	// a proxy shared by many clients
+	info.IP = netip.Addr{}
+	if h.ok {
+		info.IP = h.addr
+	}
+	if h.scheme == "http" || h.scheme == "https" {
+		info.Scheme = h.scheme
+	}
+	if h.host != "" {
+		info.Host = h.host
+	}
+	info.Proxied = true
+
+	return info
+}
+
+func parseNode(node string) (netip.Addr, bool) {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if ap, err := netip.ParseAddrPort(node); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	if a, err := netip.ParseAddr(node); err == nil {
+		return a.Unmap(), true
+	}
+
+	return netip.Addr{}, false
+}
+
+func parseForwarded(values []string) []hop {
+	var hops []hop
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			var h hop
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				value = strings.Trim(value, `"`)
+				switch strings.ToLower(key) {
+				case "for":
+					h.addr, h.ok = parseNode(value)
+				case "proto":
+					h.scheme = strings.ToLower(value)
+				case "host":
+					h.host = value
+				}
+			}
+			hops = append(hops, h)
+		}
+	}
+
+	return hops
+}
+
+func splitHeader(header http.Header, name string) []string {
+	var res []string
+	for _, v := range header.Values(name) {
+		for _, item := range strings.Split(v, ",") {
+			res = append(res, strings.TrimSpace(item))
+		}
+	}
+	return res
+}
+
+func parseXForwarded(header http.Header) []hop {
+	var hops []hop
+	for _, item := range splitHeader(header, "X-Forwarded-For") {
+		var h hop
+		h.addr, h.ok = parseNode(item)
+		hops = append(hops, h)
+	}
+	if len(hops) == 0 {
+		return nil
+	}
+
+	// Proxies rarely append to these, use what the nearest one says
+	if protos := splitHeader(header, "X-Forwarded-Proto"); len(protos) > 0 {
+		scheme := strings.ToLower(protos[len(protos)-1])
+		for i := range hops {
+			hops[i].scheme = scheme
+		}
+	}
+	if hosts := splitHeader(header, "X-Forwarded-Host"); len(hosts) > 0 {
+		for i := range hops {
+			hops[i].host = hosts[len(hosts)-1]
+		}
+	}
+
+	return hops
+}
+
+// Middleware resolves the client info and stores it in the request
+// context.
+func (r *Resolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		info := r.Resolve(req)
+		next.ServeHTTP(w, req.WithContext(NewContext(req.Context(), info)))
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ficoos/kokosync/store"
+)
+
+const (
+	snapshotPrefix = "kokosync-"
+	snapshotSuffix = ".db"
+	// Nanoseconds keep snapshots written within the same second apart,
+	// names without them from older versions still parse
+	snapshotTimeFormat = "20060102T150405.000000000Z"
+)
+
+type SnapshotConfig struct {
+	// Dir is where snapshots are written, snapshots are disabled when empty
+	Dir      string
+	Interval time.Duration
+	// Keep is how many snapshots to keep, 0 keeps all of them
+	Keep int
+}
+
+var lastSnapshot atomic.Int64
+
+func init() {
+	metricsRegistry.NewGaugeFunc(
+		"kokosync_last_snapshot_timestamp_seconds",
+		"Time of the last successful database snapshot.",
+		func() float64 { return float64(lastSnapshot.Load()) },
+	)
+}
+
+// WriteSnapshot backs b up to a new timestamped file in dir and removes
+// the oldest snapshots beyond keep.
+func WriteSnapshot(ctx context.Context, b store.Backuper, dir string, keep int) (string, error) {
+	now := time.Now().UTC()
+	path := filepath.Join(dir, snapshotPrefix+now.Format(snapshotTimeFormat)+snapshotSuffix)
+	err := b.Backup(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	lastSnapshot.Store(now.Unix())
+
+	return path, pruneSnapshots(dir, keep)
+}
+
+// pruneSnapshots removes all but the newest keep snapshots in dir, other
+// files are left alone.
+func pruneSnapshots(dir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var snapshots []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+			continue
+		}
+		_, err := time.Parse(snapshotTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix))
+		if err == nil {
+			snapshots = append(snapshots, name)
+		}
+	}
+	if len(snapshots) <= keep {
+		return nil
+	}
+
+	// the timestamps sort chronologically
+	slices.Sort(snapshots)
+	for _, name := range snapshots[:len(snapshots)-keep] {
+		err = os.Remove(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runSnapshots writes a snapshot every conf.Interval until ctx is done.
+func runSnapshots(ctx context.Context, b store.Backuper, conf SnapshotConfig) {
+	ticker := time.NewTicker(conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		path, err := WriteSnapshot(ctx, b, conf.Dir, conf.Keep)
+		if err != nil {
+			slog.Error("write database snapshot", "dir", conf.Dir, "error", err)
+			continue
+		}
+		slog.Info("wrote database snapshot", "path", path)
+	}
+}
@@ -0,0 +1,213 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Backuper is implemented by stores that can copy themselves while in use.
+type Backuper interface {
+	// Backup writes a consistent copy of the store to path.
+	Backup(ctx context.Context, path string) error
+}
+
+// sqliteStore adds online backups to the SQLite store.
+type sqliteStore struct {
+	*sqlStore
+}
+
+// Backup copies the database with SQLite's backup API, which is safe while
+// other connections write. The copy is written next to path and renamed
+// into place so path is never a partial copy.
+func (s *sqliteStore) Backup(ctx context.Context, path string) (err error) {
+	defer func(start time.Time) { observe("backup", start, err) }(time.Now())
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	dsn, err := fileDSN(tmp.Name(), "")
+	if err != nil {
+		return err
+	}
+	dst, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return err
+	}
+	err = sqliteCopy(ctx, dst, s.db)
+	if err == nil {
+		// a snapshot should be a single self contained file
+		_, err = dst.ExecContext(ctx, `PRAGMA journal_mode = DELETE`)
+	}
+	closeErr := dst.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// sqliteCopy replaces the content of dst with the content of src.
+func sqliteCopy(ctx context.Context, dst *sql.DB, src *sql.DB) error {
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	return dstConn.Raw(func(dstDriverConn any) error {
+		return srcConn.Raw(func(srcDriverConn any) error {
+			b, err := dstDriverConn.(*sqlite3.SQLiteConn).Backup("main", srcDriverConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return fmt.Errorf("start backup: %s", err)
+			}
+			_, err = b.Step(-1)
+			if err != nil {
+				b.Finish()
+				return fmt.Errorf("copy: %s", err)
+			}
+			return b.Finish()
+		})
+	})
+}
+
+// latestVersion returns the version of the last migration for d.
+func latestVersion(d *dialect) (int, error) {
+	entries, err := fs.ReadDir(migrations, path.Join("migrations", d.name))
+	if err != nil {
+		return 0, err
+	}
+	latest := 0
+	for _, entry := range entries {
+		prefix, _, _ := strings.Cut(entry.Name(), "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return 0, fmt.Errorf("bad migration name %s", entry.Name())
+		}
+		latest = max(latest, version)
+	}
+
+	return latest, nil
+}
+
+// fileDSN returns a file: URI DSN for the database at path with query as
+// its parameters. The path is escaped so names containing ? or # aren't cut
+// short, and made absolute since a relative one would be taken for the URI
+// authority.
+func fileDSN(path string, query string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(abs), RawQuery: query}
+	return u.String(), nil
+}
+
+// CheckSQLiteSnapshot makes sure the file at path is an intact kokosync
+// database this version can use and returns its schema version.
+func CheckSQLiteSnapshot(ctx context.Context, path string) (int, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	dsn, err := fileDSN(path, "mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var check string
+	err = db.QueryRowContext(ctx, `PRAGMA quick_check`).Scan(&check)
+	if err != nil {
+		return 0, fmt.Errorf("check integrity: %s", err)
+	}
+	if check != "ok" {
+		return 0, fmt.Errorf("snapshot is corrupt: %s", check)
+	}
+
+	var version int
+	err = db.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("get schema version: %s", err)
+	}
+	latest, err := latestVersion(sqliteDialect)
+	if err != nil {
+		return 0, err
+	}
+	if version == 0 {
+		return 0, errors.New("not a kokosync database")
+	}
+	if version > latest {
+		return 0, fmt.Errorf("schema version %d is newer than this kokosync supports (%d)", version, latest)
+	}
+
+	var count int
+	err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM progress`).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("read progress: %s", err)
+	}
+
+	return version, nil
+}
+
+// RestoreSQLite replaces the database at path with a checked snapshot and
+// brings its schema up to date. Other processes using the database see the
+// restored content once it is done.
+func RestoreSQLite(ctx context.Context, snapshot string, path string, opts Options) error {
+	_, err := CheckSQLiteSnapshot(ctx, snapshot)
+	if err != nil {
+		return err
+	}
+
+	dsn, err := fileDSN(snapshot, "mode=ro")
+	if err != nil {
+		return err
+	}
+	src, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	st, err := OpenSQLite(path, opts)
+	if err != nil {
+		return err
+	}
+	s := st.(*sqliteStore)
+	defer s.Close()
+
+	unlock := s.lockWrites()
+	err = sqliteCopy(ctx, s.db, src)
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	return s.migrate()
+}
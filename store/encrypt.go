@@ -0,0 +1,552 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ficoos/kokosync/kosync"
+)
+
+// sealedPrefix starts every encrypted value, it is followed by the key ID,
+// a colon and the base64 of the nonce and the ciphertext.
+const sealedPrefix = "kokosync:1:"
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Key is an encryption key and the ID stored along the values it encrypts.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// ParseKeys parses comma or white space separated keys written as
+// id:base64, e.g. 2025:ZmFrZS1rZXktZmFrZS1rZXktZmFrZS1rZXktMDE=.
+func ParseKeys(raw string) ([]Key, error) {
+	var keys []Key
+	for _, field := range strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	}) {
+		id, encoded, ok := strings.Cut(field, ":")
+		if !ok {
+			return nil, fmt.Errorf("key %q isn't written as id:base64", field)
+		}
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("decode key %s: %s", id, err)
+		}
+		keys = append(keys, Key{ID: id, Secret: secret})
+	}
+
+	return keys, nil
+}
+
+// Cipher encrypts stored values with AES-256-GCM. Documents are replaced
+// by their HMAC-SHA256 under a key of their own so they can still be looked
+// up, the document itself is kept in the encrypted value.
+type Cipher struct {
+	aeads   map[string]cipher.AEAD
+	current string
+	index   []byte
+}
+
+// NewCipher returns a cipher encrypting with the first key, the others are
+// only used to decrypt values encrypted before the key was rotated. The
+// index key hashes documents and can't be rotated.
+func NewCipher(keys []Key, index []byte) (*Cipher, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no encryption keys")
+	}
+	if len(index) < 32 {
+		return nil, errors.New("the index key must be at least 32 bytes")
+	}
+
+	c := &Cipher{aeads: map[string]cipher.AEAD{}, current: keys[0].ID, index: index}
+	for _, key := range keys {
+		if !keyIDPattern.MatchString(key.ID) {
+			return nil, fmt.Errorf("bad key id %q, use letters, digits, '.', '_' and '-'", key.ID)
+		}
+		if _, ok := c.aeads[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate key id %s", key.ID)
+		}
+		if len(key.Secret) != 32 {
+			return nil, fmt.Errorf("key %s must be 32 bytes, got %d", key.ID, len(key.Secret))
+		}
+		block, err := aes.NewCipher(key.Secret)
+		if err != nil {
+			return nil, err
+		}
+		c.aeads[key.ID], err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// indexOf returns the keyed hash document is stored under.
+func (c *Cipher) indexOf(document string) string {
+	mac := hmac.New(sha256.New, c.index)
+	mac.Write([]byte(document))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// seal encrypts plaintext with the current key, aad ties the value to
+// where it is stored.
+func (c *Cipher) seal(plaintext []byte, aad string) string {
+	aead := c.aeads[c.current]
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(aad))
+	return sealedPrefix + c.current + ":" + base64.StdEncoding.EncodeToString(sealed)
+}
+
+// aad joins what a value is stored under into the associated data it is
+// sealed with, every part is length prefixed so they can't run together.
+func aad(parts ...string) string {
+	var b strings.Builder
+	for _, part := range parts {
+		b.WriteString(strconv.Itoa(len(part)))
+		b.WriteByte(':')
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+// sealedKeyID returns the ID of the key value was sealed with, if it was
+// sealed.
+func sealedKeyID(value string) (string, bool) {
+	rest, ok := strings.CutPrefix(value, sealedPrefix)
+	if !ok {
+		return "", false
+	}
+	id, _, ok := strings.Cut(rest, ":")
+	return id, ok
+}
+
+func (c *Cipher) open(value string, aad string) ([]byte, error) {
+	id, ok := sealedKeyID(value)
+	if !ok {
+		return nil, errors.New("value isn't encrypted")
+	}
+	aead, ok := c.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("value is encrypted with unknown key %s", id)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, sealedPrefix+id+":"))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, errors.New("malformed encrypted value")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(aad))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt with key %s: %s", id, err)
+	}
+
+	return plaintext, nil
+}
+
+// sealedProgress holds the fields of a progress record that are encrypted.
+type sealedProgress struct {
+	Document   string  `json:"document"`
+	Progress   string  `json:"progress"`
+	Percentage float64 `json:"percentage"`
+}
+
+// sealProgress returns the progress of user as it is stored: the document
+// is replaced by its index and the position is encrypted. The value can
+// only be opened for the same user and document.
+func (c *Cipher) sealProgress(user string, p kosync.Progress) kosync.Progress {
+	plaintext, _ := json.Marshal(&sealedProgress{Document: p.Document, Progress: p.Progress, Percentage: p.Percentage})
+	p.Document = c.indexOf(p.Document)
+	p.Progress = c.seal(plaintext, aad(user, p.Document))
+	p.Percentage = 0
+	return p
+}
+
+func (c *Cipher) openProgress(user string, p kosync.Progress) (kosync.Progress, error) {
+	plaintext, err := c.open(p.Progress, aad(user, p.Document))
+	if err != nil {
+		return p, fmt.Errorf("progress of document %s: %s", p.Document, err)
+	}
+	var sealed sealedProgress
+	err = json.Unmarshal(plaintext, &sealed)
+	if err != nil {
+		return p, fmt.Errorf("progress of document %s: %s", p.Document, err)
+	}
+	p.Document = sealed.Document
+	p.Progress = sealed.Progress
+	p.Percentage = sealed.Percentage
+	return p, nil
+}
+
+// sealDevice encrypts the last document of d, which gives away what the
+// user reads.
+func (c *Cipher) sealDevice(d Device) Device {
+	if d.LastDocument != "" {
+		d.LastDocument = c.seal([]byte(d.LastDocument), aad(d.User, d.ID))
+	}
+	return d
+}
+
+func (c *Cipher) openDevice(d Device) (Device, error) {
+	if d.LastDocument == "" {
+		return d, nil
+	}
+	plaintext, err := c.open(d.LastDocument, aad(d.User, d.ID))
+	if err != nil {
+		return d, fmt.Errorf("last document of device %s: %s", d.ID, err)
+	}
+	d.LastDocument = string(plaintext)
+	return d, nil
+}
+
+// Reencrypt encrypts every value of s that isn't encrypted with the current
+// key of c, or decrypts every value when decrypt is set. s must be opened
+// without a cipher. It returns the number of values changed.
+func Reencrypt(ctx context.Context, s ProgressStore, c *Cipher, decrypt bool) (int, error) {
+	return s.Rewrite(ctx, Rewriter{
+		Progress: func(user string, p *kosync.Progress) error {
+			id, sealed := sealedKeyID(p.Progress)
+			if sealed && id == c.current && !decrypt {
+				return nil
+			}
+			plain := *p
+			if sealed {
+				var err error
+				plain, err = c.openProgress(user, *p)
+				if err != nil {
+					return err
+				}
+			}
+			if decrypt {
+				*p = plain
+			} else {
+				*p = c.sealProgress(user, plain)
+			}
+			return nil
+		},
+		Device: func(d *Device) error {
+			id, sealed := sealedKeyID(d.LastDocument)
+			if sealed && id == c.current && !decrypt {
+				return nil
+			}
+			plain := *d
+			if sealed {
+				var err error
+				plain, err = c.openDevice(*d)
+				if err != nil {
+					return err
+				}
+			}
+			if decrypt {
+				*d = plain
+			} else {
+				*d = c.sealDevice(plain)
+			}
+			return nil
+		},
+	})
+}
+
+// Encrypt returns a store that encrypts what it saves in s with c. Every
+// progress record, device progress record and device in s must already be
+// encrypted with one of the keys of c, Reencrypt takes care of that.
+//
+// Document aliases are stored as they are, both hashes of an alias stay
+// readable.
+func Encrypt(ctx context.Context, s ProgressStore, c *Cipher) (ProgressStore, error) {
+	readable := func(value string) bool {
+		id, ok := sealedKeyID(value)
+		_, known := c.aeads[id]
+		return ok && known
+	}
+	// Rewrite is the only way to see the device progress of every user,
+	// nothing is changed
+	unreadable := 0
+	_, err := s.Rewrite(ctx, Rewriter{
+		Progress: func(user string, p *kosync.Progress) error {
+			if !readable(p.Progress) {
+				unreadable++
+			}
+			return nil
+		},
+		Device: func(d *Device) error {
+			if d.LastDocument != "" && !readable(d.LastDocument) {
+				unreadable++
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if unreadable > 0 {
+		return nil, fmt.Errorf("%d stored values aren't encrypted with a configured key, run the reencrypt command", unreadable)
+	}
+
+	e := &encryptedStore{ProgressStore: s, cipher: c}
+	if b, ok := s.(Backuper); ok {
+		return &encryptedBackuper{encryptedStore: e, Backuper: b}, nil
+	}
+	return e, nil
+}
+
+// encryptedStore encrypts progress on the way into the store it wraps and
+// decrypts it on the way out, methods that don't deal with documents or
+// positions are passed through.
+type encryptedStore struct {
+	ProgressStore
+	cipher *Cipher
+}
+
+// encryptedBackuper keeps backups available when the wrapped store has
+// them, backups hold the encrypted values.
+type encryptedBackuper struct {
+	*encryptedStore
+	Backuper
+}
+
+func (s *encryptedStore) UpdateProgress(ctx context.Context, user string, progress *kosync.Progress) error {
+	sealed := s.cipher.sealProgress(user, *progress)
+	return s.ProgressStore.UpdateProgress(ctx, user, &sealed)
+}
+
+func (s *encryptedStore) GetProgress(ctx context.Context, user string, document string) (*kosync.Progress, error) {
+	p, err := s.ProgressStore.GetProgress(ctx, user, s.cipher.indexOf(document))
+	if err != nil {
+		return nil, err
+	}
+	opened, err := s.cipher.openProgress(user, *p)
+	if err != nil {
+		return nil, err
+	}
+	return &opened, nil
+}
+
+// openAll decrypts the progress of user in place and sorts it like
+// ListProgress.
+func (s *encryptedStore) openAll(user string, progress []*kosync.Progress) ([]*kosync.Progress, error) {
+	for i, p := range progress {
+		opened, err := s.cipher.openProgress(user, *p)
+		if err != nil {
+			return nil, err
+		}
+		progress[i] = &opened
+	}
+	// the store sorted by index
+	slices.SortStableFunc(progress, func(a, b *kosync.Progress) int {
+		return cmp.Or(cmp.Compare(b.Timestamp, a.Timestamp), cmp.Compare(a.Document, b.Document))
+	})
+	return progress, nil
+}
+
+func (s *encryptedStore) ListProgress(ctx context.Context, user string) ([]*kosync.Progress, error) {
+	progress, err := s.ProgressStore.ListProgress(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	return s.openAll(user, progress)
+}
+
+func (s *encryptedStore) ListDeviceProgress(ctx context.Context, user string, document string) ([]*kosync.Progress, error) {
+	progress, err := s.ProgressStore.ListDeviceProgress(ctx, user, s.cipher.indexOf(document))
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range progress {
+		opened, err := s.cipher.openProgress(user, *p)
+		if err != nil {
+			return nil, err
+		}
+		progress[i] = &opened
+	}
+	return progress, nil
+}
+
+// EachProgress buffers the records of one user at a time since the wrapped
+// store orders them by index rather than by document.
+func (s *encryptedStore) EachProgress(ctx context.Context, user string, fn func(*ProgressRecord) error) error {
+	var pending []*ProgressRecord
+	flush := func() error {
+		slices.SortFunc(pending, func(a, b *ProgressRecord) int { return cmp.Compare(a.Document, b.Document) })
+		for _, rec := range pending {
+			err := fn(rec)
+			if err != nil {
+				return err
+			}
+		}
+		pending = pending[:0]
+		return nil
+	}
+	err := s.ProgressStore.EachProgress(ctx, user, func(rec *ProgressRecord) error {
+		opened, err := s.cipher.openProgress(rec.User, rec.Progress)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 && pending[0].User != rec.User {
+			err = flush()
+			if err != nil {
+				return err
+			}
+		}
+		pending = append(pending, &ProgressRecord{User: rec.User, Progress: opened})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// ListDocuments decrypts every record to map the indexes back to
+// documents, it is only used by the admin API.
+func (s *encryptedStore) ListDocuments(ctx context.Context) ([]*DocumentSummary, error) {
+	docs, err := s.ProgressStore.ListDocuments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	documents := map[string]string{}
+	err = s.ProgressStore.EachProgress(ctx, "", func(rec *ProgressRecord) error {
+		if _, ok := documents[rec.Document]; ok {
+			return nil
+		}
+		opened, err := s.cipher.openProgress(rec.User, rec.Progress)
+		documents[rec.Document] = opened.Document
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range docs {
+		d.Document = documents[d.Document]
+	}
+	slices.SortFunc(docs, func(a, b *DocumentSummary) int { return cmp.Compare(a.Document, b.Document) })
+	return docs, nil
+}
+
+func (s *encryptedStore) DeleteProgress(ctx context.Context, user string, document string) error {
+	return s.ProgressStore.DeleteProgress(ctx, user, s.cipher.indexOf(document))
+}
+
+func (s *encryptedStore) ImportProgress(ctx context.Context, policy ConflictPolicy, next func() (*ProgressRecord, error)) (int, int, error) {
+	return s.ProgressStore.ImportProgress(ctx, policy, func() (*ProgressRecord, error) {
+		rec, err := next()
+		if err != nil {
+			return nil, err
+		}
+		return &ProgressRecord{User: rec.User, Progress: s.cipher.sealProgress(rec.User, rec.Progress)}, nil
+	})
+}
+
+// MergeDocument moves the progress stored under the index of the alias,
+// the records are sealed again for the document.
+func (s *encryptedStore) MergeDocument(ctx context.Context, alias *DocumentAlias) (int, error) {
+	m, ok := s.ProgressStore.(resealer)
+	if !ok {
+		return 0, errors.New("the store can't move encrypted progress")
+	}
+	return m.mergeDocument(ctx, alias, s.cipher.indexOf(alias.Alias), func(user string, p *kosync.Progress) error {
+		opened, err := s.cipher.openProgress(user, *p)
+		if err != nil {
+			return err
+		}
+		opened.Document = alias.Document
+		*p = s.cipher.sealProgress(user, opened)
+		return nil
+	})
+}
+
+// ClaimLegacyProgress seals the claimed progress again for user.
+func (s *encryptedStore) ClaimLegacyProgress(ctx context.Context, user string) (int64, error) {
+	m, ok := s.ProgressStore.(resealer)
+	if !ok {
+		return 0, errors.New("the store can't move encrypted progress")
+	}
+	return m.claimLegacyProgress(ctx, user, func(p *kosync.Progress) error {
+		opened, err := s.cipher.openProgress("", *p)
+		if err != nil {
+			return err
+		}
+		*p = s.cipher.sealProgress(user, opened)
+		return nil
+	})
+}
+
+func (s *encryptedStore) SeenDevice(ctx context.Context, device *Device) error {
+	sealed := s.cipher.sealDevice(*device)
+	return s.ProgressStore.SeenDevice(ctx, &sealed)
+}
+
+func (s *encryptedStore) GetDevice(ctx context.Context, user string, id string) (*Device, error) {
+	d, err := s.ProgressStore.GetDevice(ctx, user, id)
+	if err != nil {
+		return nil, err
+	}
+	opened, err := s.cipher.openDevice(*d)
+	if err != nil {
+		return nil, err
+	}
+	return &opened, nil
+}
+
+func (s *encryptedStore) ListDevices(ctx context.Context, user string) ([]*Device, error) {
+	devices, err := s.ProgressStore.ListDevices(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	for i, d := range devices {
+		opened, err := s.cipher.openDevice(*d)
+		if err != nil {
+			return nil, err
+		}
+		devices[i] = &opened
+	}
+	return devices, nil
+}
+
+// Rewrite hands r the decrypted values and encrypts what it changes.
+func (s *encryptedStore) Rewrite(ctx context.Context, r Rewriter) (int, error) {
+	return s.ProgressStore.Rewrite(ctx, Rewriter{
+		Progress: func(user string, p *kosync.Progress) error {
+			opened, err := s.cipher.openProgress(user, *p)
+			if err != nil {
+				return err
+			}
+			rewritten := opened
+			err = r.Progress(user, &rewritten)
+			if err != nil || rewritten == opened {
+				return err
+			}
+			*p = s.cipher.sealProgress(user, rewritten)
+			return nil
+		},
+		Device: func(d *Device) error {
+			opened, err := s.cipher.openDevice(*d)
+			if err != nil {
+				return err
+			}
+			rewritten := opened
+			err = r.Device(&rewritten)
+			if err != nil || rewritten == opened {
+				return err
+			}
+			*d = s.cipher.sealDevice(rewritten)
+			return nil
+		},
+	})
+}
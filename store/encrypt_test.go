@@ -0,0 +1,127 @@
+package store_test
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/ficoos/kokosync/kosync"
+	"github.com/ficoos/kokosync/store"
+	"github.com/ficoos/kokosync/store/storetest"
+)
+
+func testCipher(t *testing.T) *store.Cipher {
+	t.Helper()
+	keys, err := store.ParseKeys("k1:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if err != nil {
+		t.Fatalf("parse keys: %s", err)
+	}
+	c, err := store.NewCipher(keys, []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("new cipher: %s", err)
+	}
+	return c
+}
+
+func encrypt(t *testing.T, s store.ProgressStore) store.ProgressStore {
+	t.Helper()
+	encrypted, err := store.Encrypt(context.Background(), s, testCipher(t))
+	if err != nil {
+		s.Close()
+		t.Fatalf("encrypt store: %s", err)
+	}
+	return encrypted
+}
+
+func TestEncryptedMemory(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.ProgressStore {
+		return encrypt(t, store.NewMemory())
+	})
+}
+
+func TestEncryptedSQLite(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.ProgressStore {
+		s, _ := openSQLite(t)
+		return encrypt(t, s)
+	})
+}
+
+// TestSealedForUser moves encrypted progress to another user behind the
+// cipher's back, it must not open for them.
+func TestSealedForUser(t *testing.T) {
+	ctx := context.Background()
+	inner := store.NewMemory()
+	s := encrypt(t, inner)
+	defer s.Close()
+	err := s.UpdateProgress(ctx, "alice", &kosync.Progress{
+		Document:   "0123456789abcdef0123456789abcdef",
+		Progress:   "/body/DocFragment[3]/body/p[1]/text().0",
+		Percentage: 0.5,
+		Device:     "kobo",
+		DeviceID:   "K1",
+		Timestamp:  100,
+	})
+	if err != nil {
+		t.Fatalf("update progress: %s", err)
+	}
+
+	var stored []*store.ProgressRecord
+	err = inner.EachProgress(ctx, "alice", func(rec *store.ProgressRecord) error {
+		stored = append(stored, &store.ProgressRecord{User: "bob", Progress: rec.Progress})
+		return nil
+	})
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("expected one stored record, got %d %v", len(stored), err)
+	}
+	_, _, err = inner.ImportProgress(ctx, store.ConflictOverwrite, func() (*store.ProgressRecord, error) {
+		if len(stored) == 0 {
+			return nil, io.EOF
+		}
+		rec := stored[0]
+		stored = stored[1:]
+		return rec, nil
+	})
+	if err != nil {
+		t.Fatalf("import: %s", err)
+	}
+
+	_, err = s.GetProgress(ctx, "bob", "0123456789abcdef0123456789abcdef")
+	if err == nil {
+		t.Fatal("expected progress copied to another user not to decrypt")
+	}
+}
+
+func TestEncryptRefusesPlaintext(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name  string
+		store func(t *testing.T) store.ProgressStore
+	}{
+		{"progress", func(t *testing.T) store.ProgressStore {
+			s := store.NewMemory()
+			err := s.UpdateProgress(ctx, "alice", &kosync.Progress{Document: "doc", Progress: "/body/p[1]", DeviceID: "K1", Device: "kobo"})
+			if err != nil {
+				t.Fatalf("update progress: %s", err)
+			}
+			return s
+		}},
+		{"device", func(t *testing.T) store.ProgressStore {
+			s := store.NewMemory()
+			err := s.SeenDevice(ctx, &store.Device{User: "alice", ID: "K1", Name: "kobo", LastDocument: "doc"})
+			if err != nil {
+				t.Fatalf("seen device: %s", err)
+			}
+			return s
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.store(t)
+			defer s.Close()
+			_, err := store.Encrypt(ctx, s, testCipher(t))
+			if err == nil {
+				t.Fatal("expected plaintext to be refused")
+			}
+		})
+	}
+}
@@ -0,0 +1,680 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ficoos/kokosync/kosync"
+)
+
+// memoryStore keeps progress in maps, user -> document -> progress, the
+// progress of every device in user -> document -> device ID -> progress,
+// devices in user -> device ID -> device, tokens in user -> token ID ->
+// token, aliases in alias -> user and document aliases in alias ->
+// document.
+type memoryStore struct {
+	mu              sync.RWMutex
+	progress        map[string]map[string]kosync.Progress
+	deviceProgress  map[string]map[string]map[string]kosync.Progress
+	devices         map[string]map[string]Device
+	tokens          map[string]map[string]Token
+	aliases         map[string]string
+	documentAliases map[string]string
+}
+
+// NewMemory returns a store that keeps everything in memory and forgets it
+// when the process exits.
+func NewMemory() ProgressStore {
+	return &memoryStore{
+		progress:        map[string]map[string]kosync.Progress{},
+		deviceProgress:  map[string]map[string]map[string]kosync.Progress{},
+		devices:         map[string]map[string]Device{},
+		tokens:          map[string]map[string]Token{},
+		aliases:         map[string]string{},
+		documentAliases: map[string]string{},
+	}
+}
+
+func (s *memoryStore) UpdateProgress(ctx context.Context, user string, progress *kosync.Progress) (err error) {
+	defer func(start time.Time) { observe("update_progress", start, err) }(time.Now())
+	p := *progress
+	if p.Timestamp == 0 {
+		p.Timestamp = time.Now().Unix()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	put(s.progress, user, p)
+	putDevice(s.deviceProgress, user, p)
+	return nil
+}
+
+func putDevice(deviceProgress map[string]map[string]map[string]kosync.Progress, user string, p kosync.Progress) {
+	docs, ok := deviceProgress[user]
+	if !ok {
+		docs = map[string]map[string]kosync.Progress{}
+		deviceProgress[user] = docs
+	}
+	devices, ok := docs[p.Document]
+	if !ok {
+		devices = map[string]kosync.Progress{}
+		docs[p.Document] = devices
+	}
+	devices[p.DeviceID] = p
+}
+
+func put(progress map[string]map[string]kosync.Progress, user string, p kosync.Progress) {
+	docs, ok := progress[user]
+	if !ok {
+		docs = map[string]kosync.Progress{}
+		progress[user] = docs
+	}
+	docs[p.Document] = p
+}
+
+func (s *memoryStore) GetProgress(ctx context.Context, user string, document string) (_ *kosync.Progress, err error) {
+	defer func(start time.Time) { observe("get_progress", start, err) }(time.Now())
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.progress[user][document]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &p, nil
+}
+
+func (s *memoryStore) ListProgress(ctx context.Context, user string) (_ []*kosync.Progress, err error) {
+	defer func(start time.Time) { observe("list_progress", start, err) }(time.Now())
+	s.mu.RLock()
+	res := []*kosync.Progress{}
+	for _, p := range s.progress[user] {
+		res = append(res, &p)
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(res, func(a, b *kosync.Progress) int {
+		return cmp.Or(cmp.Compare(b.Timestamp, a.Timestamp), cmp.Compare(a.Document, b.Document))
+	})
+	return res, nil
+}
+
+func (s *memoryStore) ListDeviceProgress(ctx context.Context, user string, document string) (_ []*kosync.Progress, err error) {
+	defer func(start time.Time) { observe("list_device_progress", start, err) }(time.Now())
+	s.mu.RLock()
+	res := []*kosync.Progress{}
+	for _, p := range s.deviceProgress[user][document] {
+		res = append(res, &p)
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(res, func(a, b *kosync.Progress) int {
+		return cmp.Or(cmp.Compare(b.Timestamp, a.Timestamp), cmp.Compare(a.DeviceID, b.DeviceID))
+	})
+	return res, nil
+}
+
+func (s *memoryStore) EachProgress(ctx context.Context, user string, fn func(*ProgressRecord) error) (err error) {
+	defer func(start time.Time) { observe("each_progress", start, err) }(time.Now())
+	// Collect first so fn can use the store
+	var records []*ProgressRecord
+	s.mu.RLock()
+	for u, docs := range s.progress {
+		if user != "" && u != user {
+			continue
+		}
+		for _, p := range docs {
+			records = append(records, &ProgressRecord{User: u, Progress: p})
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(records, func(a, b *ProgressRecord) int {
+		return cmp.Or(cmp.Compare(a.User, b.User), cmp.Compare(a.Document, b.Document))
+	})
+	for _, rec := range records {
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *memoryStore) ListUsers(ctx context.Context) (_ []*UserSummary, err error) {
+	defer func(start time.Time) { observe("list_users", start, err) }(time.Now())
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	res := []*UserSummary{}
+	for _, user := range slices.Sorted(maps.Keys(s.progress)) {
+		u := &UserSummary{User: user}
+		for _, p := range s.progress[user] {
+			u.Documents++
+			u.LastSync = max(u.LastSync, p.Timestamp)
+		}
+		res = append(res, u)
+	}
+
+	return res, nil
+}
+
+func (s *memoryStore) ListDocuments(ctx context.Context) (_ []*DocumentSummary, err error) {
+	defer func(start time.Time) { observe("list_documents", start, err) }(time.Now())
+	s.mu.RLock()
+	docs := map[string]*DocumentSummary{}
+	for _, userDocs := range s.progress {
+		for _, p := range userDocs {
+			d, ok := docs[p.Document]
+			if !ok {
+				d = &DocumentSummary{Document: p.Document}
+				docs[p.Document] = d
+			}
+			d.Users++
+			d.LastSync = max(d.LastSync, p.Timestamp)
+		}
+	}
+	s.mu.RUnlock()
+
+	res := []*DocumentSummary{}
+	for _, doc := range slices.Sorted(maps.Keys(docs)) {
+		res = append(res, docs[doc])
+	}
+	return res, nil
+}
+
+func (s *memoryStore) DeleteProgress(ctx context.Context, user string, document string) (err error) {
+	defer func(start time.Time) { observe("delete_progress", start, err) }(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	docs := s.progress[user]
+	if _, ok := docs[document]; !ok {
+		return ErrNotFound
+	}
+	delete(docs, document)
+	if len(docs) == 0 {
+		delete(s.progress, user)
+	}
+	delete(s.deviceProgress[user], document)
+	if len(s.deviceProgress[user]) == 0 {
+		delete(s.deviceProgress, user)
+	}
+
+	return nil
+}
+
+func (s *memoryStore) DeleteUser(ctx context.Context, user string) (_ int64, err error) {
+	defer func(start time.Time) { observe("delete_user", start, err) }(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.progress[user])
+	delete(s.progress, user)
+	delete(s.deviceProgress, user)
+	delete(s.devices, user)
+	delete(s.tokens, user)
+	maps.DeleteFunc(s.aliases, func(alias string, u string) bool { return u == user })
+
+	return int64(n), nil
+}
+
+func (s *memoryStore) ClaimLegacyProgress(ctx context.Context, user string) (int64, error) {
+	return s.claimLegacyProgress(ctx, user, func(p *kosync.Progress) error { return nil })
+}
+
+func (s *memoryStore) claimLegacyProgress(ctx context.Context, user string, move func(p *kosync.Progress) error) (_ int64, err error) {
+	defer func(start time.Time) { observe("claim_legacy_progress", start, err) }(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// claims are staged so a failed one changes nothing
+	var staged []kosync.Progress
+	legacy := s.progress[""]
+	for doc, p := range legacy {
+		if _, ok := s.progress[user][doc]; ok {
+			continue
+		}
+		err = move(&p)
+		if err != nil {
+			return 0, err
+		}
+		staged = append(staged, p)
+	}
+
+	for _, p := range staged {
+		put(s.progress, user, p)
+		delete(legacy, p.Document)
+	}
+	if len(legacy) == 0 {
+		delete(s.progress, "")
+	}
+
+	return int64(len(staged)), nil
+}
+
+func (s *memoryStore) ImportProgress(ctx context.Context, policy ConflictPolicy, next func() (*ProgressRecord, error)) (imported int, skipped int, err error) {
+	defer func(start time.Time) { observe("import_progress", start, err) }(time.Now())
+	switch policy {
+	case ConflictNewer, ConflictOverwrite, ConflictSkip:
+	default:
+		return 0, 0, fmt.Errorf("unknown conflict policy %q", policy)
+	}
+
+	// Records are staged and only applied once next is exhausted so a
+	// failed import changes nothing
+	staged := map[string]map[string]kosync.Progress{}
+	var order []ProgressRecord
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		rec, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		existing, ok := staged[rec.User][rec.Document]
+		if !ok {
+			existing, ok = s.progress[rec.User][rec.Document]
+		}
+		if ok && (policy == ConflictSkip || (policy == ConflictNewer && rec.Timestamp <= existing.Timestamp)) {
+			skipped++
+			continue
+		}
+		put(staged, rec.User, rec.Progress)
+		order = append(order, *rec)
+		imported++
+	}
+
+	for _, rec := range order {
+		put(s.progress, rec.User, rec.Progress)
+		putDevice(s.deviceProgress, rec.User, rec.Progress)
+	}
+
+	return imported, skipped, nil
+}
+
+func (s *memoryStore) SeenDevice(ctx context.Context, device *Device) (err error) {
+	defer func(start time.Time) { observe("seen_device", start, err) }(time.Now())
+	seen := device.LastSeen
+	if seen == 0 {
+		seen = time.Now().Unix()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	devices, ok := s.devices[device.User]
+	if !ok {
+		devices = map[string]Device{}
+		s.devices[device.User] = devices
+	}
+	d, ok := devices[device.ID]
+	if !ok {
+		d = Device{User: device.User, ID: device.ID, FirstSeen: seen}
+	}
+	d.Name = device.Name
+	d.LastSeen = seen
+	d.LastDocument = device.LastDocument
+	d.LastIP = device.LastIP
+	devices[device.ID] = d
+
+	return nil
+}
+
+func (s *memoryStore) GetDevice(ctx context.Context, user string, id string) (_ *Device, err error) {
+	defer func(start time.Time) { observe("get_device", start, err) }(time.Now())
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.devices[user][id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &d, nil
+}
+
+func (s *memoryStore) ListDevices(ctx context.Context, user string) (_ []*Device, err error) {
+	defer func(start time.Time) { observe("list_devices", start, err) }(time.Now())
+	s.mu.RLock()
+	res := []*Device{}
+	for u, devices := range s.devices {
+		if user != "" && u != user {
+			continue
+		}
+		for _, d := range devices {
+			res = append(res, &d)
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(res, func(a, b *Device) int {
+		return cmp.Or(cmp.Compare(a.User, b.User), cmp.Compare(b.LastSeen, a.LastSeen), cmp.Compare(a.ID, b.ID))
+	})
+	return res, nil
+}
+
+// updateDevice applies fn to a device, a missing device is ErrNotFound.
+func (s *memoryStore) updateDevice(user string, id string, fn func(d *Device)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[user][id]
+	if !ok {
+		return ErrNotFound
+	}
+	fn(&d)
+	s.devices[user][id] = d
+
+	return nil
+}
+
+func (s *memoryStore) RenameDevice(ctx context.Context, user string, id string, label string) (err error) {
+	defer func(start time.Time) { observe("rename_device", start, err) }(time.Now())
+	return s.updateDevice(user, id, func(d *Device) { d.Label = label })
+}
+
+func (s *memoryStore) BlockDevice(ctx context.Context, user string, id string, blocked bool) (err error) {
+	defer func(start time.Time) { observe("block_device", start, err) }(time.Now())
+	return s.updateDevice(user, id, func(d *Device) { d.Blocked = blocked })
+}
+
+func (s *memoryStore) CreateToken(ctx context.Context, token *Token) (err error) {
+	defer func(start time.Time) { observe("create_token", start, err) }(time.Now())
+	t := *token
+	if t.Created == 0 {
+		t.Created = time.Now().Unix()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tokens := range s.tokens {
+		for _, existing := range tokens {
+			if existing.Hash == t.Hash {
+				return errors.New("duplicate token hash")
+			}
+		}
+	}
+	if _, ok := s.tokens[t.User][t.ID]; ok {
+		return fmt.Errorf("duplicate token id %s", t.ID)
+	}
+	if s.tokens[t.User] == nil {
+		s.tokens[t.User] = map[string]Token{}
+	}
+	s.tokens[t.User][t.ID] = t
+
+	return nil
+}
+
+func (s *memoryStore) FindToken(ctx context.Context, user string, hash string) (_ *Token, err error) {
+	defer func(start time.Time) { observe("find_token", start, err) }(time.Now())
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.tokens[user] {
+		if t.Hash == hash {
+			return &t, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (s *memoryStore) ListTokens(ctx context.Context, user string) (_ []*Token, err error) {
+	defer func(start time.Time) { observe("list_tokens", start, err) }(time.Now())
+	s.mu.RLock()
+	res := []*Token{}
+	for u, tokens := range s.tokens {
+		if user != "" && u != user {
+			continue
+		}
+		for _, t := range tokens {
+			res = append(res, &t)
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(res, func(a, b *Token) int {
+		return cmp.Or(cmp.Compare(a.User, b.User), cmp.Compare(a.Created, b.Created), cmp.Compare(a.ID, b.ID))
+	})
+	return res, nil
+}
+
+func (s *memoryStore) UseToken(ctx context.Context, user string, id string, when int64) (err error) {
+	defer func(start time.Time) { observe("use_token", start, err) }(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.tokens[user][id]; ok {
+		t.LastUsed = when
+		s.tokens[user][id] = t
+	}
+
+	return nil
+}
+
+func (s *memoryStore) RevokeToken(ctx context.Context, user string, id string) (err error) {
+	defer func(start time.Time) { observe("revoke_token", start, err) }(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[user][id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.tokens[user], id)
+	if len(s.tokens[user]) == 0 {
+		delete(s.tokens, user)
+	}
+
+	return nil
+}
+
+func (s *memoryStore) SetAlias(ctx context.Context, alias *Alias) (err error) {
+	defer func(start time.Time) { observe("set_alias", start, err) }(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aliases[alias.Alias] = alias.User
+	return nil
+}
+
+func (s *memoryStore) ResolveAlias(ctx context.Context, alias string) (_ string, err error) {
+	defer func(start time.Time) { observe("resolve_alias", start, err) }(time.Now())
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.aliases[alias]
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	return user, nil
+}
+
+func (s *memoryStore) ListAliases(ctx context.Context) (_ []*Alias, err error) {
+	defer func(start time.Time) { observe("list_aliases", start, err) }(time.Now())
+	s.mu.RLock()
+	res := []*Alias{}
+	for alias, user := range s.aliases {
+		res = append(res, &Alias{Alias: alias, User: user})
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(res, func(a, b *Alias) int {
+		return cmp.Or(cmp.Compare(a.User, b.User), cmp.Compare(a.Alias, b.Alias))
+	})
+	return res, nil
+}
+
+func (s *memoryStore) DeleteAlias(ctx context.Context, alias string) (err error) {
+	defer func(start time.Time) { observe("delete_alias", start, err) }(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.aliases[alias]; !ok {
+		return ErrNotFound
+	}
+	delete(s.aliases, alias)
+
+	return nil
+}
+
+func (s *memoryStore) SetDocumentAlias(ctx context.Context, alias *DocumentAlias) (err error) {
+	defer func(start time.Time) { observe("set_document_alias", start, err) }(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.documentAliases[alias.Alias] = alias.Document
+	return nil
+}
+
+func (s *memoryStore) MergeDocument(ctx context.Context, alias *DocumentAlias) (int, error) {
+	return s.mergeDocument(ctx, alias, alias.Alias, func(user string, p *kosync.Progress) error {
+		p.Document = alias.Document
+		return nil
+	})
+}
+
+func (s *memoryStore) mergeDocument(ctx context.Context, alias *DocumentAlias, from string, move func(user string, p *kosync.Progress) error) (merged int, err error) {
+	defer func(start time.Time) { observe("merge_document", start, err) }(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// moves are staged so a failed one changes nothing
+	var staged []ProgressRecord
+	for user, docs := range s.progress {
+		p, ok := docs[from]
+		if !ok {
+			continue
+		}
+		err = move(user, &p)
+		if err != nil {
+			return 0, err
+		}
+		existing, ok := docs[p.Document]
+		if ok && p.Timestamp <= existing.Timestamp {
+			continue
+		}
+		staged = append(staged, ProgressRecord{User: user, Progress: p})
+	}
+
+	s.documentAliases[alias.Alias] = alias.Document
+	for _, rec := range staged {
+		put(s.progress, rec.User, rec.Progress)
+		putDevice(s.deviceProgress, rec.User, rec.Progress)
+	}
+	for user, docs := range s.progress {
+		if _, ok := docs[from]; !ok {
+			continue
+		}
+		delete(docs, from)
+		delete(s.deviceProgress[user], from)
+		if len(s.deviceProgress[user]) == 0 {
+			delete(s.deviceProgress, user)
+		}
+	}
+
+	return len(staged), nil
+}
+
+func (s *memoryStore) ResolveDocumentAlias(ctx context.Context, alias string) (_ string, err error) {
+	defer func(start time.Time) { observe("resolve_document_alias", start, err) }(time.Now())
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	document, ok := s.documentAliases[alias]
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	return document, nil
+}
+
+func (s *memoryStore) ListDocumentAliases(ctx context.Context) (_ []*DocumentAlias, err error) {
+	defer func(start time.Time) { observe("list_document_aliases", start, err) }(time.Now())
+	s.mu.RLock()
+	res := []*DocumentAlias{}
+	for alias, document := range s.documentAliases {
+		res = append(res, &DocumentAlias{Alias: alias, Document: document})
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(res, func(a, b *DocumentAlias) int {
+		return cmp.Or(cmp.Compare(a.Document, b.Document), cmp.Compare(a.Alias, b.Alias))
+	})
+	return res, nil
+}
+
+func (s *memoryStore) DeleteDocumentAlias(ctx context.Context, alias string) (err error) {
+	defer func(start time.Time) { observe("delete_document_alias", start, err) }(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.documentAliases[alias]; !ok {
+		return ErrNotFound
+	}
+	delete(s.documentAliases, alias)
+
+	return nil
+}
+
+func (s *memoryStore) Rewrite(ctx context.Context, r Rewriter) (changed int, err error) {
+	defer func(start time.Time) { observe("rewrite", start, err) }(time.Now())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Rewrite into copies so a failure changes nothing
+	progress := map[string]map[string]kosync.Progress{}
+	for user, docs := range s.progress {
+		for _, p := range docs {
+			rewritten := p
+			err = r.Progress(user, &rewritten)
+			if err != nil {
+				return 0, err
+			}
+			if rewritten != p {
+				changed++
+			}
+			put(progress, user, rewritten)
+		}
+	}
+	deviceProgress := map[string]map[string]map[string]kosync.Progress{}
+	for user, docs := range s.deviceProgress {
+		for _, devices := range docs {
+			for _, p := range devices {
+				rewritten := p
+				err = r.Progress(user, &rewritten)
+				if err != nil {
+					return 0, err
+				}
+				if rewritten != p {
+					changed++
+				}
+				putDevice(deviceProgress, user, rewritten)
+			}
+		}
+	}
+	devices := map[string]map[string]Device{}
+	for user, userDevices := range s.devices {
+		devices[user] = map[string]Device{}
+		for id, d := range userDevices {
+			rewritten := d
+			err = r.Device(&rewritten)
+			if err != nil {
+				return 0, err
+			}
+			if rewritten != d {
+				changed++
+			}
+			devices[user][id] = rewritten
+		}
+	}
+
+	s.progress, s.deviceProgress, s.devices = progress, deviceProgress, devices
+	return changed, nil
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
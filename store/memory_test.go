@@ -0,0 +1,14 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/ficoos/kokosync/store"
+	"github.com/ficoos/kokosync/store/storetest"
+)
+
+func TestMemory(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.ProgressStore {
+		return store.NewMemory()
+	})
+}
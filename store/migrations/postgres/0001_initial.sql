@@ -0,0 +1,10 @@
+CREATE TABLE progress (
+    username TEXT NOT NULL,
+    document TEXT NOT NULL,
+    progress TEXT NOT NULL,
+    percentage DOUBLE PRECISION NOT NULL,
+    device_id TEXT NOT NULL,
+    device TEXT NOT NULL,
+    timestamp BIGINT NOT NULL,
+    PRIMARY KEY (username, document)
+);
@@ -0,0 +1,9 @@
+CREATE TABLE tokens (
+    username TEXT NOT NULL,
+    token_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    hash TEXT NOT NULL UNIQUE,
+    created BIGINT NOT NULL,
+    last_used BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (username, token_id)
+);
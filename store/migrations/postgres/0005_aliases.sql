@@ -0,0 +1,4 @@
+CREATE TABLE aliases (
+    alias TEXT NOT NULL PRIMARY KEY,
+    username TEXT NOT NULL
+);
@@ -0,0 +1,4 @@
+CREATE TABLE document_aliases (
+    alias TEXT NOT NULL PRIMARY KEY,
+    document TEXT NOT NULL
+);
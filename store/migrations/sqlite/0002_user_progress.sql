@@ -0,0 +1,20 @@
+-- Progress is now owned by the user who synced it
+CREATE TABLE progress_v2 (
+    username TEXT NOT NULL,
+    document TEXT NOT NULL,
+    progress TEXT NOT NULL,
+    percentage NUMERIC NOT NULL,
+    device_id TEXT NOT NULL,
+    device TEXT NOT NULL,
+    timestamp INTEGER NOT NULL,
+    PRIMARY KEY (username, document)
+);
+
+-- Existing progress was shared by everyone, it stays unowned until claimed
+-- with MKSYNC_LEGACY_USER
+INSERT INTO progress_v2 (username, document, progress, percentage, device_id, device, timestamp)
+    SELECT '', document, progress, percentage, device_id, device, CAST(strftime('%s', 'now') AS INTEGER)
+    FROM progress;
+
+DROP TABLE progress;
+ALTER TABLE progress_v2 RENAME TO progress;
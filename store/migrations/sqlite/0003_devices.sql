@@ -0,0 +1,24 @@
+CREATE TABLE devices (
+    username TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    device TEXT NOT NULL,
+    label TEXT NOT NULL DEFAULT '',
+    first_seen INTEGER NOT NULL,
+    last_seen INTEGER NOT NULL,
+    last_document TEXT NOT NULL,
+    last_ip TEXT NOT NULL,
+    blocked BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (username, device_id)
+);
+
+-- Seed the registry with the devices progress was last saved by
+INSERT INTO devices (username, device_id, device, first_seen, last_seen, last_document, last_ip)
+    SELECT p.username, p.device_id, p.device, seen.first_seen, p.timestamp, p.document, ''
+    FROM progress p
+    JOIN (
+        SELECT username, device_id, MIN(timestamp) AS first_seen, MAX(timestamp) AS last_seen
+        FROM progress
+        GROUP BY username, device_id
+    ) seen ON seen.username = p.username AND seen.device_id = p.device_id AND seen.last_seen = p.timestamp
+    WHERE p.username <> '' AND p.device_id <> ''
+    ON CONFLICT DO NOTHING;
@@ -0,0 +1,17 @@
+-- The latest position every device synced, progress keeps the one
+-- returned to KOReader
+CREATE TABLE device_progress (
+    username TEXT NOT NULL,
+    document TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    device TEXT NOT NULL,
+    progress TEXT NOT NULL,
+    percentage NUMERIC NOT NULL,
+    timestamp INTEGER NOT NULL,
+    PRIMARY KEY (username, document, device_id)
+);
+
+INSERT INTO device_progress (username, document, device_id, device, progress, percentage, timestamp)
+    SELECT username, document, device_id, device, progress, percentage, timestamp
+    FROM progress
+    WHERE username <> '';
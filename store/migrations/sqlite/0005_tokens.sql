@@ -0,0 +1,9 @@
+CREATE TABLE tokens (
+    username TEXT NOT NULL,
+    token_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    hash TEXT NOT NULL UNIQUE,
+    created INTEGER NOT NULL,
+    last_used INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (username, token_id)
+);
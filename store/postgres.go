@@ -0,0 +1,75 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+// migrationLock is the advisory lock key replicas starting together take
+// so only one of them migrates.
+const migrationLock = 0x6b6f6b6f
+
+var postgresDialect = &dialect{
+	name:   "postgres",
+	rebind: rebindDollar,
+	schemaVersion: func(tx *sql.Tx) (int, error) {
+		_, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationLock)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`)
+		if err != nil {
+			return 0, err
+		}
+		var version int
+		err = tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+		return version, err
+	},
+	setSchemaVersion: func(tx *sql.Tx, version int) error {
+		_, err := tx.Exec(`DELETE FROM schema_version`)
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO schema_version (version) VALUES ($1)`, version)
+		}
+		return err
+	},
+}
+
+// rebindDollar replaces ? placeholders with $1, $2 ...
+func rebindDollar(query string) string {
+	var sb strings.Builder
+	n := 0
+	for _, c := range query {
+		if c != '?' {
+			sb.WriteRune(c)
+			continue
+		}
+		n++
+		sb.WriteByte('$')
+		sb.WriteString(strconv.Itoa(n))
+	}
+
+	return sb.String()
+}
+
+// OpenPostgres connects to the PostgreSQL database described by dsn and
+// creates the schema if needed. Several instances can share a database.
+func OpenPostgres(dsn string, opts Options) (ProgressStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open database: %s", err)
+	}
+	setPoolSize(db, opts)
+
+	s := newSQLStore(db, postgresDialect)
+	err = s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initialize database: %s", err)
+	}
+
+	return s, nil
+}
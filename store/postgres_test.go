@@ -0,0 +1,90 @@
+package store_test
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ficoos/kokosync/store"
+	"github.com/ficoos/kokosync/store/storetest"
+)
+
+// postgresDSNEnv names the PostgreSQL server the tests run against, they
+// are skipped without it. The user needs to be allowed to create schemas.
+const postgresDSNEnv = "KOKOSYNC_TEST_POSTGRES_DSN"
+
+// postgresDSN returns the DSN of the test server, it skips the test when
+// there is none.
+func postgresDSN(t *testing.T) string {
+	t.Helper()
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skip(postgresDSNEnv + " is not set")
+	}
+	return dsn
+}
+
+// openPostgres opens a store in a new schema of its own, migrated from
+// scratch and dropped when the test is done.
+func openPostgres(t *testing.T, dsn string) store.ProgressStore {
+	t.Helper()
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("open database: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	id := make([]byte, 8)
+	rand.Read(id)
+	schema := "kokosync_test_" + hex.EncodeToString(id)
+	_, err = db.Exec(`CREATE SCHEMA ` + schema)
+	if err != nil {
+		t.Fatalf("create schema: %s", err)
+	}
+	t.Cleanup(func() {
+		_, err := db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+		if err != nil {
+			t.Errorf("drop schema: %s", err)
+		}
+	})
+
+	s, err := store.OpenPostgres(withSearchPath(t, dsn, schema), store.DefaultOptions)
+	if err != nil {
+		t.Fatalf("open postgres: %s", err)
+	}
+	return s
+}
+
+// withSearchPath returns dsn connecting to schema, dsn is either a URL or
+// key=value pairs.
+func withSearchPath(t *testing.T, dsn string, schema string) string {
+	t.Helper()
+	if !strings.HasPrefix(dsn, "postgres://") && !strings.HasPrefix(dsn, "postgresql://") {
+		return dsn + " search_path=" + schema
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatalf("parse %s: %s", postgresDSNEnv, err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func TestPostgres(t *testing.T) {
+	dsn := postgresDSN(t)
+	storetest.Run(t, func(t *testing.T) store.ProgressStore {
+		return openPostgres(t, dsn)
+	})
+}
+
+func TestEncryptedPostgres(t *testing.T) {
+	dsn := postgresDSN(t)
+	storetest.Run(t, func(t *testing.T) store.ProgressStore {
+		return encrypt(t, openPostgres(t, dsn))
+	})
+}
@@ -0,0 +1,1173 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ficoos/kokosync/kosync"
+)
+
+// pingWriteTimeout bounds the write probe of Ping, including the wait for
+// the write lock.
+const pingWriteTimeout = time.Second
+
+//go:embed migrations
+var migrations embed.FS
+
+// dialect holds what differs between the SQL databases, queries are
+// written with ? placeholders and rewritten by rebind.
+type dialect struct {
+	// name of the migrations directory
+	name   string
+	rebind func(query string) string
+	// serializeWrites makes writers wait for each other in process
+	serializeWrites bool
+	// schemaVersion locks the schema for tx and returns the version of the
+	// last migration applied
+	schemaVersion    func(tx *sql.Tx) (int, error)
+	setSchemaVersion func(tx *sql.Tx, version int) error
+}
+
+// sqlStore implements ProgressStore with plain SQL that both SQLite and
+// PostgreSQL understand.
+type sqlStore struct {
+	db      *sql.DB
+	dialect *dialect
+	// writes holds a value while a writer holds the write lock
+	writes chan struct{}
+}
+
+// newSQLStore returns a store on db, the schema isn't migrated.
+func newSQLStore(db *sql.DB, d *dialect) *sqlStore {
+	return &sqlStore{db: db, dialect: d, writes: make(chan struct{}, 1)}
+}
+
+func setPoolSize(db *sql.DB, opts Options) {
+	if opts.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(opts.MaxOpenConns)
+	}
+	if opts.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(opts.MaxIdleConns)
+	}
+}
+
+// lockWrites returns a function releasing the write lock when the dialect
+// serializes writes.
+func (s *sqlStore) lockWrites() func() {
+	if !s.dialect.serializeWrites {
+		return func() {}
+	}
+	s.writes <- struct{}{}
+	return s.unlockWrites
+}
+
+// lockWritesContext is lockWrites giving up when ctx is done.
+func (s *sqlStore) lockWritesContext(ctx context.Context) (func(), error) {
+	if !s.dialect.serializeWrites {
+		return func() {}, nil
+	}
+	select {
+	case s.writes <- struct{}{}:
+		return s.unlockWrites, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *sqlStore) unlockWrites() {
+	<-s.writes
+}
+
+func (s *sqlStore) exec(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return s.db.ExecContext(ctx, s.dialect.rebind(query), args...)
+}
+
+func (s *sqlStore) query(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return s.db.QueryContext(ctx, s.dialect.rebind(query), args...)
+}
+
+const upsertProgress = `
+	INSERT INTO progress (
+		username,
+		document,
+		progress,
+		percentage,
+		device_id,
+		device,
+		timestamp)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(username, document) `
+
+// updateIfNewer completes upsertProgress for ConflictNewer.
+const updateIfNewer = `DO UPDATE SET
+			progress=excluded.progress,
+			percentage=excluded.percentage,
+			device_id=excluded.device_id,
+			device=excluded.device,
+			timestamp=excluded.timestamp
+		WHERE excluded.timestamp > progress.timestamp`
+
+// upsertDeviceProgress takes the same arguments as upsertProgress.
+const upsertDeviceProgress = `
+	INSERT INTO device_progress (
+		username,
+		document,
+		progress,
+		percentage,
+		device_id,
+		device,
+		timestamp)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(username, document, device_id) DO UPDATE SET
+		progress=excluded.progress,
+		percentage=excluded.percentage,
+		device=excluded.device,
+		timestamp=excluded.timestamp`
+
+func (s *sqlStore) UpdateProgress(ctx context.Context, user string, progress *kosync.Progress) (err error) {
+	defer func(start time.Time) { observe("update_progress", start, err) }(time.Now())
+	defer s.lockWrites()()
+	timestamp := progress.Timestamp
+	if timestamp == 0 {
+		timestamp = time.Now().Unix()
+	}
+	args := []any{
+		user,
+		progress.Document,
+		progress.Progress,
+		progress.Percentage,
+		progress.DeviceID,
+		progress.Device,
+		timestamp,
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, s.dialect.rebind(upsertProgress+`DO UPDATE SET
+		progress=excluded.progress,
+		percentage=excluded.percentage,
+		device_id=excluded.device_id,
+		device=excluded.device,
+		timestamp=excluded.timestamp`), args...)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.dialect.rebind(upsertDeviceProgress), args...)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanProgress(row scanner) (*kosync.Progress, error) {
+	var res kosync.Progress
+	err := row.Scan(
+		&res.Document,
+		&res.Progress,
+		&res.Percentage,
+		&res.DeviceID,
+		&res.Device,
+		&res.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (s *sqlStore) GetProgress(ctx context.Context, user string, document string) (_ *kosync.Progress, err error) {
+	defer func(start time.Time) { observe("get_progress", start, err) }(time.Now())
+	row := s.db.QueryRowContext(ctx, s.dialect.rebind(`
+	SELECT document, progress, percentage, device_id, device, timestamp
+	FROM progress
+	WHERE username = ? AND document = ?
+	`), user, document)
+	p, err := scanProgress(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return p, err
+}
+
+func (s *sqlStore) ListProgress(ctx context.Context, user string) (_ []*kosync.Progress, err error) {
+	defer func(start time.Time) { observe("list_progress", start, err) }(time.Now())
+	rows, err := s.query(ctx, `
+	SELECT document, progress, percentage, device_id, device, timestamp
+	FROM progress
+	WHERE username = ?
+	ORDER BY timestamp DESC, document
+	`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []*kosync.Progress{}
+	for rows.Next() {
+		p, err := scanProgress(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, p)
+	}
+
+	return res, rows.Err()
+}
+
+func (s *sqlStore) ListDeviceProgress(ctx context.Context, user string, document string) (_ []*kosync.Progress, err error) {
+	defer func(start time.Time) { observe("list_device_progress", start, err) }(time.Now())
+	rows, err := s.query(ctx, `
+	SELECT document, progress, percentage, device_id, device, timestamp
+	FROM device_progress
+	WHERE username = ? AND document = ?
+	ORDER BY timestamp DESC, device_id
+	`, user, document)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []*kosync.Progress{}
+	for rows.Next() {
+		p, err := scanProgress(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, p)
+	}
+
+	return res, rows.Err()
+}
+
+func (s *sqlStore) ListUsers(ctx context.Context) (_ []*UserSummary, err error) {
+	defer func(start time.Time) { observe("list_users", start, err) }(time.Now())
+	rows, err := s.query(ctx, `
+	SELECT username, COUNT(*), MAX(timestamp)
+	FROM progress
+	GROUP BY username
+	ORDER BY username
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []*UserSummary{}
+	for rows.Next() {
+		var u UserSummary
+		err = rows.Scan(&u.User, &u.Documents, &u.LastSync)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, &u)
+	}
+
+	return res, rows.Err()
+}
+
+func (s *sqlStore) ListDocuments(ctx context.Context) (_ []*DocumentSummary, err error) {
+	defer func(start time.Time) { observe("list_documents", start, err) }(time.Now())
+	rows, err := s.query(ctx, `
+	SELECT document, COUNT(*), MAX(timestamp)
+	FROM progress
+	GROUP BY document
+	ORDER BY document
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []*DocumentSummary{}
+	for rows.Next() {
+		var d DocumentSummary
+		err = rows.Scan(&d.Document, &d.Users, &d.LastSync)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, &d)
+	}
+
+	return res, rows.Err()
+}
+
+func (s *sqlStore) DeleteProgress(ctx context.Context, user string, document string) (err error) {
+	defer func(start time.Time) { observe("delete_progress", start, err) }(time.Now())
+	defer s.lockWrites()()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM progress WHERE username = ? AND document = ?`), user, document)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	_, err = tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM device_progress WHERE username = ? AND document = ?`), user, document)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlStore) DeleteUser(ctx context.Context, user string) (_ int64, err error) {
+	defer func(start time.Time) { observe("delete_user", start, err) }(time.Now())
+	defer s.lockWrites()()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"devices", "device_progress", "tokens", "aliases"} {
+		_, err = tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM `+table+` WHERE username = ?`), user)
+		if err != nil {
+			return 0, err
+		}
+	}
+	res, err := tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM progress WHERE username = ?`), user)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return n, tx.Commit()
+}
+
+func (s *sqlStore) ClaimLegacyProgress(ctx context.Context, user string) (int64, error) {
+	return s.claimLegacyProgress(ctx, user, func(p *kosync.Progress) error { return nil })
+}
+
+func (s *sqlStore) claimLegacyProgress(ctx context.Context, user string, move func(p *kosync.Progress) error) (claimed int64, err error) {
+	defer func(start time.Time) { observe("claim_legacy_progress", start, err) }(time.Now())
+	defer s.lockWrites()()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, s.dialect.rebind(`
+	SELECT document, progress, percentage, device_id, device, timestamp
+	FROM progress
+	WHERE username = '' AND document NOT IN (
+		SELECT document FROM progress WHERE username = ?
+	)`), user)
+	if err != nil {
+		return 0, err
+	}
+	var legacy []*kosync.Progress
+	for rows.Next() {
+		p, err := scanProgress(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		legacy = append(legacy, p)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, p := range legacy {
+		document := p.Document
+		err = move(p)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.ExecContext(ctx, s.dialect.rebind(`
+		UPDATE progress SET username = ?, progress = ?, percentage = ?
+		WHERE username = '' AND document = ?
+		`), user, p.Progress, p.Percentage, document)
+		if err != nil {
+			return 0, err
+		}
+		claimed++
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return claimed, nil
+}
+
+func (s *sqlStore) SeenDevice(ctx context.Context, device *Device) (err error) {
+	defer func(start time.Time) { observe("seen_device", start, err) }(time.Now())
+	defer s.lockWrites()()
+	seen := device.LastSeen
+	if seen == 0 {
+		seen = time.Now().Unix()
+	}
+	_, err = s.exec(ctx, `
+		INSERT INTO devices (
+			username,
+			device_id,
+			device,
+			first_seen,
+			last_seen,
+			last_document,
+			last_ip)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(username, device_id) DO UPDATE SET
+			device=excluded.device,
+			last_seen=excluded.last_seen,
+			last_document=excluded.last_document,
+			last_ip=excluded.last_ip
+	`,
+		device.User,
+		device.ID,
+		device.Name,
+		seen,
+		seen,
+		device.LastDocument,
+		device.LastIP,
+	)
+	return err
+}
+
+const deviceColumns = `username, device_id, device, label, first_seen, last_seen, last_document, last_ip, blocked`
+
+func scanDevice(row scanner) (*Device, error) {
+	var d Device
+	err := row.Scan(
+		&d.User,
+		&d.ID,
+		&d.Name,
+		&d.Label,
+		&d.FirstSeen,
+		&d.LastSeen,
+		&d.LastDocument,
+		&d.LastIP,
+		&d.Blocked)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s *sqlStore) GetDevice(ctx context.Context, user string, id string) (_ *Device, err error) {
+	defer func(start time.Time) { observe("get_device", start, err) }(time.Now())
+	row := s.db.QueryRowContext(ctx, s.dialect.rebind(`
+	SELECT `+deviceColumns+`
+	FROM devices
+	WHERE username = ? AND device_id = ?
+	`), user, id)
+	d, err := scanDevice(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return d, err
+}
+
+func (s *sqlStore) ListDevices(ctx context.Context, user string) (_ []*Device, err error) {
+	defer func(start time.Time) { observe("list_devices", start, err) }(time.Now())
+	query := `
+	SELECT ` + deviceColumns + `
+	FROM devices
+	`
+	var args []any
+	if user != "" {
+		query += `WHERE username = ?
+	`
+		args = append(args, user)
+	}
+	rows, err := s.query(ctx, query+`ORDER BY username, last_seen DESC, device_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []*Device{}
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, d)
+	}
+
+	return res, rows.Err()
+}
+
+// updateDevice runs an update of a single device, not matching a device is
+// ErrNotFound.
+func (s *sqlStore) updateDevice(ctx context.Context, query string, args ...any) error {
+	defer s.lockWrites()()
+	res, err := s.exec(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *sqlStore) RenameDevice(ctx context.Context, user string, id string, label string) (err error) {
+	defer func(start time.Time) { observe("rename_device", start, err) }(time.Now())
+	return s.updateDevice(ctx, `UPDATE devices SET label = ? WHERE username = ? AND device_id = ?`, label, user, id)
+}
+
+func (s *sqlStore) BlockDevice(ctx context.Context, user string, id string, blocked bool) (err error) {
+	defer func(start time.Time) { observe("block_device", start, err) }(time.Now())
+	return s.updateDevice(ctx, `UPDATE devices SET blocked = ? WHERE username = ? AND device_id = ?`, blocked, user, id)
+}
+
+func (s *sqlStore) CreateToken(ctx context.Context, token *Token) (err error) {
+	defer func(start time.Time) { observe("create_token", start, err) }(time.Now())
+	defer s.lockWrites()()
+	created := token.Created
+	if created == 0 {
+		created = time.Now().Unix()
+	}
+	_, err = s.exec(ctx, `
+	INSERT INTO tokens (username, token_id, name, hash, created)
+	VALUES (?, ?, ?, ?, ?)
+	`, token.User, token.ID, token.Name, token.Hash, created)
+	return err
+}
+
+const tokenColumns = `username, token_id, name, hash, created, last_used`
+
+func scanToken(row scanner) (*Token, error) {
+	var t Token
+	err := row.Scan(&t.User, &t.ID, &t.Name, &t.Hash, &t.Created, &t.LastUsed)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *sqlStore) FindToken(ctx context.Context, user string, hash string) (_ *Token, err error) {
+	defer func(start time.Time) { observe("find_token", start, err) }(time.Now())
+	row := s.db.QueryRowContext(ctx, s.dialect.rebind(`
+	SELECT `+tokenColumns+`
+	FROM tokens
+	WHERE username = ? AND hash = ?
+	`), user, hash)
+	t, err := scanToken(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return t, err
+}
+
+func (s *sqlStore) ListTokens(ctx context.Context, user string) (_ []*Token, err error) {
+	defer func(start time.Time) { observe("list_tokens", start, err) }(time.Now())
+	query := `
+	SELECT ` + tokenColumns + `
+	FROM tokens
+	`
+	var args []any
+	if user != "" {
+		query += `WHERE username = ?
+	`
+		args = append(args, user)
+	}
+	rows, err := s.query(ctx, query+`ORDER BY username, created, token_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []*Token{}
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, t)
+	}
+
+	return res, rows.Err()
+}
+
+func (s *sqlStore) UseToken(ctx context.Context, user string, id string, when int64) (err error) {
+	defer func(start time.Time) { observe("use_token", start, err) }(time.Now())
+	defer s.lockWrites()()
+	_, err = s.exec(ctx, `UPDATE tokens SET last_used = ? WHERE username = ? AND token_id = ?`, when, user, id)
+	return err
+}
+
+func (s *sqlStore) RevokeToken(ctx context.Context, user string, id string) (err error) {
+	defer func(start time.Time) { observe("revoke_token", start, err) }(time.Now())
+	defer s.lockWrites()()
+	res, err := s.exec(ctx, `DELETE FROM tokens WHERE username = ? AND token_id = ?`, user, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *sqlStore) SetAlias(ctx context.Context, alias *Alias) (err error) {
+	defer func(start time.Time) { observe("set_alias", start, err) }(time.Now())
+	defer s.lockWrites()()
+	_, err = s.exec(ctx, `
+	INSERT INTO aliases (alias, username) VALUES (?, ?)
+	ON CONFLICT(alias) DO UPDATE SET username=excluded.username
+	`, alias.Alias, alias.User)
+	return err
+}
+
+func (s *sqlStore) ResolveAlias(ctx context.Context, alias string) (_ string, err error) {
+	defer func(start time.Time) { observe("resolve_alias", start, err) }(time.Now())
+	var user string
+	err = s.db.QueryRowContext(ctx, s.dialect.rebind(`SELECT username FROM aliases WHERE alias = ?`), alias).Scan(&user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return user, err
+}
+
+func (s *sqlStore) ListAliases(ctx context.Context) (_ []*Alias, err error) {
+	defer func(start time.Time) { observe("list_aliases", start, err) }(time.Now())
+	rows, err := s.query(ctx, `SELECT alias, username FROM aliases ORDER BY username, alias`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []*Alias{}
+	for rows.Next() {
+		var a Alias
+		err := rows.Scan(&a.Alias, &a.User)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, &a)
+	}
+
+	return res, rows.Err()
+}
+
+func (s *sqlStore) DeleteAlias(ctx context.Context, alias string) (err error) {
+	defer func(start time.Time) { observe("delete_alias", start, err) }(time.Now())
+	defer s.lockWrites()()
+	res, err := s.exec(ctx, `DELETE FROM aliases WHERE alias = ?`, alias)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *sqlStore) SetDocumentAlias(ctx context.Context, alias *DocumentAlias) (err error) {
+	defer func(start time.Time) { observe("set_document_alias", start, err) }(time.Now())
+	defer s.lockWrites()()
+	_, err = s.exec(ctx, upsertDocumentAlias, alias.Alias, alias.Document)
+	return err
+}
+
+const upsertDocumentAlias = `
+	INSERT INTO document_aliases (alias, document) VALUES (?, ?)
+	ON CONFLICT(alias) DO UPDATE SET document=excluded.document
+	`
+
+func (s *sqlStore) MergeDocument(ctx context.Context, alias *DocumentAlias) (int, error) {
+	return s.mergeDocument(ctx, alias, alias.Alias, func(user string, p *kosync.Progress) error {
+		p.Document = alias.Document
+		return nil
+	})
+}
+
+func (s *sqlStore) mergeDocument(ctx context.Context, alias *DocumentAlias, from string, move func(user string, p *kosync.Progress) error) (merged int, err error) {
+	defer func(start time.Time) { observe("merge_document", start, err) }(time.Now())
+	defer s.lockWrites()()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, s.dialect.rebind(upsertDocumentAlias), alias.Alias, alias.Document)
+	if err != nil {
+		return 0, err
+	}
+
+	// read everything first, the transaction has a single connection
+	rows, err := tx.QueryContext(ctx, s.dialect.rebind(`
+	SELECT username, document, progress, percentage, device_id, device, timestamp
+	FROM progress
+	WHERE document = ?
+	`), from)
+	if err != nil {
+		return 0, err
+	}
+	var records []*ProgressRecord
+	for rows.Next() {
+		var rec ProgressRecord
+		err = rows.Scan(
+			&rec.User,
+			&rec.Document,
+			&rec.Progress.Progress,
+			&rec.Percentage,
+			&rec.DeviceID,
+			&rec.Device,
+			&rec.Timestamp)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		records = append(records, &rec)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, rec := range records {
+		err = move(rec.User, &rec.Progress)
+		if err != nil {
+			return 0, err
+		}
+		args := []any{
+			rec.User,
+			rec.Document,
+			rec.Progress.Progress,
+			rec.Percentage,
+			rec.DeviceID,
+			rec.Device,
+			rec.Timestamp,
+		}
+		res, err := tx.ExecContext(ctx, s.dialect.rebind(upsertProgress+updateIfNewer), args...)
+		if err != nil {
+			return 0, fmt.Errorf("merge [user=%s]: %s", rec.User, err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			continue
+		}
+		_, err = tx.ExecContext(ctx, s.dialect.rebind(upsertDeviceProgress), args...)
+		if err != nil {
+			return 0, fmt.Errorf("merge [user=%s]: %s", rec.User, err)
+		}
+		merged++
+	}
+
+	_, err = tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM progress WHERE document = ?`), from)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, s.dialect.rebind(`DELETE FROM device_progress WHERE document = ?`), from)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return merged, nil
+}
+
+func (s *sqlStore) ResolveDocumentAlias(ctx context.Context, alias string) (_ string, err error) {
+	defer func(start time.Time) { observe("resolve_document_alias", start, err) }(time.Now())
+	var document string
+	err = s.db.QueryRowContext(ctx, s.dialect.rebind(`SELECT document FROM document_aliases WHERE alias = ?`), alias).Scan(&document)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return document, err
+}
+
+func (s *sqlStore) ListDocumentAliases(ctx context.Context) (_ []*DocumentAlias, err error) {
+	defer func(start time.Time) { observe("list_document_aliases", start, err) }(time.Now())
+	rows, err := s.query(ctx, `SELECT alias, document FROM document_aliases ORDER BY document, alias`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := []*DocumentAlias{}
+	for rows.Next() {
+		var a DocumentAlias
+		err := rows.Scan(&a.Alias, &a.Document)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, &a)
+	}
+
+	return res, rows.Err()
+}
+
+func (s *sqlStore) DeleteDocumentAlias(ctx context.Context, alias string) (err error) {
+	defer func(start time.Time) { observe("delete_document_alias", start, err) }(time.Now())
+	defer s.lockWrites()()
+	res, err := s.exec(ctx, `DELETE FROM document_aliases WHERE alias = ?`, alias)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *sqlStore) Rewrite(ctx context.Context, r Rewriter) (changed int, err error) {
+	defer func(start time.Time) { observe("rewrite", start, err) }(time.Now())
+	defer s.lockWrites()()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"progress", "device_progress"} {
+		where := `username = ? AND document = ?`
+		if table == "device_progress" {
+			where += ` AND device_id = ?`
+		}
+		query := `SELECT username, document, progress, percentage, device_id, device, timestamp FROM ` + table
+		update := `UPDATE ` + table + ` SET document = ?, progress = ?, percentage = ?, device = ? WHERE ` + where
+		n, err := s.rewriteRows(ctx, tx, query, update, func(row scanner) ([]any, error) {
+			var rec ProgressRecord
+			err := row.Scan(
+				&rec.User,
+				&rec.Document,
+				&rec.Progress.Progress,
+				&rec.Percentage,
+				&rec.DeviceID,
+				&rec.Device,
+				&rec.Timestamp)
+			if err != nil {
+				return nil, err
+			}
+			p := rec.Progress
+			err = r.Progress(rec.User, &p)
+			if err != nil || p == rec.Progress {
+				return nil, err
+			}
+			args := []any{p.Document, p.Progress, p.Percentage, p.Device, rec.User, rec.Document}
+			if table == "device_progress" {
+				args = append(args, rec.DeviceID)
+			}
+			return args, nil
+		})
+		changed += n
+		if err != nil {
+			return 0, fmt.Errorf("rewrite %s: %s", table, err)
+		}
+	}
+
+	query := `SELECT ` + deviceColumns + ` FROM devices`
+	update := `UPDATE devices SET device = ?, label = ?, last_document = ?, last_ip = ? WHERE username = ? AND device_id = ?`
+	n, err := s.rewriteRows(ctx, tx, query, update, func(row scanner) ([]any, error) {
+		d, err := scanDevice(row)
+		if err != nil {
+			return nil, err
+		}
+		rewritten := *d
+		err = r.Device(&rewritten)
+		if err != nil || rewritten == *d {
+			return nil, err
+		}
+		return []any{rewritten.Name, rewritten.Label, rewritten.LastDocument, rewritten.LastIP, d.User, d.ID}, nil
+	})
+	changed += n
+	if err != nil {
+		return 0, fmt.Errorf("rewrite devices: %s", err)
+	}
+
+	return changed, tx.Commit()
+}
+
+// rewriteRows reads every row query returns and runs update for the rows fn
+// returns arguments for, nil leaves a row alone.
+func (s *sqlStore) rewriteRows(ctx context.Context, tx *sql.Tx, query string, update string, fn func(row scanner) ([]any, error)) (int, error) {
+	rows, err := tx.QueryContext(ctx, s.dialect.rebind(query))
+	if err != nil {
+		return 0, err
+	}
+	// updating while reading isn't portable, collect the updates first
+	var updates [][]any
+	for rows.Next() {
+		args, err := fn(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if args != nil {
+			updates = append(updates, args)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	update = s.dialect.rebind(update)
+	for _, args := range updates {
+		_, err = tx.ExecContext(ctx, update, args...)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(updates), nil
+}
+
+// Ping does a no-op write that is rolled back but still fails if the
+// database is read only.
+func (s *sqlStore) Ping(ctx context.Context) (err error) {
+	defer func(start time.Time) { observe("ping", start, err) }(time.Now())
+	var count int
+	err = s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM progress`).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("read: %s", err)
+	}
+
+	// a write stuck behind a long one fails the probe rather than the
+	// other way around
+	ctx, cancel := context.WithTimeout(ctx, pingWriteTimeout)
+	defer cancel()
+	unlock, err := s.lockWritesContext(ctx)
+	if err != nil {
+		return fmt.Errorf("write: %s", err)
+	}
+	defer unlock()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("write: begin transaction: %s", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `DELETE FROM progress WHERE 1 = 0`)
+	if err != nil {
+		return fmt.Errorf("write: %s", err)
+	}
+
+	return nil
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) EachProgress(ctx context.Context, user string, fn func(*ProgressRecord) error) (err error) {
+	defer func(start time.Time) { observe("each_progress", start, err) }(time.Now())
+	query := `
+	SELECT username, document, progress, percentage, device_id, device, timestamp
+	FROM progress
+	`
+	var args []any
+	if user != "" {
+		query += `WHERE username = ?
+	`
+		args = append(args, user)
+	}
+	rows, err := s.query(ctx, query+`ORDER BY username, document`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rec ProgressRecord
+		err = rows.Scan(
+			&rec.User,
+			&rec.Document,
+			&rec.Progress.Progress,
+			&rec.Percentage,
+			&rec.DeviceID,
+			&rec.Device,
+			&rec.Timestamp)
+		if err != nil {
+			return err
+		}
+		err = fn(&rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (s *sqlStore) ImportProgress(ctx context.Context, policy ConflictPolicy, next func() (*ProgressRecord, error)) (imported int, skipped int, err error) {
+	defer func(start time.Time) { observe("import_progress", start, err) }(time.Now())
+	var conflict string
+	switch policy {
+	case ConflictNewer:
+		conflict = updateIfNewer
+	case ConflictOverwrite:
+		conflict = `DO UPDATE SET
+			progress=excluded.progress,
+			percentage=excluded.percentage,
+			device_id=excluded.device_id,
+			device=excluded.device,
+			timestamp=excluded.timestamp`
+	case ConflictSkip:
+		conflict = `DO NOTHING`
+	default:
+		return 0, 0, fmt.Errorf("unknown conflict policy %q", policy)
+	}
+
+	defer s.lockWrites()()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, s.dialect.rebind(upsertProgress+conflict))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer stmt.Close()
+	deviceStmt, err := tx.PrepareContext(ctx, s.dialect.rebind(upsertDeviceProgress))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer deviceStmt.Close()
+
+	for {
+		rec, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		args := []any{
+			rec.User,
+			rec.Document,
+			rec.Progress.Progress,
+			rec.Percentage,
+			rec.DeviceID,
+			rec.Device,
+			rec.Timestamp,
+		}
+		res, err := stmt.ExecContext(ctx, args...)
+		if err != nil {
+			return 0, 0, fmt.Errorf("import [user=%s document=%s]: %s", rec.User, rec.Document, err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, 0, err
+		}
+		if n == 0 {
+			skipped++
+			continue
+		}
+		_, err = deviceStmt.ExecContext(ctx, args...)
+		if err != nil {
+			return 0, 0, fmt.Errorf("import [user=%s document=%s]: %s", rec.User, rec.Document, err)
+		}
+		imported++
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return imported, skipped, nil
+}
+
+// migrate brings the schema up to date. Migrations are numbered files
+// applied in a single transaction.
+func (s *sqlStore) migrate() error {
+	dir := path.Join("migrations", s.dialect.name)
+	entries, err := fs.ReadDir(migrations, dir)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current, err := s.dialect.schemaVersion(tx)
+	if err != nil {
+		return fmt.Errorf("get schema version: %s", err)
+	}
+
+	for _, entry := range entries {
+		prefix, _, _ := strings.Cut(entry.Name(), "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return fmt.Errorf("bad migration name %s", entry.Name())
+		}
+		if version <= current {
+			continue
+		}
+
+		stmts, err := migrations.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(string(stmts))
+		if err == nil {
+			err = s.dialect.setSchemaVersion(tx, version)
+		}
+		if err != nil {
+			return fmt.Errorf("apply migration %s: %s", entry.Name(), err)
+		}
+	}
+
+	return tx.Commit()
+}
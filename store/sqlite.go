@@ -0,0 +1,89 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var sqliteDialect = &dialect{
+	name:   "sqlite",
+	rebind: func(query string) string { return query },
+	// SQLite allows a single writer, waiting on a mutex is cheaper and
+	// fairer than polling the database lock
+	serializeWrites: true,
+	// SQLite keeps the version in the database header
+	schemaVersion: func(tx *sql.Tx) (int, error) {
+		var version int
+		err := tx.QueryRow(`PRAGMA user_version`).Scan(&version)
+		return version, err
+	},
+	setSchemaVersion: func(tx *sql.Tx, version int) error {
+		_, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version))
+		return err
+	},
+}
+
+var (
+	journalModes      = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+	synchronousLevels = []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+)
+
+// sqliteDSN adds the options to path as go-sqlite3 connection parameters
+// so every connection in the pool gets them.
+func sqliteDSN(path string, opts Options) (string, error) {
+	params := url.Values{}
+	// Take the write lock when a transaction starts instead of failing
+	// when a reading transaction tries to write
+	params.Set("_txlock", "immediate")
+	if opts.JournalMode != "" {
+		mode := strings.ToUpper(opts.JournalMode)
+		if !slices.Contains(journalModes, mode) {
+			return "", fmt.Errorf("unknown journal mode %q, expected one of %s", opts.JournalMode, strings.Join(journalModes, ", "))
+		}
+		params.Set("_journal_mode", mode)
+	}
+	if opts.Synchronous != "" {
+		level := strings.ToUpper(opts.Synchronous)
+		if !slices.Contains(synchronousLevels, level) {
+			return "", fmt.Errorf("unknown synchronous level %q, expected one of %s", opts.Synchronous, strings.Join(synchronousLevels, ", "))
+		}
+		params.Set("_synchronous", level)
+	}
+	if opts.BusyTimeout > 0 {
+		params.Set("_busy_timeout", strconv.FormatInt(opts.BusyTimeout.Milliseconds(), 10))
+	}
+
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + params.Encode(), nil
+}
+
+// OpenSQLite opens the SQLite database at path, creating it if needed.
+func OpenSQLite(path string, opts Options) (ProgressStore, error) {
+	dsn, err := sqliteDSN(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open database: %s", err)
+	}
+	setPoolSize(db, opts)
+
+	s := newSQLStore(db, sqliteDialect)
+	err = s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initialize database: %s", err)
+	}
+
+	return &sqliteStore{s}, nil
+}
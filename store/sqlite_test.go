@@ -0,0 +1,48 @@
+package store_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/ficoos/kokosync/store"
+	"github.com/ficoos/kokosync/store/storetest"
+)
+
+// openSQLite opens a new database file with the options kokosync runs
+// with, WAL included, so concurrency is tested the way it is deployed.
+func openSQLite(t *testing.T) (store.ProgressStore, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "kokosync.db")
+	s, err := store.OpenSQLite(path, store.DefaultOptions)
+	if err != nil {
+		t.Fatalf("open sqlite: %s", err)
+	}
+	return s, path
+}
+
+func TestSQLite(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.ProgressStore {
+		s, _ := openSQLite(t)
+		return s
+	})
+}
+
+func TestSQLiteJournalMode(t *testing.T) {
+	s, path := openSQLite(t)
+	defer s.Close()
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("open database: %s", err)
+	}
+	defer db.Close()
+	var mode string
+	err = db.QueryRow("PRAGMA journal_mode").Scan(&mode)
+	if err != nil {
+		t.Fatalf("query journal mode: %s", err)
+	}
+	if mode != "wal" {
+		t.Fatalf("journal mode is %q, expected wal", mode)
+	}
+}
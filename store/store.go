@@ -0,0 +1,285 @@
+// Package store persists reading progress. ProgressStore is implemented on
+// top of SQLite, PostgreSQL and in memory, Open picks one from a DSN.
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ficoos/kokosync/kosync"
+)
+
+// ErrNotFound is returned when there is no progress to get or delete.
+var ErrNotFound = errors.New("not found")
+
+type ProgressStore interface {
+	// UpdateProgress saves progress for user as the progress of the
+	// document and of the device, a zero timestamp means now.
+	UpdateProgress(ctx context.Context, user string, progress *kosync.Progress) error
+	GetProgress(ctx context.Context, user string, document string) (*kosync.Progress, error)
+	// ListProgress returns all of the user's progress, most recent first.
+	ListProgress(ctx context.Context, user string) ([]*kosync.Progress, error)
+	// ListDeviceProgress returns the latest progress every device of user
+	// saved for document, most recent first. GetProgress returns the one
+	// saved last.
+	ListDeviceProgress(ctx context.Context, user string, document string) ([]*kosync.Progress, error)
+	// EachProgress calls fn for every progress record of user, or of every
+	// user when user is empty.
+	EachProgress(ctx context.Context, user string, fn func(*ProgressRecord) error) error
+	ListUsers(ctx context.Context) ([]*UserSummary, error)
+	ListDocuments(ctx context.Context) ([]*DocumentSummary, error)
+	DeleteProgress(ctx context.Context, user string, document string) error
+	// DeleteUser removes everything stored for user, devices, tokens and
+	// aliases included, and returns the number of progress records deleted.
+	DeleteUser(ctx context.Context, user string) (int64, error)
+	// ClaimLegacyProgress assigns progress saved before progress was per
+	// user to user. Documents the user already has progress for are left
+	// alone.
+	ClaimLegacyProgress(ctx context.Context, user string) (int64, error)
+	// ImportProgress upserts every record returned by next until it returns
+	// io.EOF. Either every record is imported or none are. Imported records
+	// also update the progress of their device.
+	ImportProgress(ctx context.Context, policy ConflictPolicy, next func() (*ProgressRecord, error)) (imported int, skipped int, err error)
+	// SeenDevice records a sync by device, adding it to the registry the
+	// first time it is seen. A zero LastSeen means now, the label and the
+	// blocked flag are left alone.
+	SeenDevice(ctx context.Context, device *Device) error
+	GetDevice(ctx context.Context, user string, id string) (*Device, error)
+	// ListDevices returns the devices of user, or of every user when user
+	// is empty, most recently seen first.
+	ListDevices(ctx context.Context, user string) ([]*Device, error)
+	RenameDevice(ctx context.Context, user string, id string, label string) error
+	BlockDevice(ctx context.Context, user string, id string, blocked bool) error
+	// CreateToken saves a sync token, a zero Created means now.
+	CreateToken(ctx context.Context, token *Token) error
+	// FindToken returns the token of user with hash, ErrNotFound when there
+	// is none.
+	FindToken(ctx context.Context, user string, hash string) (*Token, error)
+	// ListTokens returns the tokens of user, or of every user when user is
+	// empty, oldest first.
+	ListTokens(ctx context.Context, user string) ([]*Token, error)
+	// UseToken records the last time a token was used.
+	UseToken(ctx context.Context, user string, id string, when int64) error
+	RevokeToken(ctx context.Context, user string, id string) error
+	// SetAlias makes alias.Alias log in as alias.User, replacing what it
+	// mapped to before.
+	SetAlias(ctx context.Context, alias *Alias) error
+	// ResolveAlias returns the user alias logs in as, ErrNotFound when it
+	// isn't an alias.
+	ResolveAlias(ctx context.Context, alias string) (string, error)
+	// ListAliases returns every alias ordered by user.
+	ListAliases(ctx context.Context) ([]*Alias, error)
+	DeleteAlias(ctx context.Context, alias string) error
+	// SetDocumentAlias makes progress of alias.Alias the progress of
+	// alias.Document, replacing what it mapped to before. Progress saved
+	// under the alias is left alone.
+	SetDocumentAlias(ctx context.Context, alias *DocumentAlias) error
+	// MergeDocument saves alias and moves the progress every user saved
+	// under alias.Alias to alias.Document, unless the progress of the
+	// document is newer, in a single transaction. Only the latest progress
+	// of the alias is kept, not that of every device. It returns the number
+	// of records moved.
+	MergeDocument(ctx context.Context, alias *DocumentAlias) (int, error)
+	// ResolveDocumentAlias returns the document alias shares progress with,
+	// ErrNotFound when it isn't an alias.
+	ResolveDocumentAlias(ctx context.Context, alias string) (string, error)
+	// ListDocumentAliases returns every document alias ordered by document.
+	ListDocumentAliases(ctx context.Context) ([]*DocumentAlias, error)
+	DeleteDocumentAlias(ctx context.Context, alias string) error
+	// Rewrite passes every stored progress record, device progress record
+	// and device through r in a single transaction and saves the ones r
+	// changed. It returns the number of values changed.
+	Rewrite(ctx context.Context, r Rewriter) (int, error)
+	// Ping checks the store can be read and written to.
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// resealer is implemented by the stores Encrypt wraps for the methods that
+// move progress to another document or user, which changes what encrypted
+// progress is sealed for. move gets each record as it is stored and turns
+// it into the record to store. mergeDocument is MergeDocument for progress
+// stored under from.
+type resealer interface {
+	mergeDocument(ctx context.Context, alias *DocumentAlias, from string, move func(user string, p *kosync.Progress) error) (int, error)
+	claimLegacyProgress(ctx context.Context, user string, move func(p *kosync.Progress) error) (int64, error)
+}
+
+// ProgressRecord is a progress record along with its owner. It marshals to
+// the kosync.Progress JSON shape with an extra user field.
+type ProgressRecord struct {
+	User string `json:"user"`
+	kosync.Progress
+}
+
+type UserSummary struct {
+	User      string `json:"user"`
+	Documents int    `json:"documents"`
+	LastSync  int64  `json:"last_sync"`
+}
+
+type DocumentSummary struct {
+	Document string `json:"document"`
+	Users    int    `json:"users"`
+	LastSync int64  `json:"last_sync"`
+}
+
+// Device is a device that synced progress for a user.
+type Device struct {
+	User string `json:"user"`
+	ID   string `json:"device_id"`
+	// Name is the name the device reported last
+	Name string `json:"device"`
+	// Label is a name given by the user, it survives syncs
+	Label        string `json:"label"`
+	FirstSeen    int64  `json:"first_seen"`
+	LastSeen     int64  `json:"last_seen"`
+	LastDocument string `json:"last_document"`
+	LastIP       string `json:"last_ip"`
+	// Blocked devices can't push progress
+	Blocked bool `json:"blocked"`
+}
+
+// Token is a sync token a device authenticates with in place of the
+// Komga password.
+type Token struct {
+	User string `json:"user"`
+	ID   string `json:"id"`
+	// Name tells tokens apart, usually it names the device
+	Name string `json:"name"`
+	// Hash is the SHA-256 of the key the device sends, the token itself
+	// isn't stored
+	Hash     string `json:"-"`
+	Created  int64  `json:"created"`
+	LastUsed int64  `json:"last_used"`
+}
+
+// Alias maps a login name to the user its progress is stored under.
+type Alias struct {
+	Alias string `json:"alias"`
+	User  string `json:"user"`
+}
+
+// DocumentAlias is another hash of a document, e.g. from a different hash
+// method or an edited copy of the file.
+type DocumentAlias struct {
+	Alias    string `json:"alias"`
+	Document string `json:"document"`
+}
+
+// Rewriter changes stored values in place, it sees them as they are stored.
+type Rewriter struct {
+	// Progress may change anything but the device ID and the timestamp
+	Progress func(user string, p *kosync.Progress) error
+	// Device may change the name, the label, the last document and the
+	// last IP
+	Device func(d *Device) error
+}
+
+// ConflictPolicy decides what happens when an imported record is for a
+// document the user already has progress for.
+type ConflictPolicy string
+
+const (
+	// ConflictNewer keeps whichever record has the later timestamp
+	ConflictNewer     ConflictPolicy = "newer"
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictSkip      ConflictPolicy = "skip"
+)
+
+func ParseConflictPolicy(raw string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(raw); p {
+	case ConflictNewer, ConflictOverwrite, ConflictSkip:
+		return p, nil
+	case "":
+		return ConflictNewer, nil
+	}
+
+	return "", fmt.Errorf("unknown conflict policy %q, expected one of newer, overwrite or skip", raw)
+}
+
+// Observer is notified about the outcome of every query.
+type Observer func(query string, elapsed time.Duration, err error)
+
+var observer Observer
+
+// SetObserver sets a function to be called after every query of every
+// store.
+func SetObserver(o Observer) {
+	observer = o
+}
+
+// observe reports a query started at start, not finding a row is not a
+// query failure.
+func observe(query string, start time.Time, err error) {
+	if observer == nil {
+		return
+	}
+	if errors.Is(err, ErrNotFound) {
+		err = nil
+	}
+	observer(query, time.Since(start), err)
+}
+
+// Options tune the SQL stores, zero values keep the defaults.
+type Options struct {
+	MaxOpenConns int
+	MaxIdleConns int
+
+	// Cipher encrypts progress when set, see Encrypt
+	Cipher *Cipher
+
+	// SQLite only, see https://sqlite.org/pragma.html
+	JournalMode string
+	Synchronous string
+	BusyTimeout time.Duration
+}
+
+// DefaultOptions suit a single kokosync instance syncing a handful of
+// devices.
+var DefaultOptions = Options{
+	JournalMode: "WAL",
+	Synchronous: "NORMAL",
+	BusyTimeout: 5 * time.Second,
+}
+
+// Open opens the store described by dsn: postgres:// and postgresql:// URLs
+// are PostgreSQL connection strings, memory: is an in-memory store and
+// anything else is a path to a SQLite database.
+func Open(dsn string, opts Options) (ProgressStore, error) {
+	s, err := open(dsn, opts)
+	if err != nil || opts.Cipher == nil {
+		return s, err
+	}
+	encrypted, err := Encrypt(context.Background(), s, opts.Cipher)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return encrypted, nil
+}
+
+func open(dsn string, opts Options) (ProgressStore, error) {
+	if dsn == "memory:" {
+		return NewMemory(), nil
+	}
+	if path, ok := SQLitePath(dsn); ok {
+		return OpenSQLite(path, opts)
+	}
+
+	return OpenPostgres(dsn, opts)
+}
+
+// SQLitePath returns the path of the SQLite database dsn names, if it
+// names one.
+func SQLitePath(dsn string) (string, bool) {
+	if dsn == "memory:" || strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return "", false
+	}
+
+	return strings.TrimPrefix(dsn, "sqlite:"), true
+}
@@ -0,0 +1,892 @@
+// Package storetest is a conformance suite every store.ProgressStore
+// implementation must pass.
+//
+//	func TestMemory(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) store.ProgressStore {
+//			return store.NewMemory()
+//		})
+//	}
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ficoos/kokosync/kosync"
+	"github.com/ficoos/kokosync/store"
+)
+
+// Run runs the suite, open must return a new empty store every time it is
+// called.
+func Run(t *testing.T, open func(t *testing.T) store.ProgressStore) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s store.ProgressStore)
+	}{
+		{"GetMissing", testGetMissing},
+		{"UpdateAndGet", testUpdateAndGet},
+		{"DefaultTimestamp", testDefaultTimestamp},
+		{"PerUser", testPerUser},
+		{"ListProgress", testListProgress},
+		{"EachProgress", testEachProgress},
+		{"Summaries", testSummaries},
+		{"DeleteProgress", testDeleteProgress},
+		{"DeleteUser", testDeleteUser},
+		{"ClaimLegacyProgress", testClaimLegacyProgress},
+		{"ImportPolicies", testImportPolicies},
+		{"ImportIsAtomic", testImportIsAtomic},
+		{"DeviceProgress", testDeviceProgress},
+		{"Devices", testDevices},
+		{"DeleteUserDevices", testDeleteUserDevices},
+		{"Rewrite", testRewrite},
+		{"Tokens", testTokens},
+		{"Aliases", testAliases},
+		{"DocumentAliases", testDocumentAliases},
+		{"MergeDocument", testMergeDocument},
+		{"Ping", testPing},
+		{"ConcurrentUpdates", testConcurrentUpdates},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := open(t)
+			t.Cleanup(func() { s.Close() })
+			tt.fn(t, s)
+		})
+	}
+}
+
+func progress(document string, percentage float64, timestamp int64) *kosync.Progress {
+	return &kosync.Progress{
+		Document:   document,
+		Progress:   "/body/DocFragment[3]/body/p[1]/text().0",
+		Percentage: percentage,
+		Device:     "kobo",
+		DeviceID:   "K1",
+		Timestamp:  timestamp,
+	}
+}
+
+func mustUpdate(t *testing.T, s store.ProgressStore, user string, p *kosync.Progress) {
+	t.Helper()
+	err := s.UpdateProgress(context.Background(), user, p)
+	if err != nil {
+		t.Fatalf("update progress [user=%s document=%s]: %s", user, p.Document, err)
+	}
+}
+
+func mustGet(t *testing.T, s store.ProgressStore, user string, document string) *kosync.Progress {
+	t.Helper()
+	p, err := s.GetProgress(context.Background(), user, document)
+	if err != nil {
+		t.Fatalf("get progress [user=%s document=%s]: %s", user, document, err)
+	}
+	return p
+}
+
+func testGetMissing(t *testing.T, s store.ProgressStore) {
+	_, err := s.GetProgress(context.Background(), "alice", "doc")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func testUpdateAndGet(t *testing.T, s store.ProgressStore) {
+	want := progress("doc", 0.25, 100)
+	mustUpdate(t, s, "alice", want)
+	got := mustGet(t, s, "alice", "doc")
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	want = progress("doc", 0.5, 200)
+	want.Device = "phone"
+	want.DeviceID = "P1"
+	mustUpdate(t, s, "alice", want)
+	got = mustGet(t, s, "alice", "doc")
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("after update got %+v, want %+v", got, want)
+	}
+}
+
+func testDefaultTimestamp(t *testing.T, s store.ProgressStore) {
+	before := time.Now().Unix()
+	mustUpdate(t, s, "alice", progress("doc", 0.25, 0))
+	got := mustGet(t, s, "alice", "doc")
+	if got.Timestamp < before || got.Timestamp > time.Now().Unix() {
+		t.Fatalf("expected a timestamp of now, got %d", got.Timestamp)
+	}
+}
+
+func testPerUser(t *testing.T, s store.ProgressStore) {
+	mustUpdate(t, s, "alice", progress("doc", 0.25, 100))
+	mustUpdate(t, s, "bob", progress("doc", 0.75, 200))
+
+	if p := mustGet(t, s, "alice", "doc"); p.Percentage != 0.25 {
+		t.Errorf("alice sees %v", p.Percentage)
+	}
+	if p := mustGet(t, s, "bob", "doc"); p.Percentage != 0.75 {
+		t.Errorf("bob sees %v", p.Percentage)
+	}
+	_, err := s.GetProgress(context.Background(), "carol", "doc")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("carol: expected ErrNotFound, got %v", err)
+	}
+}
+
+func documents(progress []*kosync.Progress) []string {
+	res := []string{}
+	for _, p := range progress {
+		res = append(res, p.Document)
+	}
+	return res
+}
+
+func testListProgress(t *testing.T, s store.ProgressStore) {
+	ctx := context.Background()
+	list, err := s.ListProgress(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list == nil || len(list) != 0 {
+		t.Fatalf("expected an empty list, got %v", list)
+	}
+
+	mustUpdate(t, s, "alice", progress("b", 0.1, 100))
+	mustUpdate(t, s, "alice", progress("c", 0.1, 300))
+	mustUpdate(t, s, "alice", progress("a", 0.1, 100))
+	mustUpdate(t, s, "bob", progress("d", 0.1, 400))
+
+	list, err = s.ListProgress(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// most recent first, then by document
+	want := []string{"c", "a", "b"}
+	if got := documents(list); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func collect(t *testing.T, s store.ProgressStore, user string) []string {
+	t.Helper()
+	var res []string
+	err := s.EachProgress(context.Background(), user, func(rec *store.ProgressRecord) error {
+		res = append(res, rec.User+"/"+rec.Document)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("each progress [user=%s]: %s", user, err)
+	}
+	return res
+}
+
+func testEachProgress(t *testing.T, s store.ProgressStore) {
+	mustUpdate(t, s, "bob", progress("a", 0.1, 100))
+	mustUpdate(t, s, "alice", progress("b", 0.1, 100))
+	mustUpdate(t, s, "alice", progress("a", 0.1, 200))
+
+	want := []string{"alice/a", "alice/b", "bob/a"}
+	if got := collect(t, s, ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("every user: got %v, want %v", got, want)
+	}
+	want = []string{"bob/a"}
+	if got := collect(t, s, "bob"); !reflect.DeepEqual(got, want) {
+		t.Errorf("bob: got %v, want %v", got, want)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err := s.EachProgress(context.Background(), "", func(rec *store.ProgressRecord) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("expected the callback error after one call, got %v after %d", err, calls)
+	}
+}
+
+func testSummaries(t *testing.T, s store.ProgressStore) {
+	ctx := context.Background()
+	mustUpdate(t, s, "bob", progress("a", 0.1, 100))
+	mustUpdate(t, s, "alice", progress("a", 0.1, 300))
+	mustUpdate(t, s, "alice", progress("b", 0.1, 200))
+
+	users, err := s.ListUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantUsers := []*store.UserSummary{
+		{User: "alice", Documents: 2, LastSync: 300},
+		{User: "bob", Documents: 1, LastSync: 100},
+	}
+	if !reflect.DeepEqual(users, wantUsers) {
+		t.Errorf("users: got %+v, want %+v", users, wantUsers)
+	}
+
+	docs, err := s.ListDocuments(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDocs := []*store.DocumentSummary{
+		{Document: "a", Users: 2, LastSync: 300},
+		{Document: "b", Users: 1, LastSync: 200},
+	}
+	if !reflect.DeepEqual(docs, wantDocs) {
+		t.Errorf("documents: got %+v, want %+v", docs, wantDocs)
+	}
+}
+
+func testDeleteProgress(t *testing.T, s store.ProgressStore) {
+	ctx := context.Background()
+	mustUpdate(t, s, "alice", progress("doc", 0.1, 100))
+	mustUpdate(t, s, "bob", progress("doc", 0.1, 100))
+
+	err := s.DeleteProgress(ctx, "alice", "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.DeleteProgress(ctx, "alice", "doc")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("second delete: expected ErrNotFound, got %v", err)
+	}
+	mustGet(t, s, "bob", "doc")
+}
+
+func testDeleteUser(t *testing.T, s store.ProgressStore) {
+	ctx := context.Background()
+	mustUpdate(t, s, "alice", progress("a", 0.1, 100))
+	mustUpdate(t, s, "alice", progress("b", 0.1, 100))
+	mustUpdate(t, s, "bob", progress("a", 0.1, 100))
+
+	n, err := s.DeleteUser(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 deleted, got %d", n)
+	}
+	n, err = s.DeleteUser(ctx, "alice")
+	if err != nil || n != 0 {
+		t.Errorf("deleting again: got %d, %v", n, err)
+	}
+	if got := collect(t, s, ""); !reflect.DeepEqual(got, []string{"bob/a"}) {
+		t.Errorf("left over: %v", got)
+	}
+}
+
+func testClaimLegacyProgress(t *testing.T, s store.ProgressStore) {
+	ctx := context.Background()
+	mustUpdate(t, s, "", progress("a", 0.1, 100))
+	mustUpdate(t, s, "", progress("b", 0.1, 100))
+	mustUpdate(t, s, "alice", progress("b", 0.9, 200))
+
+	n, err := s.ClaimLegacyProgress(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 claimed, got %d", n)
+	}
+	// the user's own progress wins and the legacy record stays unowned
+	if p := mustGet(t, s, "alice", "b"); p.Percentage != 0.9 {
+		t.Errorf("claim overwrote alice's progress: %+v", p)
+	}
+	want := []string{"/b", "alice/a", "alice/b"}
+	if got := collect(t, s, ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// records returns a next function for ImportProgress.
+func records(recs ...*store.ProgressRecord) func() (*store.ProgressRecord, error) {
+	return func() (*store.ProgressRecord, error) {
+		if len(recs) == 0 {
+			return nil, io.EOF
+		}
+		rec := recs[0]
+		recs = recs[1:]
+		return rec, nil
+	}
+}
+
+func record(user string, p *kosync.Progress) *store.ProgressRecord {
+	return &store.ProgressRecord{User: user, Progress: *p}
+}
+
+func testImportPolicies(t *testing.T, s store.ProgressStore) {
+	ctx := context.Background()
+	for _, tt := range []struct {
+		policy             store.ConflictPolicy
+		imported, skipped  int
+		older, newer, same float64
+	}{
+		{store.ConflictNewer, 2, 1, 0.5, 0.6, 0.5},
+		{store.ConflictOverwrite, 3, 0, 0.1, 0.6, 0.5},
+		{store.ConflictSkip, 1, 2, 0.5, 0.5, 0.5},
+	} {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			user := "user-" + string(tt.policy)
+			mustUpdate(t, s, user, progress("older", 0.5, 200))
+			mustUpdate(t, s, user, progress("newer", 0.5, 200))
+
+			imported, skipped, err := s.ImportProgress(ctx, tt.policy, records(
+				record(user, progress("older", 0.1, 100)),
+				record(user, progress("newer", 0.6, 300)),
+				record(user, progress("new", 0.5, 100)),
+			))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if imported != tt.imported || skipped != tt.skipped {
+				t.Errorf("got %d imported %d skipped, want %d and %d", imported, skipped, tt.imported, tt.skipped)
+			}
+			if p := mustGet(t, s, user, "older"); p.Percentage != tt.older {
+				t.Errorf("older: got %v, want %v", p.Percentage, tt.older)
+			}
+			if p := mustGet(t, s, user, "newer"); p.Percentage != tt.newer {
+				t.Errorf("newer: got %v, want %v", p.Percentage, tt.newer)
+			}
+			if p := mustGet(t, s, user, "new"); p.Percentage != tt.same {
+				t.Errorf("new: got %v, want %v", p.Percentage, tt.same)
+			}
+		})
+	}
+
+	_, _, err := s.ImportProgress(ctx, "bogus", records())
+	if err == nil {
+		t.Error("expected an unknown policy to fail")
+	}
+}
+
+func testImportIsAtomic(t *testing.T, s store.ProgressStore) {
+	ctx := context.Background()
+	mustUpdate(t, s, "alice", progress("a", 0.5, 100))
+
+	broken := errors.New("broken")
+	recs := records(
+		record("alice", progress("a", 0.9, 200)),
+		record("alice", progress("b", 0.9, 200)),
+	)
+	_, _, err := s.ImportProgress(ctx, store.ConflictOverwrite, func() (*store.ProgressRecord, error) {
+		rec, err := recs()
+		if errors.Is(err, io.EOF) {
+			return nil, broken
+		}
+		return rec, err
+	})
+	if !errors.Is(err, broken) {
+		t.Fatalf("expected the reader error, got %v", err)
+	}
+	if p := mustGet(t, s, "alice", "a"); p.Percentage != 0.5 {
+		t.Errorf("failed import changed progress: %+v", p)
+	}
+	_, err = s.GetProgress(ctx, "alice", "b")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("failed import added progress: %v", err)
+	}
+}
+
+func testDeviceProgress(t *testing.T, s store.ProgressStore) {
+	ctx := context.Background()
+	kobo := progress("a", 0.5, 100)
+	phone := progress("a", 0.2, 200)
+	phone.Device, phone.DeviceID = "phone", "P1"
+	mustUpdate(t, s, "alice", kobo)
+	mustUpdate(t, s, "alice", phone)
+	mustUpdate(t, s, "alice", progress("b", 0.9, 300))
+	mustUpdate(t, s, "bob", progress("a", 0.7, 400))
+
+	if got := mustGet(t, s, "alice", "a"); got.DeviceID != "P1" {
+		t.Fatalf("expected the last saved progress to win, got %+v", got)
+	}
+	positions, err := s.ListDeviceProgress(ctx, "alice", "a")
+	if err != nil {
+		t.Fatalf("list device progress: %s", err)
+	}
+	if !reflect.DeepEqual(positions, []*kosync.Progress{phone, kobo}) {
+		t.Fatalf("expected both devices most recent first, got %+v", positions)
+	}
+
+	// imports update the device they came from
+	_, _, err = s.ImportProgress(ctx, store.ConflictNewer, records(record("alice", progress("a", 0.6, 500))))
+	if err != nil {
+		t.Fatalf("import: %s", err)
+	}
+	positions, err = s.ListDeviceProgress(ctx, "alice", "a")
+	if err != nil {
+		t.Fatalf("list device progress: %s", err)
+	}
+	if len(positions) != 2 || positions[0].DeviceID != "K1" || positions[0].Percentage != 0.6 {
+		t.Fatalf("expected the imported progress first, got %+v", positions)
+	}
+
+	err = s.DeleteProgress(ctx, "alice", "a")
+	if err != nil {
+		t.Fatalf("delete progress: %s", err)
+	}
+	positions, err = s.ListDeviceProgress(ctx, "alice", "a")
+	if err != nil {
+		t.Fatalf("list device progress: %s", err)
+	}
+	if len(positions) != 0 {
+		t.Fatalf("expected deleting progress to forget the devices, got %+v", positions)
+	}
+	positions, err = s.ListDeviceProgress(ctx, "bob", "a")
+	if err != nil {
+		t.Fatalf("list device progress: %s", err)
+	}
+	if len(positions) != 1 {
+		t.Fatalf("expected bob's progress to stay, got %+v", positions)
+	}
+}
+
+func mustSeeDevice(t *testing.T, s store.ProgressStore, d store.Device) {
+	t.Helper()
+	err := s.SeenDevice(context.Background(), &d)
+	if err != nil {
+		t.Fatalf("seen device [user=%s device=%s]: %s", d.User, d.ID, err)
+	}
+}
+
+func testDevices(t *testing.T, s store.ProgressStore) {
+	ctx := context.Background()
+	_, err := s.GetDevice(ctx, "alice", "K1")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	err = s.RenameDevice(ctx, "alice", "K1", "mine")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("rename missing device: expected ErrNotFound, got %v", err)
+	}
+
+	mustSeeDevice(t, s, store.Device{User: "alice", ID: "K1", Name: "kobo", LastSeen: 100, LastDocument: "a", LastIP: "192.0.2.1"})
+	mustSeeDevice(t, s, store.Device{User: "alice", ID: "P1", Name: "phone", LastSeen: 150, LastDocument: "b", LastIP: "192.0.2.2"})
+	mustSeeDevice(t, s, store.Device{User: "bob", ID: "K1", Name: "kindle", LastSeen: 120, LastDocument: "c"})
+	err = s.RenameDevice(ctx, "alice", "K1", "bedside")
+	if err != nil {
+		t.Fatalf("rename device: %s", err)
+	}
+	err = s.BlockDevice(ctx, "alice", "K1", true)
+	if err != nil {
+		t.Fatalf("block device: %s", err)
+	}
+	// a later sync updates what the device reported but keeps the label
+	// and the blocked flag
+	mustSeeDevice(t, s, store.Device{User: "alice", ID: "K1", Name: "kobo libra", LastSeen: 200, LastDocument: "d", LastIP: "192.0.2.3"})
+
+	d, err := s.GetDevice(ctx, "alice", "K1")
+	if err != nil {
+		t.Fatalf("get device: %s", err)
+	}
+	expected := &store.Device{
+		User:         "alice",
+		ID:           "K1",
+		Name:         "kobo libra",
+		Label:        "bedside",
+		FirstSeen:    100,
+		LastSeen:     200,
+		LastDocument: "d",
+		LastIP:       "192.0.2.3",
+		Blocked:      true,
+	}
+	if !reflect.DeepEqual(d, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, d)
+	}
+
+	devices, err := s.ListDevices(ctx, "alice")
+	if err != nil {
+		t.Fatalf("list devices: %s", err)
+	}
+	if len(devices) != 2 || devices[0].ID != "K1" || devices[1].ID != "P1" {
+		t.Fatalf("expected alice's devices most recent first, got %+v", devices)
+	}
+	devices, err = s.ListDevices(ctx, "")
+	if err != nil {
+		t.Fatalf("list all devices: %s", err)
+	}
+	if len(devices) != 3 || devices[2].User != "bob" || devices[2].Name != "kindle" {
+		t.Fatalf("expected every device by user, got %+v", devices)
+	}
+
+	err = s.BlockDevice(ctx, "alice", "K1", false)
+	if err != nil {
+		t.Fatalf("unblock device: %s", err)
+	}
+	d, err = s.GetDevice(ctx, "alice", "K1")
+	if err != nil {
+		t.Fatalf("get device: %s", err)
+	}
+	if d.Blocked {
+		t.Fatalf("expected device to be unblocked")
+	}
+}
+
+func testDeleteUserDevices(t *testing.T, s store.ProgressStore) {
+	ctx := context.Background()
+	mustSeeDevice(t, s, store.Device{User: "alice", ID: "K1", Name: "kobo", LastSeen: 100})
+	mustSeeDevice(t, s, store.Device{User: "bob", ID: "K1", Name: "kobo", LastSeen: 100})
+	_, err := s.DeleteUser(ctx, "alice")
+	if err != nil {
+		t.Fatalf("delete user: %s", err)
+	}
+
+	_, err = s.GetDevice(ctx, "alice", "K1")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected alice's device to be gone, got %v", err)
+	}
+	_, err = s.GetDevice(ctx, "bob", "K1")
+	if err != nil {
+		t.Fatalf("expected bob's device to stay: %s", err)
+	}
+}
+
+func testRewrite(t *testing.T, s store.ProgressStore) {
+	ctx := context.Background()
+	mustUpdate(t, s, "alice", progress("a", 0.5, 100))
+	mustUpdate(t, s, "alice", progress("b", 0.2, 200))
+	mustSeeDevice(t, s, store.Device{User: "alice", ID: "K1", Name: "kobo", LastDocument: "b"})
+
+	changed, err := s.Rewrite(ctx, store.Rewriter{
+		Progress: func(user string, p *kosync.Progress) error {
+			if p.Document == "a" {
+				p.Progress = "rewritten"
+			}
+			return nil
+		},
+		Device: func(d *store.Device) error {
+			d.LastDocument = "c"
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("rewrite: %s", err)
+	}
+	// the progress and the device progress of a, and the device
+	if changed != 3 {
+		t.Fatalf("expected 3 changes, got %d", changed)
+	}
+	if got := mustGet(t, s, "alice", "a"); got.Progress != "rewritten" || got.Timestamp != 100 {
+		t.Fatalf("expected a to be rewritten, got %+v", got)
+	}
+	if got := mustGet(t, s, "alice", "b"); got.Progress != "/body/DocFragment[3]/body/p[1]/text().0" {
+		t.Fatalf("expected b to stay, got %+v", got)
+	}
+	positions, err := s.ListDeviceProgress(ctx, "alice", "a")
+	if err != nil {
+		t.Fatalf("list device progress: %s", err)
+	}
+	if len(positions) != 1 || positions[0].Progress != "rewritten" {
+		t.Fatalf("expected the device progress to be rewritten, got %+v", positions)
+	}
+	d, err := s.GetDevice(ctx, "alice", "K1")
+	if err != nil {
+		t.Fatalf("get device: %s", err)
+	}
+	if d.LastDocument != "c" {
+		t.Fatalf("expected the device to be rewritten, got %+v", d)
+	}
+
+	// a failing rewrite changes nothing
+	boom := errors.New("boom")
+	_, err = s.Rewrite(ctx, store.Rewriter{
+		Progress: func(user string, p *kosync.Progress) error {
+			if p.Document == "b" {
+				return boom
+			}
+			p.Progress = "lost"
+			return nil
+		},
+		Device: func(d *store.Device) error { return nil },
+	})
+	if err == nil {
+		t.Fatal("expected the rewrite to fail")
+	}
+	if got := mustGet(t, s, "alice", "a"); got.Progress != "rewritten" {
+		t.Fatalf("expected the failed rewrite to be rolled back, got %+v", got)
+	}
+}
+
+func testTokens(t *testing.T, s store.ProgressStore) {
+	ctx := context.Background()
+	for _, token := range []store.Token{
+		{User: "alice", ID: "t2", Name: "phone", Hash: "h2", Created: 200},
+		{User: "alice", ID: "t1", Name: "kobo", Hash: "h1", Created: 100},
+		{User: "bob", ID: "t1", Name: "kindle", Hash: "h3", Created: 300},
+	} {
+		err := s.CreateToken(ctx, &token)
+		if err != nil {
+			t.Fatalf("create token: %s", err)
+		}
+	}
+	err := s.CreateToken(ctx, &store.Token{User: "bob", ID: "t9", Hash: "h1"})
+	if err == nil {
+		t.Fatal("expected hashes to be unique")
+	}
+
+	found, err := s.FindToken(ctx, "alice", "h1")
+	if err != nil {
+		t.Fatalf("find token: %s", err)
+	}
+	if found.ID != "t1" || found.Name != "kobo" {
+		t.Fatalf("found the wrong token: %+v", found)
+	}
+	_, err = s.FindToken(ctx, "bob", "h1")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected tokens to be per user, got %v", err)
+	}
+
+	err = s.UseToken(ctx, "alice", "t1", 500)
+	if err != nil {
+		t.Fatalf("use token: %s", err)
+	}
+	tokens, err := s.ListTokens(ctx, "alice")
+	if err != nil {
+		t.Fatalf("list tokens: %s", err)
+	}
+	want := []*store.Token{
+		{User: "alice", ID: "t1", Name: "kobo", Hash: "h1", Created: 100, LastUsed: 500},
+		{User: "alice", ID: "t2", Name: "phone", Hash: "h2", Created: 200},
+	}
+	if !reflect.DeepEqual(tokens, want) {
+		t.Fatalf("got %+v, want %+v", tokens, want)
+	}
+	tokens, err = s.ListTokens(ctx, "")
+	if err != nil {
+		t.Fatalf("list tokens: %s", err)
+	}
+	if len(tokens) != 3 {
+		t.Fatalf("expected every token, got %+v", tokens)
+	}
+
+	err = s.RevokeToken(ctx, "alice", "t1")
+	if err != nil {
+		t.Fatalf("revoke token: %s", err)
+	}
+	_, err = s.FindToken(ctx, "alice", "h1")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected the token to be revoked, got %v", err)
+	}
+	err = s.RevokeToken(ctx, "alice", "t1")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected revoking twice to be not found, got %v", err)
+	}
+
+	_, err = s.DeleteUser(ctx, "bob")
+	if err != nil {
+		t.Fatalf("delete user: %s", err)
+	}
+	_, err = s.FindToken(ctx, "bob", "h3")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected deleting the user to revoke the tokens, got %v", err)
+	}
+}
+
+func testAliases(t *testing.T, s store.ProgressStore) {
+	ctx := context.Background()
+	for _, alias := range []store.Alias{
+		{Alias: "alice@old.example", User: "alice@example.com"},
+		{Alias: "ally", User: "bob"},
+		{Alias: "ally", User: "alice@example.com"},
+		{Alias: "bobby", User: "bob"},
+	} {
+		err := s.SetAlias(ctx, &alias)
+		if err != nil {
+			t.Fatalf("set alias: %s", err)
+		}
+	}
+
+	user, err := s.ResolveAlias(ctx, "ally")
+	if err != nil {
+		t.Fatalf("resolve alias: %s", err)
+	}
+	if user != "alice@example.com" {
+		t.Fatalf("expected setting an alias again to replace it, got %s", user)
+	}
+	_, err = s.ResolveAlias(ctx, "alice@example.com")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected users not to be aliases, got %v", err)
+	}
+
+	aliases, err := s.ListAliases(ctx)
+	if err != nil {
+		t.Fatalf("list aliases: %s", err)
+	}
+	want := []*store.Alias{
+		{Alias: "alice@old.example", User: "alice@example.com"},
+		{Alias: "ally", User: "alice@example.com"},
+		{Alias: "bobby", User: "bob"},
+	}
+	if !reflect.DeepEqual(aliases, want) {
+		t.Fatalf("got %+v, want %+v", aliases, want)
+	}
+
+	err = s.DeleteAlias(ctx, "ally")
+	if err != nil {
+		t.Fatalf("delete alias: %s", err)
+	}
+	err = s.DeleteAlias(ctx, "ally")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected deleting twice to be not found, got %v", err)
+	}
+
+	_, err = s.DeleteUser(ctx, "bob")
+	if err != nil {
+		t.Fatalf("delete user: %s", err)
+	}
+	_, err = s.ResolveAlias(ctx, "bobby")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected deleting the user to delete the aliases, got %v", err)
+	}
+}
+
+func testDocumentAliases(t *testing.T, s store.ProgressStore) {
+	ctx := context.Background()
+	for _, alias := range []store.DocumentAlias{
+		{Alias: "c", Document: "b"},
+		{Alias: "c", Document: "a"},
+		{Alias: "d", Document: "a"},
+		{Alias: "e", Document: "b"},
+	} {
+		err := s.SetDocumentAlias(ctx, &alias)
+		if err != nil {
+			t.Fatalf("set document alias: %s", err)
+		}
+	}
+
+	document, err := s.ResolveDocumentAlias(ctx, "c")
+	if err != nil {
+		t.Fatalf("resolve document alias: %s", err)
+	}
+	if document != "a" {
+		t.Fatalf("expected setting an alias again to replace it, got %s", document)
+	}
+	_, err = s.ResolveDocumentAlias(ctx, "a")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected documents not to be aliases, got %v", err)
+	}
+
+	err = s.DeleteDocumentAlias(ctx, "d")
+	if err != nil {
+		t.Fatalf("delete document alias: %s", err)
+	}
+	err = s.DeleteDocumentAlias(ctx, "d")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected deleting twice to be not found, got %v", err)
+	}
+
+	aliases, err := s.ListDocumentAliases(ctx)
+	if err != nil {
+		t.Fatalf("list document aliases: %s", err)
+	}
+	want := []*store.DocumentAlias{{Alias: "c", Document: "a"}, {Alias: "e", Document: "b"}}
+	if !reflect.DeepEqual(aliases, want) {
+		t.Fatalf("got %+v, want %+v", aliases, want)
+	}
+}
+
+func testMergeDocument(t *testing.T, s store.ProgressStore) {
+	ctx := context.Background()
+	// alice read the alias last, bob the document and carol only the alias
+	mustUpdate(t, s, "alice", progress("doc", 0.1, 100))
+	mustUpdate(t, s, "alice", progress("alias", 0.5, 200))
+	mustUpdate(t, s, "bob", progress("doc", 0.7, 300))
+	mustUpdate(t, s, "bob", progress("alias", 0.2, 100))
+	mustUpdate(t, s, "carol", progress("alias", 0.3, 100))
+	mustUpdate(t, s, "carol", progress("other", 0.9, 100))
+
+	merged, err := s.MergeDocument(ctx, &store.DocumentAlias{Alias: "alias", Document: "doc"})
+	if err != nil {
+		t.Fatalf("merge document: %s", err)
+	}
+	if merged != 2 {
+		t.Errorf("expected 2 records moved, got %d", merged)
+	}
+
+	document, err := s.ResolveDocumentAlias(ctx, "alias")
+	if err != nil || document != "doc" {
+		t.Fatalf("expected the alias to be saved, got %q %v", document, err)
+	}
+	for user, want := range map[string]float64{"alice": 0.5, "bob": 0.7, "carol": 0.3} {
+		got := mustGet(t, s, user, "doc")
+		if got.Document != "doc" || got.Percentage != want {
+			t.Errorf("%s: expected the newer progress at %v, got %+v", user, want, got)
+		}
+		_, err = s.GetProgress(ctx, user, "alias")
+		if !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("%s: expected the progress of the alias to be gone, got %v", user, err)
+		}
+		positions, err := s.ListDeviceProgress(ctx, user, "alias")
+		if err != nil {
+			t.Fatalf("list device progress: %s", err)
+		}
+		if len(positions) != 0 {
+			t.Errorf("%s: expected the devices of the alias to be gone, got %+v", user, positions)
+		}
+	}
+	positions, err := s.ListDeviceProgress(ctx, "carol", "doc")
+	if err != nil {
+		t.Fatalf("list device progress: %s", err)
+	}
+	if len(positions) != 1 || positions[0].Percentage != 0.3 {
+		t.Errorf("expected the moved progress to update its device, got %+v", positions)
+	}
+	mustGet(t, s, "carol", "other")
+}
+
+func testPing(t *testing.T, s store.ProgressStore) {
+	err := s.Ping(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testConcurrentUpdates has many devices syncing at once, as happens when
+// several readers are closed together, every update must succeed.
+func testConcurrentUpdates(t *testing.T, s store.ProgressStore) {
+	const writers, updates = 32, 50
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user := fmt.Sprintf("user%d", w%4)
+			for i := range updates {
+				p := progress(fmt.Sprintf("doc%d", w), float64(i)/updates, int64(i+1))
+				err := s.UpdateProgress(ctx, user, p)
+				if err == nil {
+					_, err = s.GetProgress(ctx, user, p.Document)
+				}
+				if err == nil && i%10 == 0 {
+					_, err = s.ListProgress(ctx, user)
+				}
+				if err != nil {
+					errs <- fmt.Errorf("writer %d update %d: %s", w, i, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if t.Failed() {
+		return
+	}
+
+	for w := range writers {
+		p := mustGet(t, s, fmt.Sprintf("user%d", w%4), fmt.Sprintf("doc%d", w))
+		if p.Timestamp != updates {
+			t.Errorf("writer %d: expected the last update to win, got %+v", w, p)
+		}
+	}
+}
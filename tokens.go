@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ficoos/kokosync/kosync"
+	"github.com/ficoos/kokosync/store"
+)
+
+const (
+	// tokenPrefix starts every sync token so they are easy to recognize
+	tokenPrefix        = "kks_"
+	maxTokenNameLength = 64
+	// tokenUseInterval is how stale the last use of a token may get before
+	// it is updated, so syncing doesn't write on every request
+	tokenUseInterval = time.Minute
+)
+
+var tokenEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var errTokenNotFound = errors.New("token not found")
+
+// md5Key returns the key KOReader sends for password, the md5 of it.
+func md5Key(password string) string {
+	sum := md5.Sum([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenHash returns the hash a token is stored under for a key. KOReader
+// sends the md5 of the token typed as the password, other clients may send
+// the token itself.
+func tokenHash(key string) string {
+	if strings.HasPrefix(key, tokenPrefix) {
+		key = md5Key(key)
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken returns a random sync token and the ID it is known by.
+func newToken() (token string, id string) {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	idBytes := make([]byte, 6)
+	rand.Read(idBytes)
+	return tokenPrefix + strings.ToLower(tokenEncoding.EncodeToString(secret)), hex.EncodeToString(idBytes)
+}
+
+// authorize accepts the sync tokens of the user and otherwise asks Komga.
+// It returns the user progress is stored under and the upstream client when
+// Komga accepted the key, nil when a sync token did since there is no Komga
+// key to sync upstream with.
+func (s *BridgeImpl) authorize(ctx context.Context, auth *kosync.Auth) (string, *kosync.Client, error) {
+	user, err := s.canonicalUser(ctx, auth.User)
+	if err != nil {
+		return "", nil, err
+	}
+	if user != "" && auth.Key != "" {
+		t, err := s.dal.FindToken(ctx, user, tokenHash(auth.Key))
+		if err == nil {
+			s.usedToken(ctx, t)
+			recordLogin(ctx, nil)
+			return user, nil, nil
+		}
+		if !errors.Is(err, store.ErrNotFound) {
+			return "", nil, fmt.Errorf("find token [user=%s]: %s", user, err)
+		}
+	}
+
+	us := s.upstreamClient(auth)
+	err = us.Authorize(ctx)
+	recordLogin(ctx, err)
+	return user, us, err
+}
+
+// usedToken records the use of t, failing to is only logged.
+func (s *BridgeImpl) usedToken(ctx context.Context, t *store.Token) {
+	now := time.Now()
+	if now.Sub(time.Unix(t.LastUsed, 0)) < tokenUseInterval {
+		return
+	}
+	err := s.dal.UseToken(ctx, t.User, t.ID, now.Unix())
+	if err != nil {
+		slog.WarnContext(ctx, "record token use failed", "user", t.User, "token_id", t.ID, "error", err)
+	}
+}
+
+// issuedToken is a token as it is handed out, the only time the token
+// itself is seen.
+type issuedToken struct {
+	*store.Token
+	Secret string `json:"token"`
+}
+
+// issueToken checks password with Komga and creates a sync token for the
+// user login is stored as. A wrong password is kosync.ErrUnauthorized, bad
+// arguments are kosync.ErrBadRequest.
+func (s *BridgeImpl) issueToken(ctx context.Context, login string, password string, name string) (*issuedToken, error) {
+	name = strings.TrimSpace(name)
+	if login == "" || password == "" {
+		return nil, fmt.Errorf("%w: user and password are required", kosync.ErrBadRequest)
+	}
+	if utf8.RuneCountInString(name) > maxTokenNameLength {
+		return nil, fmt.Errorf("%w: name is longer than %d characters", kosync.ErrBadRequest, maxTokenNameLength)
+	}
+
+	err := s.upstreamClient(&kosync.Auth{User: login, Key: md5Key(password)}).Authorize(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("authorize with komga: %w", err)
+	}
+
+	user, err := s.canonicalUser(ctx, login)
+	if err != nil {
+		return nil, err
+	}
+	token, id := newToken()
+	t := &store.Token{User: user, ID: id, Name: name, Hash: tokenHash(token), Created: time.Now().Unix()}
+	err = s.dal.CreateToken(ctx, t)
+	if err != nil {
+		return nil, fmt.Errorf("save token [user=%s]: %s", user, err)
+	}
+
+	slog.InfoContext(ctx, "issued sync token", "user", user, "token_id", id, "name", name)
+	return &issuedToken{Token: t, Secret: token}, nil
+}
+
+// listTokens writes the tokens of user, or of everyone when user is empty.
+func listTokens(w http.ResponseWriter, r *http.Request, dal store.ProgressStore, user string) {
+	tokens, err := dal.ListTokens(r.Context(), user)
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("list tokens [user=%s]: %s", user, err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, tokens)
+}
+
+func revokeToken(w http.ResponseWriter, r *http.Request, dal store.ProgressStore, user string, id string) {
+	err := dal.RevokeToken(r.Context(), user, id)
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSONError(w, r, http.StatusNotFound, errTokenNotFound)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("revoke token [user=%s token_id=%s]: %s", user, id, err))
+		return
+	}
+
+	slog.InfoContext(r.Context(), "revoked sync token", "user", user, "token_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/ficoos/kokosync/kosync"
+	"github.com/ficoos/kokosync/store"
+)
+
+// UserNormalization says how login names are turned into user names before
+// they are used, Komga logins are e-mail addresses and ignore case.
+type UserNormalization struct {
+	Trim bool
+	Fold bool
+}
+
+// ParseUserNormalization parses a list of trim and fold.
+func ParseUserNormalization(names []string) (UserNormalization, error) {
+	var n UserNormalization
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case "trim":
+			n.Trim = true
+		case "fold":
+			n.Fold = true
+		default:
+			return n, fmt.Errorf("unknown user normalization %q, expected trim or fold", name)
+		}
+	}
+
+	return n, nil
+}
+
+func (n UserNormalization) Normalize(login string) string {
+	if n.Trim {
+		login = strings.TrimSpace(login)
+	}
+	if n.Fold {
+		login = strings.ToLower(login)
+	}
+	return login
+}
+
+var errAliasNotFound = errors.New("alias not found")
+
+// canonicalUser returns the user progress of login is stored under: the
+// normalized login, or the user it is an alias of.
+func (s *BridgeImpl) canonicalUser(ctx context.Context, login string) (string, error) {
+	user := s.users.Normalize(login)
+	canonical, err := s.dal.ResolveAlias(ctx, user)
+	if errors.Is(err, store.ErrNotFound) {
+		return user, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("resolve alias [login=%s]: %s", login, err)
+	}
+
+	return canonical, nil
+}
+
+// userNames resolves login names like canonicalUser with the aliases
+// loaded once, for bulk work like imports that can't query the store for
+// every record.
+type userNames struct {
+	users   UserNormalization
+	aliases map[string]string
+}
+
+func (s *BridgeImpl) loadUserNames(ctx context.Context) (*userNames, error) {
+	aliases, err := s.dal.ListAliases(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list aliases: %s", err)
+	}
+	n := &userNames{users: s.users, aliases: map[string]string{}}
+	for _, a := range aliases {
+		n.aliases[a.Alias] = a.User
+	}
+
+	return n, nil
+}
+
+func (n *userNames) canonical(login string) string {
+	user := n.users.Normalize(login)
+	if canonical, ok := n.aliases[user]; ok {
+		return canonical
+	}
+	return user
+}
+
+// setAlias makes alias log in as user. Aliases are normalized like logins,
+// user is taken as is so aliases can point at names stored before
+// normalization was turned on. Aliases of aliases are refused.
+func (s *BridgeImpl) setAlias(ctx context.Context, alias string, user string) (*store.Alias, error) {
+	a := &store.Alias{Alias: s.users.Normalize(alias), User: user}
+	if a.Alias == "" || a.User == "" {
+		return nil, fmt.Errorf("%w: alias and user are required", kosync.ErrBadRequest)
+	}
+	if a.Alias == a.User {
+		return nil, fmt.Errorf("%w: %s can't be an alias of itself", kosync.ErrBadRequest, a.Alias)
+	}
+	_, err := s.dal.ResolveAlias(ctx, a.User)
+	if err == nil {
+		return nil, fmt.Errorf("%w: %s is an alias itself", kosync.ErrBadRequest, a.User)
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+	aliases, err := s.dal.ListAliases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, existing := range aliases {
+		if existing.User == a.Alias {
+			return nil, fmt.Errorf("%w: %s has aliases of its own", kosync.ErrBadRequest, a.Alias)
+		}
+	}
+
+	err = s.dal.SetAlias(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.InfoContext(ctx, "set user alias", "alias", a.Alias, "user", a.User)
+	return a, nil
+}
+
+func listAliases(w http.ResponseWriter, r *http.Request, dal store.ProgressStore) {
+	aliases, err := dal.ListAliases(r.Context())
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("list aliases: %s", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, aliases)
+}
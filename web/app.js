@@ -0,0 +1,192 @@
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+
+async function api(method, path, body) {
+  const opts = {
+    method,
+    headers: { "X-Requested-With": "kokosync" },
+    credentials: "same-origin",
+  };
+  if (body !== undefined) {
+    opts.headers["Content-Type"] = "application/json";
+    opts.body = JSON.stringify(body);
+  }
+  const resp = await fetch("api/" + path, opts);
+  let data = null;
+  if (resp.status !== 204) {
+    data = await resp.json().catch(() => null);
+  }
+  if (!resp.ok) {
+    const err = new Error((data && data.message) || resp.statusText);
+    err.status = resp.status;
+    throw err;
+  }
+  return data;
+}
+
+function show(el, visible) {
+  el.hidden = !visible;
+}
+
+function showError(el, err) {
+  el.textContent = err ? err.message : "";
+  show(el, !!err);
+}
+
+function renderProgress(records) {
+  const rows = $("progress-rows");
+  const template = $("progress-row");
+  rows.replaceChildren();
+  for (const p of records) {
+    const row = template.content.cloneNode(true);
+    row.querySelector(".document").textContent = p.document;
+    row.querySelector(".percentage progress").value = p.percentage;
+    row.querySelector(".percentage span").textContent = (p.percentage * 100).toFixed(1) + "%";
+    row.querySelector(".device").textContent = p.device;
+    row.querySelector(".timestamp").textContent = new Date(p.timestamp * 1000).toLocaleString();
+    row.querySelector(".reset").addEventListener("click", () => reset(p.document));
+    rows.appendChild(row);
+  }
+  show($("progress-empty"), records.length === 0);
+}
+
+function renderDevices(devices) {
+  const rows = $("device-rows");
+  const template = $("device-row");
+  rows.replaceChildren();
+  for (const d of devices) {
+    const row = template.content.cloneNode(true);
+    row.querySelector("tr").classList.toggle("blocked", d.blocked);
+    row.querySelector(".name").textContent = d.label || d.device;
+    row.querySelector(".id").textContent = d.device_id;
+    row.querySelector(".first-seen").textContent = new Date(d.first_seen * 1000).toLocaleString();
+    row.querySelector(".last-seen").textContent = new Date(d.last_seen * 1000).toLocaleString();
+    row.querySelector(".address").textContent = d.last_ip;
+    row.querySelector(".rename").addEventListener("click", () => rename(d));
+    const block = row.querySelector(".block");
+    block.textContent = d.blocked ? "Unblock" : "Block";
+    block.addEventListener("click", () => setBlocked(d, !d.blocked));
+    rows.appendChild(row);
+  }
+  show($("devices"), devices.length > 0);
+}
+
+let events = null;
+
+// listen starts following progress changes made from other devices.
+function listen() {
+  if (events) {
+    return;
+  }
+  events = new EventSource("api/events");
+  events.addEventListener("progress", () => refresh());
+}
+
+function stopListening() {
+  if (events) {
+    events.close();
+    events = null;
+  }
+}
+
+async function refresh() {
+  try {
+    renderProgress(await api("GET", "progress"));
+    showError($("progress-error"), null);
+  } catch (err) {
+    showError($("progress-error"), err);
+  }
+  await refreshDevices();
+}
+
+async function refreshDevices() {
+  try {
+    renderDevices(await api("GET", "devices"));
+    showError($("devices-error"), null);
+  } catch (err) {
+    showError($("devices-error"), err);
+  }
+}
+
+async function load() {
+  try {
+    const session = await api("GET", "session");
+    $("session-user").textContent = session.user;
+    show($("session"), true);
+    show($("login"), false);
+    show($("progress"), true);
+    renderProgress(await api("GET", "progress"));
+    showError($("progress-error"), null);
+    await refreshDevices();
+    listen();
+  } catch (err) {
+    if (err.status === 401) {
+      stopListening();
+      show($("session"), false);
+      show($("progress"), false);
+      show($("devices"), false);
+      show($("login"), true);
+      return;
+    }
+    showError($("progress-error"), err);
+  }
+}
+
+async function reset(document) {
+  if (!confirm("Reset the progress of " + document + "?")) {
+    return;
+  }
+  try {
+    await api("DELETE", "progress/" + encodeURIComponent(document));
+    await load();
+  } catch (err) {
+    showError($("progress-error"), err);
+  }
+}
+
+async function rename(device) {
+  const label = prompt("Name for " + device.device_id, device.label || device.device);
+  if (label === null) {
+    return;
+  }
+  try {
+    await api("PATCH", "devices/" + encodeURIComponent(device.device_id), { label });
+    await refreshDevices();
+  } catch (err) {
+    showError($("devices-error"), err);
+  }
+}
+
+async function setBlocked(device, blocked) {
+  const name = device.label || device.device;
+  if (blocked && !confirm("Block " + name + "? It won't be able to sync until it is unblocked.")) {
+    return;
+  }
+  try {
+    await api("PATCH", "devices/" + encodeURIComponent(device.device_id), { blocked });
+    await refreshDevices();
+  } catch (err) {
+    showError($("devices-error"), err);
+  }
+}
+
+$("login").addEventListener("submit", async (ev) => {
+  ev.preventDefault();
+  const form = new FormData(ev.target);
+  try {
+    await api("POST", "login", { user: form.get("user"), password: form.get("password") });
+    ev.target.reset();
+    showError($("login-error"), null);
+    await load();
+  } catch (err) {
+    showError($("login-error"), err);
+  }
+});
+
+$("logout").addEventListener("click", async () => {
+  await api("POST", "logout").catch(() => {});
+  await load();
+});
+
+load();
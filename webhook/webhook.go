@@ -0,0 +1,321 @@
+// Package webhook delivers reading progress events to HTTP endpoints.
+//
+// Every delivery is a POST of a JSON Payload. When a secret is configured
+// the body is signed with HMAC-SHA256 and the hex digest is sent in the
+// X-Kokosync-Signature header as sha256=<digest>.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ficoos/kokosync/kosync"
+	"github.com/ficoos/kokosync/reqid"
+)
+
+const (
+	SignatureHeader = "X-Kokosync-Signature"
+	EventHeader     = "X-Kokosync-Event"
+	DeliveryHeader  = "X-Kokosync-Delivery"
+)
+
+type Event string
+
+const (
+	// EventProgressUpdated is sent for every accepted progress update
+	EventProgressUpdated Event = "progress.updated"
+	// EventDocumentStarted is sent the first time a user syncs a document
+	EventDocumentStarted Event = "document.started"
+	// EventDocumentFinished is sent when the progress crosses the finished
+	// threshold
+	EventDocumentFinished Event = "document.finished"
+)
+
+var allEvents = []Event{EventProgressUpdated, EventDocumentStarted, EventDocumentFinished}
+
+func ParseEvents(raw []string) ([]Event, error) {
+	var res []Event
+	for _, name := range raw {
+		e := Event(strings.ToLower(name))
+		found := false
+		for _, known := range allEvents {
+			found = found || e == known
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown webhook event %q", name)
+		}
+		res = append(res, e)
+	}
+
+	return res, nil
+}
+
+type Payload struct {
+	ID       string           `json:"id"`
+	Event    Event            `json:"event"`
+	Time     int64            `json:"time"`
+	User     string           `json:"user"`
+	Progress *kosync.Progress `json:"progress"`
+}
+
+type Config struct {
+	URLs   []string
+	Secret string
+	// Events to send, all of them when empty
+	Events []Event
+	// FinishedAt is the percentage a document counts as finished at
+	FinishedAt float64
+	// MaxAttempts is how often a delivery is tried, at least once
+	MaxAttempts int
+	Timeout     time.Duration
+}
+
+// Delivery is the outcome of one attempt at delivering a payload.
+type Delivery struct {
+	ID       string    `json:"id"`
+	Event    Event     `json:"event"`
+	URL      string    `json:"url"`
+	Attempt  int       `json:"attempt"`
+	Time     time.Time `json:"time"`
+	Status   int       `json:"status,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Duration float64   `json:"duration_seconds"`
+}
+
+// Observer is notified about the outcome of every delivery attempt.
+type Observer func(event Event, result string)
+
+const (
+	// maxPending bounds deliveries waiting to be attempted, events beyond
+	// it are dropped
+	maxPending = 1024
+	// maxConcurrent bounds deliveries in flight
+	maxConcurrent = 8
+	// logSize is how many attempts Deliveries remembers
+	logSize = 100
+
+	maxBackoff = 5 * time.Minute
+)
+
+type Dispatcher struct {
+	conf       Config
+	events     map[Event]bool
+	httpClient *http.Client
+	// backoff returns the delay before retry n, starting at 1
+	backoff  func(n int) time.Duration
+	observer Observer
+
+	sem     chan struct{}
+	mu      sync.Mutex
+	pending int
+	log     []Delivery
+	next    int
+}
+
+func NewDispatcher(conf Config) *Dispatcher {
+	events := map[Event]bool{}
+	if len(conf.Events) == 0 {
+		conf.Events = allEvents
+	}
+	for _, e := range conf.Events {
+		events[e] = true
+	}
+	if conf.MaxAttempts < 1 {
+		conf.MaxAttempts = 1
+	}
+
+	return &Dispatcher{
+		conf:       conf,
+		events:     events,
+		httpClient: &http.Client{Timeout: conf.Timeout},
+		backoff: func(n int) time.Duration {
+			// 1s<<9 is past maxBackoff, larger shifts would overflow
+			return min(time.Second<<min(n-1, 9), maxBackoff)
+		},
+		sem: make(chan struct{}, maxConcurrent),
+		log: make([]Delivery, 0, logSize),
+	}
+}
+
+// SetObserver sets a function to be called after every delivery attempt.
+func (d *Dispatcher) SetObserver(observer Observer) {
+	d.observer = observer
+}
+
+// ProgressChanged sends the events a progress update causes. previous is
+// the progress before the update, nil if the user had none.
+func (d *Dispatcher) ProgressChanged(user string, previous *kosync.Progress, current *kosync.Progress) {
+	var events []Event
+	events = append(events, EventProgressUpdated)
+	if previous == nil {
+		events = append(events, EventDocumentStarted)
+	}
+	if current.Percentage >= d.conf.FinishedAt && (previous == nil || previous.Percentage < d.conf.FinishedAt) {
+		events = append(events, EventDocumentFinished)
+	}
+
+	for _, e := range events {
+		if !d.events[e] {
+			continue
+		}
+		payload := &Payload{
+			ID:       reqid.New(),
+			Event:    e,
+			Time:     time.Now().Unix(),
+			User:     user,
+			Progress: current,
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			slog.Error("encode webhook payload", "event", e, "error", err)
+			continue
+		}
+		for _, url := range d.conf.URLs {
+			d.enqueue(url, payload, body)
+		}
+	}
+}
+
+func (d *Dispatcher) enqueue(url string, payload *Payload, body []byte) {
+	d.mu.Lock()
+	if d.pending >= maxPending {
+		d.mu.Unlock()
+		slog.Warn("webhook queue full, dropping event", "event", payload.Event, "delivery", payload.ID, "url", url)
+		d.observe(payload.Event, "dropped")
+		return
+	}
+	d.pending++
+	d.mu.Unlock()
+
+	go func() {
+		defer func() {
+			d.mu.Lock()
+			d.pending--
+			d.mu.Unlock()
+		}()
+		d.deliver(url, payload, body)
+	}()
+}
+
+// deliver attempts delivery until it succeeds, fails permanently or runs
+// out of attempts.
+func (d *Dispatcher) deliver(url string, payload *Payload, body []byte) {
+	for attempt := 1; ; attempt++ {
+		d.sem <- struct{}{}
+		status, err := d.post(url, payload, body, attempt)
+		<-d.sem
+
+		retry := err != nil || status == http.StatusTooManyRequests || status >= 500
+		ok := err == nil && status < 300
+		result := "ok"
+		switch {
+		case ok:
+		case retry && attempt < d.conf.MaxAttempts:
+			result = "retry"
+		default:
+			result = "failed"
+		}
+		d.observe(payload.Event, result)
+
+		if ok {
+			slog.Debug("webhook delivered", "event", payload.Event, "delivery", payload.ID, "url", url, "attempt", attempt)
+			return
+		}
+		if result == "failed" {
+			slog.Warn("webhook delivery failed", "event", payload.Event, "delivery", payload.ID, "url", url, "attempt", attempt, "status", status, "error", err)
+			return
+		}
+		delay := d.backoff(attempt)
+		slog.Info("webhook delivery failed, retrying", "event", payload.Event, "delivery", payload.ID, "url", url, "attempt", attempt, "status", status, "error", err, "retry_in", delay)
+		time.Sleep(delay)
+	}
+}
+
+func (d *Dispatcher) observe(event Event, result string) {
+	if d.observer != nil {
+		d.observer(event, result)
+	}
+}
+
+// Sign returns the signature of body for secret as sent in
+// SignatureHeader.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *Dispatcher) post(url string, payload *Payload, body []byte, attempt int) (int, error) {
+	start := time.Now()
+	status, err := func() (int, error) {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "kokosync-webhook")
+		req.Header.Set(EventHeader, string(payload.Event))
+		req.Header.Set(DeliveryHeader, payload.ID)
+		if d.conf.Secret != "" {
+			req.Header.Set(SignatureHeader, Sign(d.conf.Secret, body))
+		}
+
+		resp, err := d.httpClient.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}()
+
+	delivery := Delivery{
+		ID:       payload.ID,
+		Event:    payload.Event,
+		URL:      url,
+		Attempt:  attempt,
+		Time:     start,
+		Status:   status,
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	d.record(delivery)
+
+	return status, err
+}
+
+// record adds an attempt to the ring of recent attempts.
+func (d *Dispatcher) record(delivery Delivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.log) < logSize {
+		d.log = append(d.log, delivery)
+		return
+	}
+	d.log[d.next] = delivery
+	d.next = (d.next + 1) % logSize
+}
+
+// Deliveries returns the most recent delivery attempts, newest first.
+func (d *Dispatcher) Deliveries() []Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res := make([]Delivery, 0, len(d.log))
+	for i := range len(d.log) {
+		// the oldest entry is at next once the ring is full
+		res = append(res, d.log[(d.next+len(d.log)-1-i)%len(d.log)])
+	}
+
+	return res
+}
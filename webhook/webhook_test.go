@@ -0,0 +1,302 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ficoos/kokosync/kosync"
+)
+
+// request is a delivery as the stand-in endpoint received it.
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+// endpoint is a local stand-in for a webhook receiver answering with the
+// next of statuses, the last one once they run out.
+type endpoint struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	requests []request
+}
+
+func newEndpoint(t *testing.T, statuses ...int) *endpoint {
+	e := &endpoint{statuses: statuses}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		e.mu.Lock()
+		e.requests = append(e.requests, request{header: r.Header.Clone(), body: body})
+		status := e.statuses[min(len(e.requests), len(e.statuses))-1]
+		e.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+func (e *endpoint) received() []request {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return slices.Clone(e.requests)
+}
+
+// newTestDispatcher returns a dispatcher that retries without waiting and
+// a channel of the result of every attempt.
+func newTestDispatcher(conf Config) (*Dispatcher, chan string) {
+	if conf.Timeout == 0 {
+		conf.Timeout = 5 * time.Second
+	}
+	d := NewDispatcher(conf)
+	d.backoff = func(int) time.Duration { return 0 }
+	results := make(chan string, 100)
+	d.SetObserver(func(event Event, result string) {
+		results <- result
+	})
+	return d, results
+}
+
+// waitDone waits for n deliveries to succeed or fail and returns the
+// result of every attempt.
+func waitDone(t *testing.T, results chan string, n int) []string {
+	t.Helper()
+	var res []string
+	for n > 0 {
+		select {
+		case r := <-results:
+			res = append(res, r)
+			if r != "retry" {
+				n--
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for deliveries, got %v", res)
+		}
+	}
+	return res
+}
+
+func TestSignature(t *testing.T) {
+	e := newEndpoint(t, http.StatusNoContent)
+	d, results := newTestDispatcher(Config{URLs: []string{e.URL}, Secret: "s3cret", Events: []Event{EventProgressUpdated}})
+
+	p := &kosync.Progress{Document: "0123456789abcdef0123456789abcdef", Progress: "/body/DocFragment[3].0", Percentage: 0.25, Device: "kobo", DeviceID: "K1"}
+	d.ProgressChanged("alice", p, p)
+	waitDone(t, results, 1)
+
+	reqs := e.received()
+	if len(reqs) != 1 {
+		t.Fatalf("received %d requests, expected 1", len(reqs))
+	}
+	r := reqs[0]
+	if got, want := r.header.Get(SignatureHeader), Sign("s3cret", r.body); got != want {
+		t.Fatalf("signature is %q, expected %q", got, want)
+	}
+	if got := r.header.Get(EventHeader); got != string(EventProgressUpdated) {
+		t.Fatalf("event header is %q", got)
+	}
+	var payload Payload
+	err := json.Unmarshal(r.body, &payload)
+	if err != nil {
+		t.Fatalf("decode payload: %s", err)
+	}
+	if payload.ID == "" || payload.ID != r.header.Get(DeliveryHeader) {
+		t.Fatalf("payload id %q doesn't match delivery header %q", payload.ID, r.header.Get(DeliveryHeader))
+	}
+	if payload.User != "alice" || payload.Event != EventProgressUpdated || *payload.Progress != *p {
+		t.Fatalf("unexpected payload %+v", payload)
+	}
+}
+
+// TestSignatureKnownValue checks Sign against RFC 4231 test case 2.
+func TestSignatureKnownValue(t *testing.T) {
+	got := Sign("Jefe", []byte("what do ya want for nothing?"))
+	want := "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+	if got != want {
+		t.Fatalf("signature is %q, expected %q", got, want)
+	}
+}
+
+func TestUnsigned(t *testing.T) {
+	e := newEndpoint(t, http.StatusOK)
+	d, results := newTestDispatcher(Config{URLs: []string{e.URL}, Events: []Event{EventProgressUpdated}})
+
+	p := &kosync.Progress{Document: "d", Percentage: 0.5}
+	d.ProgressChanged("alice", p, p)
+	waitDone(t, results, 1)
+
+	if got := e.received()[0].header.Get(SignatureHeader); got != "" {
+		t.Fatalf("unsigned delivery has signature %q", got)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	progress := func(percentage float64) *kosync.Progress {
+		return &kosync.Progress{Document: "d", Percentage: percentage}
+	}
+	tests := []struct {
+		name     string
+		previous *kosync.Progress
+		current  *kosync.Progress
+		events   []Event
+	}{
+		{"first sync", nil, progress(0.1), []Event{EventProgressUpdated, EventDocumentStarted}},
+		{"first sync finished", nil, progress(0.95), []Event{EventProgressUpdated, EventDocumentStarted, EventDocumentFinished}},
+		{"reading", progress(0.1), progress(0.2), []Event{EventProgressUpdated}},
+		{"finishing", progress(0.5), progress(0.9), []Event{EventProgressUpdated, EventDocumentFinished}},
+		{"already finished", progress(0.92), progress(0.97), []Event{EventProgressUpdated}},
+		{"going back", progress(0.97), progress(0.5), []Event{EventProgressUpdated}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEndpoint(t, http.StatusOK)
+			d, results := newTestDispatcher(Config{URLs: []string{e.URL}, FinishedAt: 0.9})
+
+			d.ProgressChanged("alice", tt.previous, tt.current)
+			waitDone(t, results, len(tt.events))
+
+			var events []Event
+			for _, r := range e.received() {
+				events = append(events, Event(r.header.Get(EventHeader)))
+			}
+			slices.Sort(events)
+			want := slices.Clone(tt.events)
+			slices.Sort(want)
+			if !slices.Equal(events, want) {
+				t.Fatalf("sent %v, expected %v", events, want)
+			}
+		})
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	e := newEndpoint(t, http.StatusOK)
+	d, results := newTestDispatcher(Config{URLs: []string{e.URL}, FinishedAt: 0.9, Events: []Event{EventDocumentFinished}})
+
+	d.ProgressChanged("alice", nil, &kosync.Progress{Document: "d", Percentage: 1})
+	waitDone(t, results, 1)
+
+	reqs := e.received()
+	if len(reqs) != 1 || reqs[0].header.Get(EventHeader) != string(EventDocumentFinished) {
+		t.Fatalf("received %d requests, expected only %s", len(reqs), EventDocumentFinished)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		results  []string
+	}{
+		{"ok", []int{http.StatusOK}, []string{"ok"}},
+		{"server error", []int{http.StatusInternalServerError}, []string{"retry", "retry", "failed"}},
+		{"unavailable then ok", []int{http.StatusServiceUnavailable, http.StatusOK}, []string{"retry", "ok"}},
+		{"too many requests", []int{http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusAccepted}, []string{"retry", "retry", "ok"}},
+		{"bad request", []int{http.StatusBadRequest}, []string{"failed"}},
+		{"not found", []int{http.StatusNotFound, http.StatusOK}, []string{"failed"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEndpoint(t, tt.statuses...)
+			d, results := newTestDispatcher(Config{URLs: []string{e.URL}, Events: []Event{EventProgressUpdated}, MaxAttempts: 3})
+			var delays []int
+			d.backoff = func(n int) time.Duration {
+				delays = append(delays, n)
+				return 0
+			}
+
+			p := &kosync.Progress{Document: "d", Percentage: 0.5}
+			d.ProgressChanged("alice", p, p)
+			got := waitDone(t, results, 1)
+
+			if !slices.Equal(got, tt.results) {
+				t.Fatalf("attempts ended in %v, expected %v", got, tt.results)
+			}
+			if n := len(e.received()); n != len(tt.results) {
+				t.Fatalf("received %d requests, expected %d", n, len(tt.results))
+			}
+			for i, n := range delays {
+				if n != i+1 {
+					t.Fatalf("backoff called for retries %v, expected 1, 2, ...", delays)
+				}
+			}
+			if len(delays) != len(tt.results)-1 {
+				t.Fatalf("backoff called %d times, expected %d", len(delays), len(tt.results)-1)
+			}
+			deliveries := d.Deliveries()
+			if len(deliveries) != len(tt.results) || deliveries[0].Attempt != len(tt.results) {
+				t.Fatalf("recorded %+v", deliveries)
+			}
+		})
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	e := newEndpoint(t, http.StatusOK)
+	url := e.URL
+	e.Close()
+	d, results := newTestDispatcher(Config{URLs: []string{url}, Events: []Event{EventProgressUpdated}, MaxAttempts: 2})
+
+	p := &kosync.Progress{Document: "d"}
+	d.ProgressChanged("alice", p, p)
+	got := waitDone(t, results, 1)
+
+	if !slices.Equal(got, []string{"retry", "failed"}) {
+		t.Fatalf("attempts ended in %v", got)
+	}
+	if deliveries := d.Deliveries(); deliveries[0].Error == "" || deliveries[0].Status != 0 {
+		t.Fatalf("recorded %+v", deliveries[0])
+	}
+}
+
+func TestDeliveries(t *testing.T) {
+	d := NewDispatcher(Config{})
+	if got := d.Deliveries(); len(got) != 0 {
+		t.Fatalf("new dispatcher has deliveries %+v", got)
+	}
+
+	for i := 1; i <= 3; i++ {
+		d.record(Delivery{Attempt: i})
+	}
+	assertAttempts(t, d.Deliveries(), 3, 1)
+
+	for i := 4; i <= logSize+25; i++ {
+		d.record(Delivery{Attempt: i})
+	}
+	assertAttempts(t, d.Deliveries(), logSize+25, 26)
+}
+
+// assertAttempts checks deliveries are numbered newest down to oldest.
+func assertAttempts(t *testing.T, deliveries []Delivery, newest int, oldest int) {
+	t.Helper()
+	if len(deliveries) != newest-oldest+1 {
+		t.Fatalf("%d deliveries, expected %d", len(deliveries), newest-oldest+1)
+	}
+	for i, delivery := range deliveries {
+		if delivery.Attempt != newest-i {
+			t.Fatalf("delivery %d is attempt %d, expected %d", i, delivery.Attempt, newest-i)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := NewDispatcher(Config{})
+	for n, want := range map[int]time.Duration{
+		1:    time.Second,
+		2:    2 * time.Second,
+		9:    256 * time.Second,
+		10:   maxBackoff,
+		35:   maxBackoff,
+		1000: maxBackoff,
+	} {
+		if got := d.backoff(n); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", n, got, want)
+		}
+	}
+}
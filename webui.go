@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ficoos/kokosync/kosync"
+	"github.com/ficoos/kokosync/realip"
+	"github.com/ficoos/kokosync/store"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+const sessionCookie = "kokosync_session"
+
+// sessions are stateless, the cookie holds the user and expiry signed with
+// a server secret.
+type sessions struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+func newSessions(secret string, ttl time.Duration) *sessions {
+	return &sessions{secret: []byte(secret), ttl: ttl}
+}
+
+func (s *sessions) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *sessions) issue(user string) (string, time.Time) {
+	expires := time.Now().Add(s.ttl)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(user)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + s.sign(payload), expires
+}
+
+// verify returns the user the session belongs to.
+func (s *sessions) verify(value string) (string, bool) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return "", false
+	}
+	payload, sig := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(s.sign(payload))) {
+		return "", false
+	}
+
+	rawUser, rawExpires, ok := strings.Cut(payload, ".")
+	if !ok {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(rawExpires, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", false
+	}
+	user, err := base64.RawURLEncoding.DecodeString(rawUser)
+	if err != nil {
+		return "", false
+	}
+
+	return string(user), true
+}
+
+type WebUI struct {
+	bridge   *BridgeImpl
+	sessions *sessions
+	// path the UI is served at as seen by the browser, used to scope the
+	// cookie
+	path string
+}
+
+type loginRequest struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+type sessionResponse struct {
+	User string `json:"user"`
+}
+
+// NewWebUI returns a handler serving the web UI under /ui/. basePath is
+// the path the browser sees the UI at. Logging in checks the password with
+// Komga and is throttled by limiter.
+func NewWebUI(bridge *BridgeImpl, limiter *RateLimiter, secret string, ttl time.Duration, basePath string) http.Handler {
+	ui := &WebUI{
+		bridge:   bridge,
+		sessions: newSessions(secret, ttl),
+		path:     basePath,
+	}
+
+	static, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic("web ui files missing: " + err.Error())
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /ui/", http.StripPrefix("/ui/", http.FileServerFS(static)))
+	mux.Handle("POST /ui/api/login", requireUIHeader(limiter.Middleware(http.HandlerFunc(ui.login))))
+	mux.Handle("POST /ui/api/logout", requireUIHeader(http.HandlerFunc(ui.logout)))
+	mux.Handle("GET /ui/api/session", ui.requireSession(ui.session))
+	mux.Handle("GET /ui/api/progress", ui.requireSession(ui.listProgress))
+	mux.Handle("DELETE /ui/api/progress/{document}", ui.requireSession(ui.resetProgress))
+	mux.Handle("GET /ui/api/devices", ui.requireSession(ui.listDevices))
+	mux.Handle("PATCH /ui/api/devices/{device}", ui.requireSession(ui.patchDevice))
+	// EventSource can't send headers, the stream only reads
+	mux.Handle("GET /ui/api/events", ui.requireSessionCookie(bridge.events.ServeEvents))
+	mux.Handle("GET /ui", http.RedirectHandler(basePath, http.StatusMovedPermanently))
+
+	return mux
+}
+
+// requireUIHeader only lets through requests made by the UI scripts. Browsers
+// won't send custom headers cross site without a CORS preflight, which is
+// never answered, so this stops CSRF.
+func requireUIHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Requested-With") != "kokosync" {
+			writeJSONError(w, r, http.StatusForbidden, errors.New("missing X-Requested-With header"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (ui *WebUI) requireSession(next func(w http.ResponseWriter, r *http.Request, user string)) http.Handler {
+	return requireUIHeader(ui.requireSessionCookie(next))
+}
+
+// requireSessionCookie checks the session without requiring the UI header,
+// only for read only endpoints browsers can't add headers to.
+func (ui *WebUI) requireSessionCookie(next func(w http.ResponseWriter, r *http.Request, user string)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(sessionCookie)
+		if err != nil {
+			writeJSONError(w, r, http.StatusUnauthorized, errors.New("not logged in"))
+			return
+		}
+		user, ok := ui.sessions.verify(cookie.Value)
+		if !ok {
+			writeJSONError(w, r, http.StatusUnauthorized, errors.New("session expired"))
+			return
+		}
+
+		next(w, r, user)
+	})
+}
+
+func (ui *WebUI) setCookie(w http.ResponseWriter, r *http.Request, value string, expires time.Time) {
+	secure := r.TLS != nil
+	if info := realip.FromContext(r.Context()); info != nil {
+		secure = info.Scheme == "https"
+	}
+	maxAge := int(time.Until(expires).Seconds())
+	if value == "" {
+		maxAge = -1
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     ui.path,
+		Expires:  expires,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func (ui *WebUI) login(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, kosync.DefaultMaxBodySize))
+	err := dec.Decode(&req)
+	if err != nil || req.User == "" || req.Password == "" {
+		writeJSONError(w, r, http.StatusBadRequest, errors.New("user and password are required"))
+		return
+	}
+
+	// KOReader sends the md5 of the password as the key, do the same. Sync
+	// tokens don't open the web UI, it can unblock devices.
+	auth := &kosync.Auth{User: req.User, Key: md5Key(req.Password)}
+	err = ui.bridge.upstreamClient(auth).Authorize(r.Context())
+	recordLogin(r.Context(), err)
+	if err != nil {
+		if errors.Is(err, kosync.ErrUnauthorized) {
+			slog.InfoContext(r.Context(), "web ui login rejected", "auth", auth)
+			writeJSONError(w, r, http.StatusForbidden, errors.New("wrong user name or password"))
+			return
+		}
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("authorize: %s", err))
+		return
+	}
+
+	user, err := ui.bridge.canonicalUser(r.Context(), auth.User)
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	value, expires := ui.sessions.issue(user)
+	ui.setCookie(w, r, value, expires)
+	slog.InfoContext(r.Context(), "web ui login", "auth", auth, "user", user)
+	writeJSON(w, r, http.StatusOK, &sessionResponse{User: user})
+}
+
+func (ui *WebUI) logout(w http.ResponseWriter, r *http.Request) {
+	ui.setCookie(w, r, "", time.Unix(0, 0))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ui *WebUI) session(w http.ResponseWriter, r *http.Request, user string) {
+	writeJSON(w, r, http.StatusOK, &sessionResponse{User: user})
+}
+
+func (ui *WebUI) listProgress(w http.ResponseWriter, r *http.Request, user string) {
+	progress, err := ui.bridge.dal.ListProgress(r.Context(), user)
+	if err != nil {
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("list progress [user=%s]: %s", user, err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, progress)
+}
+
+func (ui *WebUI) resetProgress(w http.ResponseWriter, r *http.Request, user string) {
+	document, ok := pathCanonicalDocument(w, r, ui.bridge)
+	if !ok {
+		return
+	}
+
+	err := ui.bridge.dal.DeleteProgress(r.Context(), user, document)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			writeJSONError(w, r, http.StatusNotFound, kosync.ErrDocNotFound)
+			return
+		}
+		writeJSONError(w, r, http.StatusInternalServerError, fmt.Errorf("delete progress [user=%s document=%s]: %s", user, document, err))
+		return
+	}
+
+	slog.InfoContext(r.Context(), "progress reset from web ui", "user", user, "document", document)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ui *WebUI) listDevices(w http.ResponseWriter, r *http.Request, user string) {
+	listDevices(w, r, ui.bridge.dal, user)
+}
+
+func (ui *WebUI) patchDevice(w http.ResponseWriter, r *http.Request, user string) {
+	patchDevice(w, r, ui.bridge.dal, user, r.PathValue("device"))
+}